@@ -20,18 +20,36 @@ const (
 var (
 	PermDeniedErr = errors.New("Permission denied")
 	TokenNotExistsErr = errors.New("Token not exists")
+	ServerNotExistsErr = errors.New("Server not exists")
+	UserNotExistsErr = errors.New("User not exists")
+	UserExistsErr = errors.New("User already exists")
 	PluginNotExistsErr = errors.New("Plugin not exists")
+	DeviceNotExistsErr = errors.New("Device not exists")
+	MessageNotExistsErr = errors.New("Message not exists")
+	OutboxLimitErr = errors.New("Too many messages are queued for the device")
 	ErrIsDir = errors.New("Plugin not exists")
 )
 
 type UserInfo struct {
 	Username string `json:"username"`
+	// IsUser is true if the token belongs to a user, otherwise Username is generated from the token
+	IsUser   bool   `json:"isUser"`
+}
+
+type User struct {
+	Username    string    `json:"username"`
+	HasPassword bool      `json:"hasPassword"`
+	CreatedAt   time.Time `json:"createdAt"`
 }
 
 type Token struct {
 	Token string `json:"token"`
 	Root  bool   `json:"root"`
 	Expiration *time.Time `json:"expiration"`
+	// Username is the owner of the token, empty if the token does not belong to any user
+	Username string `json:"username,omitempty"`
+	// Scopes limit the operations the token can do, empty if not limited
+	Scopes []string `json:"scopes,omitempty"`
 }
 
 type DaemonToken struct {
@@ -40,6 +58,20 @@ type DaemonToken struct {
 	Expiration *time.Time `json:"expiration"`
 }
 
+// DeviceRecord is a device that has ever connected to a host
+type DeviceRecord struct {
+	Host      string    `json:"host"`
+	Id        int64     `json:"id"`
+	Device    string    `json:"device"`
+	Label     string    `json:"label"`
+	// Note and Tags are written by the admins of the host
+	Note      string    `json:"note"`
+	Tags      []string  `json:"tags"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	LastAddr  string    `json:"last_addr"`
+}
+
 type WebScriptId struct {
 	Id      string `json:"id"`
 	Version string `json:"version"`
@@ -58,6 +90,24 @@ type FileInfo struct {
 	ModTime time.Time `json:"modTime"`
 }
 
+const (
+	MessageQueued = "queued"
+	MessageDelivered = "delivered"
+	MessageExpired = "expired"
+)
+
+// QueuedMessage is a packet in the durable outbox of a device
+type QueuedMessage struct {
+	Id          int64      `json:"id"`
+	Host        string     `json:"host"`
+	Device      int64      `json:"device"`
+	Data        Map        `json:"data"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+}
+
 type DataAPI interface {
 	NewCliToken(expiration *time.Time)(token string, err error)
 	NewDaemonToken(server string, expiration *time.Time)(token string, err error)
@@ -70,12 +120,73 @@ type DataAPI interface {
 	GetUserInfo(token string)(info UserInfo, err error)
 	CheckRootToken(token string)(ok bool)
 	SetRoot(token string, value bool)(err error)
+	// GetScopes returns the scopes of a valid cli token, nil means the token is not limited
+	GetScopes(token string)(scopes []string, err error)
+	SetScopes(token string, scopes []string)(err error)
+	SetCliTokenExpiration(token string, expiration *time.Time)(err error)
+	SetDaemonTokenExpiration(token string, expiration *time.Time)(err error)
+	// RemoveExpiredTokens deletes all expired cli and daemon tokens with their permissions
+	RemoveExpiredTokens()(n int64, err error)
 	CreateServer(id string)(err error)
 	RemoveServer(id string)(err error)
+	// ListServers returns the servers that the token has at least the viewer role on
 	ListServers(token string)(servers []string, err error)
+	// HasServer reports whether the server is registered
+	HasServer(id string)(ok bool, err error)
+	// CheckPerm reports whether the token has at least the viewer role on the server
 	CheckPerm(token string, server string)(ok bool)
+	// SetPerm grants (or revokes) the operator role on the server to the token,
+	// an existing admin grant on the server is kept when granting
 	SetPerm(token string, server string, ok bool)(err error)
 
+	// GetRole returns the highest role that the token has on the host, either granted directly or by its groups.
+	// Root tokens have the admin role on every host
+	GetRole(token string, host string)(role Role)
+	ListGrants(token string)(grants []HostGrant, err error)
+	// SetGrant sets the role of the token on the host pattern, RoleNone removes the grant
+	SetGrant(token string, pattern string, role Role)(err error)
+	CreateGroup(name string)(err error)
+	RemoveGroup(name string)(err error)
+	ListGroups()(groups []Group, err error)
+	SetGroupMember(group string, token string, member bool)(err error)
+	// SetGroupGrant sets the role of the group's members on the host pattern, RoleNone removes the grant
+	SetGroupGrant(group string, pattern string, role Role)(err error)
+
+	// The password arguments are bcrypt hashes, an empty password disables password login
+	CreateUser(username string, password string)(err error)
+	// RemoveUser removes the user and all tokens belong to it
+	RemoveUser(username string)(err error)
+	ListUsers()(users []User, err error)
+	GetUserPassword(username string)(password string, err error)
+	SetUserPassword(username string, password string)(err error)
+	NewUserToken(username string, expiration *time.Time)(token string, err error)
+
+	// SeenDevice creates or updates the record of a connected device, its note and first seen time are kept
+	SeenDevice(device DeviceRecord)(err error)
+	// ListDevices returns the records of the devices of the host, ordered by id
+	ListDevices(host string)(devices []DeviceRecord, err error)
+	// GetDevice returns the record of the device, or DeviceNotExistsErr
+	GetDevice(host string, id int64)(device DeviceRecord, err error)
+	SetDeviceNote(host string, id int64, note string)(err error)
+	// SetDeviceTags sets the normalized tags of the device, they are merged with the tags reported by the device
+	SetDeviceTags(host string, id int64, tags []string)(err error)
+	// ForgetDevice removes the record of the device, it will be recorded again when it connects
+	ForgetDevice(host string, id int64)(err error)
+
+	// QueueMessage appends the message to the outbox of its device, and sets its id and status.
+	// It fails with OutboxLimitErr if limit messages of the device are already queued
+	QueueMessage(msg *QueuedMessage, limit int)(err error)
+	// PendingMessages returns the queued messages of the device that are not expired at now, ordered by id
+	PendingMessages(host string, device int64, now time.Time)(msgs []QueuedMessage, err error)
+	// ListMessages returns the messages of the device in any status, ordered by id
+	ListMessages(host string, device int64)(msgs []QueuedMessage, err error)
+	GetMessage(id int64)(msg QueuedMessage, err error)
+	SetMessageDelivered(id int64, at time.Time)(err error)
+	// SweepMessages marks the queued messages that expired before now,
+	// and removes the delivered and expired messages created before purgeBefore.
+	// n is the count of the newly expired messages
+	SweepMessages(now time.Time, purgeBefore time.Time)(n int64, err error)
+
 	ListCliWebScripts(token string)(scripts []WebScriptId, err error)
 	AddCliWebScript(token string, plugin WebScriptId)(err error)
 	DelCliWebScript(token string, plugin string)(err error)
@@ -98,3 +209,10 @@ func preProcessCliToken(clitoken string)(token string, ok bool){
 	}
 	return clitoken[len(cliTokenPrefix):], true
 }
+
+func preProcessDaemonToken(dmtoken string)(token string, ok bool){
+	if len(dmtoken) != daemonTokenLen || dmtoken[:len(daemonTokenPrefix)] != daemonTokenPrefix {
+		return "", false
+	}
+	return dmtoken[len(daemonTokenPrefix):], true
+}
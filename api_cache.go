@@ -0,0 +1,347 @@
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const maxAuthCacheEntries = 10000
+
+type cachedValue[T any] struct {
+	value   T
+	expires time.Time
+}
+
+type tokenCache struct {
+	auth    *cachedValue[bool]
+	root    *cachedValue[bool]
+	scopes  *cachedValue[[]string]
+	roles   map[string]cachedValue[Role]
+	servers *cachedValue[[]string]
+}
+
+type daemonCacheKey struct {
+	token string
+	host  string
+}
+
+// CachedDataAPI caches the auth and permission checks of another DataAPI in memory.
+// The writes through it invalidate the affected entries at once,
+// and every entry also expires after the ttl, so the changes made by other processes
+// and the tokens that expire by time are picked up eventually.
+type CachedDataAPI struct {
+	DataAPI
+	ttl time.Duration
+
+	mux     sync.Mutex
+	// gen increases on each invalidation, so a result read from the database
+	// during an invalidation will not be saved
+	gen     uint64
+	tokens  map[string]*tokenCache
+	daemons map[daemonCacheKey]cachedValue[bool]
+
+	listenerMux sync.RWMutex
+	listeners   []func(token string)
+}
+
+var _ DataAPI = (*CachedDataAPI)(nil)
+
+func NewCachedDataAPI(api DataAPI, ttl time.Duration)(v *CachedDataAPI){
+	return &CachedDataAPI{
+		DataAPI: api,
+		ttl: ttl,
+		tokens: make(map[string]*tokenCache),
+		daemons: make(map[daemonCacheKey]cachedValue[bool]),
+	}
+}
+
+// OnInvalidate registers a callback that is called after the cached permissions of a token changed.
+// The token is empty when the permissions of all tokens may be changed
+func (v *CachedDataAPI)OnInvalidate(cb func(token string)){
+	v.listenerMux.Lock()
+	defer v.listenerMux.Unlock()
+	v.listeners = append(v.listeners, cb)
+}
+
+func (v *CachedDataAPI)notify(token string){
+	v.listenerMux.RLock()
+	listeners := v.listeners
+	v.listenerMux.RUnlock()
+	for _, cb := range listeners {
+		cb(token)
+	}
+}
+
+// Invalidate drops the cached results of the token, or all cached results if the token is empty
+func (v *CachedDataAPI)Invalidate(token string){
+	v.mux.Lock()
+	v.gen++
+	if len(token) == 0 {
+		v.tokens = make(map[string]*tokenCache)
+		v.daemons = make(map[daemonCacheKey]cachedValue[bool])
+	}else{
+		delete(v.tokens, token)
+		for k, _ := range v.daemons {
+			if k.token == token {
+				delete(v.daemons, k)
+			}
+		}
+	}
+	v.mux.Unlock()
+	v.notify(token)
+}
+
+// lookup returns the cached value, or calls load and saves its result
+func cacheLookup[T any](v *CachedDataAPI, get func()(*cachedValue[T]), set func(cachedValue[T]), load func()(T))(T){
+	now := time.Now()
+	v.mux.Lock()
+	if c := get(); c != nil && now.Before(c.expires) {
+		value := c.value
+		v.mux.Unlock()
+		return value
+	}
+	gen := v.gen
+	v.mux.Unlock()
+
+	value := load()
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+	if gen == v.gen {
+		set(cachedValue[T]{value: value, expires: now.Add(v.ttl)})
+	}
+	return value
+}
+
+// token must be called with the lock held
+func (v *CachedDataAPI)token(token string)(t *tokenCache){
+	if t = v.tokens[token]; t == nil {
+		if len(v.tokens) >= maxAuthCacheEntries {
+			// too many tokens, which are likely guesses, start again
+			v.tokens = make(map[string]*tokenCache)
+		}
+		t = new(tokenCache)
+		v.tokens[token] = t
+	}
+	return
+}
+
+func (v *CachedDataAPI)AuthCli(token string)(bool){
+	return cacheLookup(v,
+		func()(*cachedValue[bool]){ return v.token(token).auth },
+		func(c cachedValue[bool]){ v.token(token).auth = &c },
+		func()(bool){ return v.DataAPI.AuthCli(token) })
+}
+
+func (v *CachedDataAPI)CheckRootToken(token string)(bool){
+	return cacheLookup(v,
+		func()(*cachedValue[bool]){ return v.token(token).root },
+		func(c cachedValue[bool]){ v.token(token).root = &c },
+		func()(bool){ return v.DataAPI.CheckRootToken(token) })
+}
+
+func (v *CachedDataAPI)GetScopes(token string)(scopes []string, err error){
+	type result struct {
+		scopes []string
+		err    error
+	}
+	res := cacheLookup(v,
+		func()(*cachedValue[result]){
+			t := v.token(token)
+			if t.scopes == nil {
+				return nil
+			}
+			return &cachedValue[result]{result{scopes: t.scopes.value}, t.scopes.expires}
+		},
+		func(c cachedValue[result]){
+			// errors are not cached
+			if c.value.err == nil {
+				v.token(token).scopes = &cachedValue[[]string]{c.value.scopes, c.expires}
+			}
+		},
+		func()(result){
+			scopes, err := v.DataAPI.GetScopes(token)
+			return result{scopes, err}
+		})
+	return res.scopes, res.err
+}
+
+func (v *CachedDataAPI)GetRole(token string, host string)(Role){
+	return cacheLookup(v,
+		func()(*cachedValue[Role]){
+			if c, ok := v.token(token).roles[host]; ok {
+				return &c
+			}
+			return nil
+		},
+		func(c cachedValue[Role]){
+			t := v.token(token)
+			if t.roles == nil {
+				t.roles = make(map[string]cachedValue[Role])
+			}
+			t.roles[host] = c
+		},
+		func()(Role){ return v.DataAPI.GetRole(token, host) })
+}
+
+func (v *CachedDataAPI)CheckPerm(token string, server string)(bool){
+	return v.GetRole(token, server) >= RoleViewer
+}
+
+func (v *CachedDataAPI)ListServers(token string)(servers []string, err error){
+	type result struct {
+		servers []string
+		err     error
+	}
+	res := cacheLookup(v,
+		func()(*cachedValue[result]){
+			t := v.token(token)
+			if t.servers == nil {
+				return nil
+			}
+			return &cachedValue[result]{result{servers: t.servers.value}, t.servers.expires}
+		},
+		func(c cachedValue[result]){
+			// errors are not cached
+			if c.value.err == nil {
+				v.token(token).servers = &cachedValue[[]string]{c.value.servers, c.expires}
+			}
+		},
+		func()(result){
+			servers, err := v.DataAPI.ListServers(token)
+			return result{servers, err}
+		})
+	if res.err != nil {
+		return nil, res.err
+	}
+	// the cached slice is shared, so return a copy
+	servers = make([]string, len(res.servers))
+	copy(servers, res.servers)
+	return
+}
+
+func (v *CachedDataAPI)AuthDaemon(token string, host string)(bool){
+	key := daemonCacheKey{token, host}
+	return cacheLookup(v,
+		func()(*cachedValue[bool]){
+			if c, ok := v.daemons[key]; ok {
+				return &c
+			}
+			return nil
+		},
+		func(c cachedValue[bool]){
+			if len(v.daemons) >= maxAuthCacheEntries {
+				v.daemons = make(map[daemonCacheKey]cachedValue[bool])
+			}
+			v.daemons[key] = c
+		},
+		func()(bool){ return v.DataAPI.AuthDaemon(token, host) })
+}
+
+// The writes below change the permissions, so they invalidate the cache after they succeed
+
+func (v *CachedDataAPI)RemoveCliToken(token string)(err error){
+	if err = v.DataAPI.RemoveCliToken(token); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)RemoveDaemonToken(token string)(err error){
+	if err = v.DataAPI.RemoveDaemonToken(token); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetRoot(token string, value bool)(err error){
+	if err = v.DataAPI.SetRoot(token, value); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetScopes(token string, scopes []string)(err error){
+	if err = v.DataAPI.SetScopes(token, scopes); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetCliTokenExpiration(token string, expiration *time.Time)(err error){
+	if err = v.DataAPI.SetCliTokenExpiration(token, expiration); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetDaemonTokenExpiration(token string, expiration *time.Time)(err error){
+	if err = v.DataAPI.SetDaemonTokenExpiration(token, expiration); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)RemoveExpiredTokens()(n int64, err error){
+	if n, err = v.DataAPI.RemoveExpiredTokens(); err == nil && n > 0 {
+		v.Invalidate("")
+	}
+	return
+}
+
+func (v *CachedDataAPI)CreateServer(id string)(err error){
+	if err = v.DataAPI.CreateServer(id); err == nil {
+		v.Invalidate("")
+	}
+	return
+}
+
+func (v *CachedDataAPI)RemoveServer(id string)(err error){
+	if err = v.DataAPI.RemoveServer(id); err == nil {
+		v.Invalidate("")
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetPerm(token string, server string, ok bool)(err error){
+	if err = v.DataAPI.SetPerm(token, server, ok); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetGrant(token string, pattern string, role Role)(err error){
+	if err = v.DataAPI.SetGrant(token, pattern, role); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)RemoveGroup(name string)(err error){
+	if err = v.DataAPI.RemoveGroup(name); err == nil {
+		v.Invalidate("")
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetGroupMember(group string, token string, member bool)(err error){
+	if err = v.DataAPI.SetGroupMember(group, token, member); err == nil {
+		v.Invalidate(token)
+	}
+	return
+}
+
+func (v *CachedDataAPI)SetGroupGrant(group string, pattern string, role Role)(err error){
+	if err = v.DataAPI.SetGroupGrant(group, pattern, role); err == nil {
+		v.Invalidate("")
+	}
+	return
+}
+
+func (v *CachedDataAPI)RemoveUser(username string)(err error){
+	if err = v.DataAPI.RemoveUser(username); err == nil {
+		v.Invalidate("")
+	}
+	return
+}
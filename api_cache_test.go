@@ -0,0 +1,117 @@
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCachedDataAPI(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	// the cache must not change any behavior of the api
+	testDataAPI(t, NewCachedDataAPI(api, time.Minute))
+}
+
+type countingDataAPI struct {
+	DataAPI
+	roles int
+}
+
+func (v *countingDataAPI)GetRole(token string, host string)(Role){
+	v.roles++
+	return v.DataAPI.GetRole(token, host)
+}
+
+func TestCachedDataAPIInvalidate(t *testing.T){
+	mem, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	backend := &countingDataAPI{DataAPI: mem}
+	api := NewCachedDataAPI(backend, time.Minute)
+	var changed []string
+	api.OnInvalidate(func(token string){
+		changed = append(changed, token)
+	})
+
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create token: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if api.CheckPerm(tk, "h1") {
+			t.Fatalf("Token should not have permission on h1 yet")
+		}
+	}
+	if backend.roles != 1 {
+		t.Errorf("Expect the role to be loaded once, got %d", backend.roles)
+	}
+
+	changed = nil
+	if err = api.SetPerm(tk, "h1", true); err != nil {
+		t.Fatalf("Cannot set perm: %v", err)
+	}
+	if len(changed) != 1 || changed[0] != tk {
+		t.Errorf("Expect the token to be invalidated, got %v", changed)
+	}
+	if !api.CheckPerm(tk, "h1") || backend.roles != 2 {
+		t.Errorf("Permission should be reloaded after SetPerm, loaded %d times", backend.roles)
+	}
+
+	changed = nil
+	if err = api.RemoveServer("h1"); err != nil {
+		t.Fatalf("Cannot remove server: %v", err)
+	}
+	if len(changed) != 1 || changed[0] != "" {
+		t.Errorf("Expect all tokens to be invalidated, got %v", changed)
+	}
+	if api.CheckPerm(tk, "h1") {
+		t.Errorf("Permission should be removed with the server")
+	}
+
+	if !api.AuthCli(tk) {
+		t.Fatalf("Token should be authed")
+	}
+	if err = api.RemoveCliToken(tk); err != nil {
+		t.Fatalf("Cannot remove token: %v", err)
+	}
+	if api.AuthCli(tk) {
+		t.Errorf("Removed token should not be authed from the cache")
+	}
+
+	// without the ttl nothing is cached, but the writes still notify
+	backend.roles = 0
+	api = NewCachedDataAPI(backend, 0)
+	api.GetRole(tk, "h1")
+	api.GetRole(tk, "h1")
+	if backend.roles != 2 {
+		t.Errorf("Expect no cache with zero ttl, loaded %d times", backend.roles)
+	}
+}
+
+func TestCachedDataAPIErrorNotCached(t *testing.T){
+	mem, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	flaky := &flakyAPI{DataAPI: mem}
+	api := NewCachedDataAPI(flaky, time.Minute)
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create token: %v", err)
+	}
+	flaky.fail.Store(true)
+	if _, err = api.GetScopes(tk); err == nil {
+		t.Fatalf("Expect the lookup to fail")
+	}
+	flaky.fail.Store(false)
+	if _, err = api.GetScopes(tk); err != nil {
+		t.Errorf("Expect the failed lookup to not be cached, got %v", err)
+	}
+}
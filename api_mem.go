@@ -0,0 +1,1106 @@
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memToken struct {
+	Root       bool          `json:"root"`
+	Expiration *time.Time    `json:"expiration,omitempty"`
+	Username   string        `json:"username,omitempty"`
+	Grants     map[string]Role `json:"grants"`
+	Scopes     []string      `json:"scopes,omitempty"`
+	Scripts    []WebScriptId `json:"scripts"`
+
+	// Servers is only read from old snapshots, fixData converts it to operator grants
+	Servers    map[string]struct{} `json:"servers,omitempty"`
+}
+
+func (t *memToken)expired(now time.Time)(bool){
+	return t.Expiration != nil && t.Expiration.Before(now)
+}
+
+type memDaemonToken struct {
+	Server     string     `json:"server"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+func (t *memDaemonToken)expired(now time.Time)(bool){
+	return t.Expiration != nil && t.Expiration.Before(now)
+}
+
+type memUser struct {
+	Password  string    `json:"password"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type memGroup struct {
+	Members map[string]struct{} `json:"members"`
+	Grants  map[string]Role     `json:"grants"`
+}
+
+type memData struct {
+	Tokens       map[string]*memToken       `json:"tokens"`
+	DaemonTokens map[string]*memDaemonToken `json:"daemon_tokens"`
+	Servers      map[string]struct{}        `json:"servers"`
+	Users        map[string]*memUser        `json:"users"`
+	Groups       map[string]*memGroup       `json:"groups"`
+	// Devices are the device records by host and id
+	Devices      map[string]map[int64]*DeviceRecord `json:"devices"`
+	// Outbox are the queued messages of the devices by id
+	Outbox       map[int64]*QueuedMessage `json:"outbox"`
+	OutboxInc    int64                    `json:"outbox_inc"`
+}
+
+// MemAPI is a DataAPI implementation which keeps everything in memory.
+// If snapshot is not empty, the data will be loaded from and saved to that JSON file,
+// so a development server can survive restarts without a database.
+type MemAPI struct {
+	snapshot string
+
+	mux  sync.RWMutex
+	data memData
+	// saved is the last snapshot written to the file,
+	// the data is restored from it when a change cannot be saved
+	saved []byte
+}
+
+var _ DataAPI = (*MemAPI)(nil)
+
+func NewMemAPI(snapshot string)(v *MemAPI, err error){
+	v = &MemAPI{
+		snapshot: snapshot,
+		data: memData{
+			Tokens: make(map[string]*memToken),
+			DaemonTokens: make(map[string]*memDaemonToken),
+			Servers: make(map[string]struct{}),
+			Users: make(map[string]*memUser),
+			Groups: make(map[string]*memGroup),
+			Devices: make(map[string]map[int64]*DeviceRecord),
+			Outbox: make(map[int64]*QueuedMessage),
+		},
+	}
+	if len(snapshot) != 0 {
+		var buf []byte
+		if buf, err = os.ReadFile(snapshot); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return
+			}
+			err = nil
+		}else if err = json.Unmarshal(buf, &v.data); err != nil {
+			err = fmt.Errorf("Cannot parse snapshot %s: %w", snapshot, err)
+			return
+		}
+		v.fixData()
+		if v.saved, err = json.Marshal(&v.data); err != nil {
+			return
+		}
+	}
+
+	if err = v.createAndLogRootTokenIfNotExists(); err != nil {
+		return
+	}
+	return
+}
+
+// fixData makes sure all the maps are not nil after loading a snapshot
+func (v *MemAPI)fixData(){
+	if v.data.Tokens == nil {
+		v.data.Tokens = make(map[string]*memToken)
+	}
+	if v.data.DaemonTokens == nil {
+		v.data.DaemonTokens = make(map[string]*memDaemonToken)
+	}
+	if v.data.Servers == nil {
+		v.data.Servers = make(map[string]struct{})
+	}
+	if v.data.Users == nil {
+		v.data.Users = make(map[string]*memUser)
+	}
+	if v.data.Groups == nil {
+		v.data.Groups = make(map[string]*memGroup)
+	}
+	if v.data.Devices == nil {
+		v.data.Devices = make(map[string]map[int64]*DeviceRecord)
+	}
+	if v.data.Outbox == nil {
+		v.data.Outbox = make(map[int64]*QueuedMessage)
+	}
+	for _, t := range v.data.Tokens {
+		if t.Grants == nil {
+			t.Grants = make(map[string]Role)
+		}
+		for s, _ := range t.Servers {
+			if t.Grants[s] < RoleOperator {
+				t.Grants[s] = RoleOperator
+			}
+		}
+		t.Servers = nil
+	}
+	for _, g := range v.data.Groups {
+		if g.Members == nil {
+			g.Members = make(map[string]struct{})
+		}
+		if g.Grants == nil {
+			g.Grants = make(map[string]Role)
+		}
+	}
+}
+
+// deleteToken must be called with the write lock held
+func (v *MemAPI)deleteToken(token string){
+	delete(v.data.Tokens, token)
+	for _, g := range v.data.Groups {
+		delete(g.Members, token)
+	}
+}
+
+// tokenGrants must be called with the read lock held
+func (v *MemAPI)tokenGrants(token string, t *memToken)(grants []HostGrant){
+	grants = make([]HostGrant, 0, len(t.Grants))
+	for p, r := range t.Grants {
+		grants = append(grants, HostGrant{Pattern: p, Role: r})
+	}
+	for _, g := range v.data.Groups {
+		if _, ok := g.Members[token]; ok {
+			for p, r := range g.Grants {
+				grants = append(grants, HostGrant{Pattern: p, Role: r})
+			}
+		}
+	}
+	return
+}
+
+// save writes the data to the snapshot, the changes are rolled back if it fails.
+// It must be called with the write lock held
+func (v *MemAPI)save()(err error){
+	if len(v.snapshot) == 0 {
+		return
+	}
+	buf, err := json.Marshal(&v.data)
+	if err == nil {
+		if err = safeDownload(bytes.NewReader(buf), v.snapshot); err != nil {
+			loger.Errorf("Cannot save memory snapshot to %s: %v", v.snapshot, err)
+		}
+	}
+	if err != nil {
+		v.rollback()
+		return
+	}
+	v.saved = buf
+	return
+}
+
+// rollback restores the data from the last saved snapshot, it must be called with the write lock held
+func (v *MemAPI)rollback(){
+	var data memData
+	if err := json.Unmarshal(v.saved, &data); err != nil {
+		loger.Errorf("Cannot restore memory snapshot: %v", err)
+		return
+	}
+	v.data = data
+	v.fixData()
+}
+
+func (v *MemAPI)createAndLogRootTokenIfNotExists()(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	now := time.Now()
+	for _, t := range v.data.Tokens {
+		if t.Root && !t.expired(now) {
+			return
+		}
+	}
+
+	loger.Warn("Root token is not exists, creating one...")
+
+	token, err := generateToken()
+	if err != nil {
+		return
+	}
+	v.data.Tokens[token] = &memToken{
+		Root: true,
+		Grants: make(map[string]Role),
+	}
+	if err = v.save(); err != nil {
+		return
+	}
+
+	loger.Warn("****************************************************************")
+	loger.Warnf("new_root_token=%s", cliTokenPrefix + token)
+	loger.Warn("****************************************************************")
+	return
+}
+
+// getToken must be called with the read lock held
+func (v *MemAPI)getToken(clitoken string)(t *memToken, token string){
+	var ok bool
+	if token, ok = preProcessCliToken(clitoken); !ok {
+		return
+	}
+	if t = v.data.Tokens[token]; t == nil || t.expired(time.Now()) {
+		return nil, token
+	}
+	return
+}
+
+func (v *MemAPI)NewCliToken(expiration *time.Time)(token string, err error){
+	if token, err = generateToken(); err != nil {
+		return
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	v.data.Tokens[token] = &memToken{
+		Expiration: expiration,
+		Grants: make(map[string]Role),
+	}
+	if err = v.save(); err != nil {
+		return
+	}
+	token = cliTokenPrefix + token
+	return
+}
+
+func (v *MemAPI)NewDaemonToken(server string, expiration *time.Time)(token string, err error){
+	if token, err = generateToken(); err != nil {
+		return
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Servers[server]; !ok {
+		return "", ServerNotExistsErr
+	}
+	v.data.DaemonTokens[token] = &memDaemonToken{
+		Server: server,
+		Expiration: expiration,
+	}
+	if err = v.save(); err != nil {
+		return
+	}
+	token = daemonTokenPrefix + token
+	return
+}
+
+func (v *MemAPI)RemoveCliToken(token string)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok = v.data.Tokens[token]; !ok {
+		return
+	}
+	v.deleteToken(token)
+	return v.save()
+}
+
+func (v *MemAPI)RemoveDaemonToken(token string)(err error){
+	if len(token) != daemonTokenLen || token[:len(daemonTokenPrefix)] != daemonTokenPrefix {
+		return TokenNotExistsErr
+	}
+	token = token[len(daemonTokenPrefix):]
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.DaemonTokens[token]; !ok {
+		return
+	}
+	delete(v.data.DaemonTokens, token)
+	return v.save()
+}
+
+func (v *MemAPI)ListTokens()(tokens []Token, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	tokens = make([]Token, 0, len(v.data.Tokens))
+	for tk, t := range v.data.Tokens {
+		tokens = append(tokens, Token{
+			Token: cliTokenPrefix + tk,
+			Root: t.Root,
+			Expiration: t.Expiration,
+			Username: t.Username,
+			Scopes: t.Scopes,
+		})
+	}
+	return
+}
+
+func (v *MemAPI)ListDaemonTokens()(tokens []DaemonToken, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	tokens = make([]DaemonToken, 0, len(v.data.DaemonTokens))
+	for tk, t := range v.data.DaemonTokens {
+		tokens = append(tokens, DaemonToken{
+			Token: daemonTokenPrefix + tk,
+			Server: t.Server,
+			Expiration: t.Expiration,
+		})
+	}
+	return
+}
+
+func (v *MemAPI)AuthCli(token string)(ok bool){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t, _ := v.getToken(token)
+	return t != nil
+}
+
+func (v *MemAPI)AuthDaemon(token string, server string)(ok bool){
+	if len(token) != daemonTokenLen || token[:len(daemonTokenPrefix)] != daemonTokenPrefix {
+		return false
+	}
+	token = token[len(daemonTokenPrefix):]
+
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t := v.data.DaemonTokens[token]
+	return t != nil && t.Server == server && !t.expired(time.Now())
+}
+
+func (v *MemAPI)GetUserInfo(token string)(info UserInfo, err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		err = TokenNotExistsErr
+		return
+	}
+	if len(t.Username) != 0 {
+		info.Username = t.Username
+		info.IsUser = true
+	}else{
+		info.Username = "cli-" + token[:4]
+	}
+	return
+}
+
+func (v *MemAPI)CheckRootToken(token string)(ok bool){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t, _ := v.getToken(token)
+	return t != nil && t.Root
+}
+
+func (v *MemAPI)GetScopes(token string)(scopes []string, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t, _ := v.getToken(token)
+	if t == nil {
+		return nil, TokenNotExistsErr
+	}
+	return t.Scopes, nil
+}
+
+func (v *MemAPI)SetScopes(token string, scopes []string)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return TokenNotExistsErr
+	}
+	if len(scopes) == 0 {
+		t.Scopes = nil
+	}else{
+		t.Scopes = append([]string(nil), scopes...)
+	}
+	return v.save()
+}
+
+func (v *MemAPI)SetRoot(token string, value bool)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return
+	}
+	t.Root = value
+	return v.save()
+}
+
+func (v *MemAPI)SetCliTokenExpiration(token string, expiration *time.Time)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return TokenNotExistsErr
+	}
+	t.Expiration = expiration
+	return v.save()
+}
+
+func (v *MemAPI)SetDaemonTokenExpiration(token string, expiration *time.Time)(err error){
+	var ok bool
+	if token, ok = preProcessDaemonToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.DaemonTokens[token]
+	if t == nil {
+		return TokenNotExistsErr
+	}
+	t.Expiration = expiration
+	return v.save()
+}
+
+func (v *MemAPI)RemoveExpiredTokens()(n int64, err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	now := time.Now()
+	for tk, t := range v.data.Tokens {
+		if t.expired(now) {
+			v.deleteToken(tk)
+			n++
+		}
+	}
+	for tk, t := range v.data.DaemonTokens {
+		if t.expired(now) {
+			delete(v.data.DaemonTokens, tk)
+			n++
+		}
+	}
+	if n != 0 {
+		err = v.save()
+	}
+	return
+}
+
+func (v *MemAPI)CreateServer(id string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Servers[id]; ok {
+		return fmt.Errorf("Server %q is already exists", id)
+	}
+	v.data.Servers[id] = struct{}{}
+	return v.save()
+}
+
+func (v *MemAPI)RemoveServer(id string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Servers[id]; !ok {
+		return
+	}
+	delete(v.data.Servers, id)
+	// grants on patterns are kept, since they may match other servers
+	for _, t := range v.data.Tokens {
+		delete(t.Grants, id)
+	}
+	for _, g := range v.data.Groups {
+		delete(g.Grants, id)
+	}
+	for tk, t := range v.data.DaemonTokens {
+		if t.Server == id {
+			delete(v.data.DaemonTokens, tk)
+		}
+	}
+	delete(v.data.Devices, id)
+	for mid, msg := range v.data.Outbox {
+		if msg.Host == id {
+			delete(v.data.Outbox, mid)
+		}
+	}
+	return v.save()
+}
+
+func (v *MemAPI)ListServers(token string)(servers []string, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t, tk := v.getToken(token)
+	if t == nil {
+		err = PermDeniedErr
+		return
+	}
+	servers = make([]string, 0, len(v.data.Servers))
+	for s, _ := range v.data.Servers {
+		servers = append(servers, s)
+	}
+	sort.Strings(servers)
+	if !t.Root {
+		servers = filterHosts(v.tokenGrants(tk, t), servers, RoleViewer)
+	}
+	return
+}
+
+func (v *MemAPI)HasServer(id string)(ok bool, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	_, ok = v.data.Servers[id]
+	return
+}
+
+func (v *MemAPI)CheckPerm(token string, server string)(ok bool){
+	return v.GetRole(token, server) >= RoleViewer
+}
+
+func (v *MemAPI)SetPerm(token string, server string, value bool)(err error){
+	if !value {
+		return v.SetGrant(token, server, RoleNone)
+	}
+	// an admin grant is not downgraded
+	return v.setGrant(token, server, RoleOperator, true)
+}
+
+func (v *MemAPI)GetRole(token string, host string)(role Role){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t, tk := v.getToken(token)
+	if t == nil {
+		return RoleNone
+	}
+	if t.Root {
+		return RoleAdmin
+	}
+	return resolveRole(v.tokenGrants(tk, t), host)
+}
+
+func (v *MemAPI)ListGrants(token string)(grants []HostGrant, err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return nil, TokenNotExistsErr
+	}
+
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return nil, TokenNotExistsErr
+	}
+	grants = make([]HostGrant, 0, len(t.Grants))
+	for p, r := range t.Grants {
+		grants = append(grants, HostGrant{Pattern: p, Role: r})
+	}
+	sortGrants(grants)
+	return
+}
+
+func (v *MemAPI)SetGrant(token string, pattern string, role Role)(err error){
+	return v.setGrant(token, pattern, role, false)
+}
+
+// setGrant sets the role of the token on the pattern, if keepAdmin is true an existing admin grant is kept
+func (v *MemAPI)setGrant(token string, pattern string, role Role, keepAdmin bool)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+	if err = checkHostPattern(pattern); err != nil {
+		return
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		if role == RoleNone {
+			return
+		}
+		return TokenNotExistsErr
+	}
+	if role == RoleNone {
+		delete(t.Grants, pattern)
+	}else{
+		if keepAdmin && t.Grants[pattern] == RoleAdmin {
+			return
+		}
+		t.Grants[pattern] = role
+	}
+	return v.save()
+}
+
+func (v *MemAPI)CreateGroup(name string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Groups[name]; ok {
+		return GroupExistsErr
+	}
+	v.data.Groups[name] = &memGroup{
+		Members: make(map[string]struct{}),
+		Grants: make(map[string]Role),
+	}
+	return v.save()
+}
+
+func (v *MemAPI)RemoveGroup(name string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Groups[name]; !ok {
+		return GroupNotExistsErr
+	}
+	delete(v.data.Groups, name)
+	return v.save()
+}
+
+func (v *MemAPI)ListGroups()(groups []Group, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	groups = make([]Group, 0, len(v.data.Groups))
+	for name, g := range v.data.Groups {
+		group := Group{
+			Name: name,
+			Members: make([]string, 0, len(g.Members)),
+			Grants: make([]HostGrant, 0, len(g.Grants)),
+		}
+		for tk, _ := range g.Members {
+			group.Members = append(group.Members, cliTokenPrefix + tk)
+		}
+		sort.Strings(group.Members)
+		for p, r := range g.Grants {
+			group.Grants = append(group.Grants, HostGrant{Pattern: p, Role: r})
+		}
+		sortGrants(group.Grants)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int)(bool){ return groups[i].Name < groups[j].Name })
+	return
+}
+
+func (v *MemAPI)SetGroupMember(group string, token string, member bool)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	g := v.data.Groups[group]
+	if g == nil {
+		if !member {
+			return
+		}
+		return GroupNotExistsErr
+	}
+	if member {
+		if _, ok = v.data.Tokens[token]; !ok {
+			return TokenNotExistsErr
+		}
+		g.Members[token] = struct{}{}
+	}else{
+		delete(g.Members, token)
+	}
+	return v.save()
+}
+
+func (v *MemAPI)SetGroupGrant(group string, pattern string, role Role)(err error){
+	if err = checkHostPattern(pattern); err != nil {
+		return
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	g := v.data.Groups[group]
+	if g == nil {
+		if role == RoleNone {
+			return
+		}
+		return GroupNotExistsErr
+	}
+	if role == RoleNone {
+		delete(g.Grants, pattern)
+	}else{
+		g.Grants[pattern] = role
+	}
+	return v.save()
+}
+
+func (v *MemAPI)CreateUser(username string, password string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Users[username]; ok {
+		return UserExistsErr
+	}
+	v.data.Users[username] = &memUser{
+		Password: password,
+		CreatedAt: time.Now().UTC(),
+	}
+	return v.save()
+}
+
+func (v *MemAPI)RemoveUser(username string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Users[username]; !ok {
+		return UserNotExistsErr
+	}
+	delete(v.data.Users, username)
+	for tk, t := range v.data.Tokens {
+		if t.Username == username {
+			v.deleteToken(tk)
+		}
+	}
+	return v.save()
+}
+
+func (v *MemAPI)ListUsers()(users []User, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	users = make([]User, 0, len(v.data.Users))
+	for name, u := range v.data.Users {
+		users = append(users, User{
+			Username: name,
+			HasPassword: len(u.Password) != 0,
+			CreatedAt: u.CreatedAt,
+		})
+	}
+	sort.Slice(users, func(i, j int)(bool){ return users[i].Username < users[j].Username })
+	return
+}
+
+func (v *MemAPI)GetUserPassword(username string)(password string, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	u, ok := v.data.Users[username]
+	if !ok {
+		return "", UserNotExistsErr
+	}
+	return u.Password, nil
+}
+
+func (v *MemAPI)SetUserPassword(username string, password string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	u, ok := v.data.Users[username]
+	if !ok {
+		return UserNotExistsErr
+	}
+	u.Password = password
+	return v.save()
+}
+
+func (v *MemAPI)NewUserToken(username string, expiration *time.Time)(token string, err error){
+	if token, err = generateToken(); err != nil {
+		return
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	if _, ok := v.data.Users[username]; !ok {
+		return "", UserNotExistsErr
+	}
+	v.data.Tokens[token] = &memToken{
+		Expiration: expiration,
+		Username: username,
+		Grants: make(map[string]Role),
+	}
+	if err = v.save(); err != nil {
+		return
+	}
+	token = cliTokenPrefix + token
+	return
+}
+
+func (v *MemAPI)SeenDevice(device DeviceRecord)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	devices := v.data.Devices[device.Host]
+	if devices == nil {
+		devices = make(map[int64]*DeviceRecord)
+		v.data.Devices[device.Host] = devices
+	}
+	seen := device.LastSeen.UTC()
+	if d := devices[device.Id]; d != nil {
+		d.Device = device.Device
+		d.Label = device.Label
+		d.LastSeen = seen
+		d.LastAddr = device.LastAddr
+	}else{
+		device.Note = ""
+		device.Tags = nil
+		device.FirstSeen = seen
+		device.LastSeen = seen
+		devices[device.Id] = &device
+	}
+	return v.save()
+}
+
+func (v *MemAPI)ListDevices(host string)(devices []DeviceRecord, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	for _, d := range v.data.Devices[host] {
+		devices = append(devices, *d)
+	}
+	sort.Slice(devices, func(i, j int)(bool){ return devices[i].Id < devices[j].Id })
+	return
+}
+
+func (v *MemAPI)GetDevice(host string, id int64)(device DeviceRecord, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	d := v.data.Devices[host][id]
+	if d == nil {
+		err = DeviceNotExistsErr
+		return
+	}
+	return *d, nil
+}
+
+func (v *MemAPI)SetDeviceNote(host string, id int64, note string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	d := v.data.Devices[host][id]
+	if d == nil {
+		return DeviceNotExistsErr
+	}
+	d.Note = note
+	return v.save()
+}
+
+func (v *MemAPI)SetDeviceTags(host string, id int64, tags []string)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	d := v.data.Devices[host][id]
+	if d == nil {
+		return DeviceNotExistsErr
+	}
+	d.Tags = tags
+	return v.save()
+}
+
+func (v *MemAPI)ForgetDevice(host string, id int64)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	devices := v.data.Devices[host]
+	if devices[id] == nil {
+		return DeviceNotExistsErr
+	}
+	delete(devices, id)
+	if len(devices) == 0 {
+		delete(v.data.Devices, host)
+	}
+	return v.save()
+}
+
+func (v *MemAPI)QueueMessage(msg *QueuedMessage, limit int)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	n := 0
+	for _, m := range v.data.Outbox {
+		if m.Host == msg.Host && m.Device == msg.Device && m.Status == MessageQueued {
+			n++
+		}
+	}
+	if n >= limit {
+		return OutboxLimitErr
+	}
+	v.data.OutboxInc++
+	msg.Id = v.data.OutboxInc
+	msg.Status = MessageQueued
+	msg.DeliveredAt = nil
+	m := *msg
+	v.data.Outbox[m.Id] = &m
+	return v.save()
+}
+
+// filterMessages returns the messages that match fn, ordered by id
+func (v *MemAPI)filterMessages(fn func(msg *QueuedMessage)(bool))(msgs []QueuedMessage){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	for _, m := range v.data.Outbox {
+		if fn(m) {
+			msgs = append(msgs, *m)
+		}
+	}
+	sort.Slice(msgs, func(i, j int)(bool){ return msgs[i].Id < msgs[j].Id })
+	return
+}
+
+func (v *MemAPI)PendingMessages(host string, device int64, now time.Time)(msgs []QueuedMessage, err error){
+	return v.filterMessages(func(m *QueuedMessage)(bool){
+		return m.Host == host && m.Device == device && m.Status == MessageQueued && !m.ExpiresAt.Before(now)
+	}), nil
+}
+
+func (v *MemAPI)ListMessages(host string, device int64)(msgs []QueuedMessage, err error){
+	return v.filterMessages(func(m *QueuedMessage)(bool){
+		return m.Host == host && m.Device == device
+	}), nil
+}
+
+func (v *MemAPI)GetMessage(id int64)(msg QueuedMessage, err error){
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	m := v.data.Outbox[id]
+	if m == nil {
+		err = MessageNotExistsErr
+		return
+	}
+	return *m, nil
+}
+
+func (v *MemAPI)SetMessageDelivered(id int64, at time.Time)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	m := v.data.Outbox[id]
+	if m == nil {
+		return MessageNotExistsErr
+	}
+	at = at.UTC()
+	m.Status = MessageDelivered
+	m.DeliveredAt = &at
+	return v.save()
+}
+
+func (v *MemAPI)SweepMessages(now time.Time, purgeBefore time.Time)(n int64, err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	changed := false
+	for id, m := range v.data.Outbox {
+		if m.Status == MessageQueued && m.ExpiresAt.Before(now) {
+			m.Status = MessageExpired
+			changed = true
+			n++
+		}
+		if m.Status != MessageQueued && m.CreatedAt.Before(purgeBefore) {
+			delete(v.data.Outbox, id)
+			changed = true
+		}
+	}
+	if changed {
+		err = v.save()
+	}
+	return
+}
+
+func (v *MemAPI)ListCliWebScripts(token string)(scripts []WebScriptId, err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	v.mux.RLock()
+	defer v.mux.RUnlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return
+	}
+	scripts = make([]WebScriptId, len(t.Scripts))
+	copy(scripts, t.Scripts)
+	return
+}
+
+func (v *MemAPI)AddCliWebScript(token string, plugin WebScriptId)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return TokenNotExistsErr
+	}
+	for _, s := range t.Scripts {
+		if s.Id == plugin.Id {
+			return fmt.Errorf("Plugin %q is already added", plugin.Id)
+		}
+	}
+	t.Scripts = append(t.Scripts, plugin)
+	return v.save()
+}
+
+func (v *MemAPI)DelCliWebScript(token string, plugin string)(err error){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	t := v.data.Tokens[token]
+	if t == nil {
+		return
+	}
+	for i, s := range t.Scripts {
+		if s.Id == plugin {
+			t.Scripts = append(t.Scripts[:i], t.Scripts[i + 1:]...)
+			return v.save()
+		}
+	}
+	return
+}
@@ -6,7 +6,9 @@ import (
 	crand "crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
@@ -20,20 +22,31 @@ var _ DataAPI = (*MySQLAPI)(nil)
 
 const mysqlDeadLockCode = 1213
 
-func NewMySQLAPI(username string, passwd string, address string, database string)(v *MySQLAPI, err error){
-	v = &MySQLAPI{}
-
-	if v.DB, err = sql.Open("mysql",
+func openMySQLDB(username string, passwd string, address string, database string)(db *sql.DB, err error){
+	if db, err = sql.Open("mysql",
 		fmt.Sprintf("%s:%s@%s/%s?parseTime=true", username, passwd, address, database)); err != nil {
 		return
 	}
-	v.DB.SetConnMaxLifetime(time.Minute * 3)
-	v.DB.SetMaxOpenConns(128)
-	v.DB.SetMaxIdleConns(16)
+	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetMaxOpenConns(128)
+	db.SetMaxIdleConns(16)
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 3)
 	defer cancel()
-	if err = v.DB.PingContext(ctx); err != nil {
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return
+}
+
+func NewMySQLAPI(username string, passwd string, address string, database string)(v *MySQLAPI, err error){
+	v = &MySQLAPI{}
+
+	if v.DB, err = openMySQLDB(username, passwd, address, database); err != nil {
+		return
+	}
+	if err = migrateUp(v.DB, "mysql"); err != nil {
 		return
 	}
 
@@ -207,7 +220,7 @@ func (v *MySQLAPI)RemoveDaemonToken(token string)(err error){
 
 func (v *MySQLAPI)ListTokens()(tokens []Token, err error){
 	const queryCmd = "SELECT `token`,`root`," +
-		"CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00')" +
+		"CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00'),`username`,`scopes`" +
 		" FROM tokens"
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
@@ -222,14 +235,18 @@ func (v *MySQLAPI)ListTokens()(tokens []Token, err error){
 		var (
 			tk Token
 			expiration sql.NullTime
+			username sql.NullString
+			scopes sql.NullString
 		)
-		if err = rows.Scan(&tk.Token, &tk.Root, &expiration); err != nil {
+		if err = rows.Scan(&tk.Token, &tk.Root, &expiration, &username, &scopes); err != nil {
 			return
 		}
 		tk.Token = cliTokenPrefix + tk.Token
 		if expiration.Valid {
 			tk.Expiration = &expiration.Time
 		}
+		tk.Username = username.String
+		tk.Scopes = splitScopes(scopes.String)
 		tokens = append(tokens, tk)
 	}
 	if err = rows.Err(); err != nil {
@@ -284,7 +301,7 @@ func (v *MySQLAPI)AuthCli(token string)(ok bool){
 	defer cancel()
 
 	if err := v.DB.QueryRowContext(ctx, queryCmd, token).Scan(&ok); err != nil {
-		return
+		return false
 	}
 	return
 }
@@ -303,7 +320,7 @@ func (v *MySQLAPI)AuthDaemon(token string, server string)(ok bool){
 	defer cancel()
 
 	if err := v.DB.QueryRowContext(ctx, queryCmd, token, server).Scan(&ok); err != nil {
-		return
+		return false
 	}
 	return
 }
@@ -328,6 +345,7 @@ func (v *MySQLAPI)GetUserInfo(token string)(info UserInfo, err error){
 	}
 	if username.Valid {
 		info.Username = username.String
+		info.IsUser = true
 	}else{
 		info.Username = "cli-" + token[:4]
 	}
@@ -347,7 +365,7 @@ func (v *MySQLAPI)CheckRootToken(rtToken string)(ok bool){
 	defer cancel()
 
 	if err := v.DB.QueryRowContext(ctx, queryCmd, rtToken).Scan(&ok); err != nil {
-		return
+		return false
 	}
 	return
 }
@@ -382,6 +400,164 @@ func (v *MySQLAPI)SetRoot(token string, value bool)(err error){
 	return
 }
 
+func (v *MySQLAPI)GetScopes(token string)(scopes []string, err error){
+	const queryCmd = "SELECT `scopes` FROM tokens" +
+		" WHERE (`expiration` IS NULL OR CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00')>=NOW())" +
+		" AND `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return nil, TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var s sql.NullString
+	if err = v.DB.QueryRowContext(ctx, queryCmd, token).Scan(&s); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	return splitScopes(s.String), nil
+}
+
+func (v *MySQLAPI)SetScopes(token string, scopes []string)(err error){
+	const queryCmd = "SELECT 1 FROM tokens" +
+		" WHERE `token`=?"
+	const updateCmd = "UPDATE tokens SET" +
+		" `scopes`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// RowsAffected does not count the rows that are not changed in MySQL
+	if err = tx.QueryRowContext(ctx, queryCmd, token).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	if _, err = execTx(tx, updateCmd, joinScopes(scopes), token); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SetCliTokenExpiration(token string, expiration *time.Time)(err error){
+	const updateCmd = "UPDATE tokens SET" +
+		" `expiration`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := execTx(tx, updateCmd, expiration, token)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return TokenNotExistsErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SetDaemonTokenExpiration(token string, expiration *time.Time)(err error){
+	const updateCmd = "UPDATE daemon_tokens SET" +
+		" `expiration`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessDaemonToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := execTx(tx, updateCmd, expiration, token)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return TokenNotExistsErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)RemoveExpiredTokens()(n int64, err error){
+	// token_grants, token_group_members and cli_web_plugins are removed by the foreign key cascade
+	const delete1Cmd = "DELETE FROM tokens" +
+		" WHERE `expiration` IS NOT NULL AND CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00')<NOW()"
+	const delete2Cmd = "DELETE FROM daemon_tokens" +
+		" WHERE `expiration` IS NOT NULL AND CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00')<NOW()"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 30)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, cmd := range []string{delete1Cmd, delete2Cmd} {
+		var res sql.Result
+		if res, err = execTx(tx, cmd); err != nil {
+			return
+		}
+		m, _ := res.RowsAffected()
+		n += m
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
 func (v *MySQLAPI)CreateServer(id string)(err error){
 	const insertCmd = "INSERT INTO servers (`id`)" +
 		" VALUES (?)"
@@ -406,7 +582,16 @@ func (v *MySQLAPI)CreateServer(id string)(err error){
 }
 
 func (v *MySQLAPI)RemoveServer(id string)(err error){
-	const deleteCmd = "DELETE FROM servers" +
+	// grants on patterns are kept, since they may match other servers
+	const delete1Cmd = "DELETE FROM token_grants" +
+		" WHERE `pattern`=?"
+	const delete2Cmd = "DELETE FROM group_grants" +
+		" WHERE `pattern`=?"
+	const delete3Cmd = "DELETE FROM devices" +
+		" WHERE `host`=?"
+	const delete4Cmd = "DELETE FROM device_outbox" +
+		" WHERE `host`=?"
+	const delete5Cmd = "DELETE FROM servers" +
 		" WHERE `id`=?"
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
@@ -418,8 +603,10 @@ func (v *MySQLAPI)RemoveServer(id string)(err error){
 	}
 	defer tx.Rollback()
 
-	if _, err = execTx(tx, deleteCmd, id); err != nil {
-		return
+	for _, cmd := range []string{delete1Cmd, delete2Cmd, delete3Cmd, delete4Cmd, delete5Cmd} {
+		if _, err = execTx(tx, cmd, id); err != nil {
+			return
+		}
 	}
 
 	if err = tx.Commit(); err != nil {
@@ -428,13 +615,49 @@ func (v *MySQLAPI)RemoveServer(id string)(err error){
 	return
 }
 
-func (v *MySQLAPI)ListServers(token string)(servers []string, err error){
+// tokenGrants returns the grants of the token and its groups.
+// err will be TokenNotExistsErr if the token is not exists or expired
+func (v *MySQLAPI)tokenGrants(ctx context.Context, token string)(root bool, grants []HostGrant, err error){
 	const query1Cmd = "SELECT `root` FROM tokens" +
 		" WHERE (`expiration` IS NULL OR CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00')>=NOW())" +
 		" AND `token`=?"
-	const query2Cmd = "SELECT `id` FROM servers"
-	const query3Cmd = "SELECT `server` FROM token_ops" +
-		" WHERE `token`=?"
+	const query2Cmd = "SELECT `pattern`,`role` FROM token_grants" +
+		" WHERE `token`=?" +
+		" UNION ALL" +
+		" SELECT g.`pattern`,g.`role` FROM group_grants AS g" +
+		" JOIN token_group_members AS m ON m.`group`=g.`group`" +
+		" WHERE m.`token`=?"
+
+	if err = v.DB.QueryRowContext(ctx, query1Cmd, token).Scan(&root); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	if root {
+		return
+	}
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, query2Cmd, token, token); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g HostGrant
+		if err = rows.Scan(&g.Pattern, &g.Role); err != nil {
+			return
+		}
+		grants = append(grants, g)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)ListServers(token string)(servers []string, err error){
+	const queryCmd = "SELECT `id` FROM servers"
 
 	var ok bool
 	if token, ok = preProcessCliToken(token); !ok {
@@ -445,21 +668,13 @@ func (v *MySQLAPI)ListServers(token string)(servers []string, err error){
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
 	defer cancel()
 
-	var root bool
-	if err = v.DB.QueryRowContext(ctx, query1Cmd, token).Scan(&root); err != nil {
+	root, grants, err := v.tokenGrants(ctx, token)
+	if err != nil {
 		return
 	}
-	var args []any
-	var queryCmd2 string
-	if root {
-		queryCmd2 = query2Cmd
-	}else{
-		queryCmd2 = query3Cmd
-		args = []any{token}
-	}
 
 	var rows *sql.Rows
-	if rows, err = v.QueryContext(ctx, queryCmd2, args...); err != nil {
+	if rows, err = v.QueryContext(ctx, queryCmd); err != nil {
 		return
 	}
 	defer rows.Close()
@@ -473,46 +688,114 @@ func (v *MySQLAPI)ListServers(token string)(servers []string, err error){
 	if err = rows.Err(); err != nil {
 		return
 	}
+	if !root {
+		servers = filterHosts(grants, servers, RoleViewer)
+	}
 	return
 }
 
+func (v *MySQLAPI)HasServer(id string)(ok bool, err error){
+	const queryCmd = "SELECT 1 FROM servers" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var one int
+	if err = v.DB.QueryRowContext(ctx, queryCmd, id).Scan(&one); err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return
+	}
+	return true, nil
+}
+
 func (v *MySQLAPI)CheckPerm(token string, server string)(ok bool){
-	const query1Cmd = "SELECT `root` FROM tokens" +
-		" WHERE (`expiration` IS NULL OR CONVERT_TZ(`expiration`,@@session.time_zone,'+00:00')>=NOW())" +
-		" AND `token`=?"
-	const query2Cmd = "SELECT 1 FROM token_ops" +
-		" WHERE `token`=? AND `server`=?"
+	return v.GetRole(token, server) >= RoleViewer
+}
+
+func (v *MySQLAPI)SetPerm(token string, server string, value bool)(err error){
+	if !value {
+		return v.SetGrant(token, server, RoleNone)
+	}
+	// an admin grant is not downgraded
+	return v.setGrant(token, server, RoleOperator, true)
+}
 
+func (v *MySQLAPI)GetRole(token string, host string)(role Role){
+	var ok bool
 	if token, ok = preProcessCliToken(token); !ok {
-		return
+		return RoleNone
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
 	defer cancel()
 
-	// check if it's a root token
-	if err := v.DB.QueryRowContext(ctx, query1Cmd, token).Scan(&ok); err != nil {
-		return
+	root, grants, err := v.tokenGrants(ctx, token)
+	if err != nil {
+		return RoleNone
+	}
+	if root {
+		return RoleAdmin
 	}
-	if ok {
+	return resolveRole(grants, host)
+}
+
+func (v *MySQLAPI)ListGrants(token string)(grants []HostGrant, err error){
+	const queryCmd = "SELECT `pattern`,`role` FROM token_grants" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
 		return
 	}
 
-	if err := v.DB.QueryRowContext(ctx, query2Cmd, token, server).Scan(&ok); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, token); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g HostGrant
+		if err = rows.Scan(&g.Pattern, &g.Role); err != nil {
+			return
+		}
+		grants = append(grants, g)
+	}
+	if err = rows.Err(); err != nil {
 		return
 	}
+	sortGrants(grants)
 	return
 }
 
-func (v *MySQLAPI)SetPerm(token string, server string, value bool)(err error){
-	const insertCmd = "INSERT IGNORE INTO token_ops (`token`, `server`)" +
-		" VALUES (?, ?)"
-	const deleteCmd = "DELETE FROM token_ops" +
-		" WHERE `token`=? AND `server`=?"
+func (v *MySQLAPI)SetGrant(token string, pattern string, role Role)(err error){
+	return v.setGrant(token, pattern, role, false)
+}
+
+// setGrant sets the role of the token on the pattern, if keepAdmin is true an existing admin grant is kept
+func (v *MySQLAPI)setGrant(token string, pattern string, role Role, keepAdmin bool)(err error){
+	const queryCmd = "SELECT 1 FROM tokens" +
+		" WHERE `token`=?"
+	const insertCmd = "INSERT INTO token_grants (`token`, `pattern`, `role`)" +
+		" VALUES (?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE `role`=VALUES(`role`)"
+	const upgradeCmd = "INSERT INTO token_grants (`token`, `pattern`, `role`)" +
+		" VALUES (?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE `role`=IF(`role`=?, `role`, VALUES(`role`))"
+	const deleteCmd = "DELETE FROM token_grants" +
+		" WHERE `token`=? AND `pattern`=?"
 
 	var ok bool
 	if token, ok = preProcessCliToken(token); !ok {
-		err = TokenNotExistsErr
+		return TokenNotExistsErr
+	}
+	if err = checkHostPattern(pattern); err != nil {
 		return
 	}
 
@@ -525,13 +808,782 @@ func (v *MySQLAPI)SetPerm(token string, server string, value bool)(err error){
 	}
 	defer tx.Rollback()
 
-	var cmd string
-	if value {
-		cmd = insertCmd
+	if role == RoleNone {
+		if _, err = execTx(tx, deleteCmd, token, pattern); err != nil {
+			return
+		}
 	}else{
-		cmd = deleteCmd
+		if err = tx.QueryRowContext(ctx, queryCmd, token).Scan(&ok); err != nil {
+			if err == sql.ErrNoRows {
+				err = TokenNotExistsErr
+			}
+			return
+		}
+		if keepAdmin {
+			_, err = execTx(tx, upgradeCmd, token, pattern, role, RoleAdmin)
+		}else{
+			_, err = execTx(tx, insertCmd, token, pattern, role)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)CreateGroup(name string)(err error){
+	const queryCmd = "SELECT 1 FROM token_groups" +
+		" WHERE `name`=?"
+	const insertCmd = "INSERT INTO token_groups (`name`)" +
+		" VALUES (?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, queryCmd, name).Scan(&exists); err == nil {
+		return GroupExistsErr
+	}else if err != sql.ErrNoRows {
+		return
+	}
+	if _, err = execTx(tx, insertCmd, name); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)RemoveGroup(name string)(err error){
+	const deleteCmd = "DELETE FROM token_groups" +
+		" WHERE `name`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := execTx(tx, deleteCmd, name)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return GroupNotExistsErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)ListGroups()(groups []Group, err error){
+	const query1Cmd = "SELECT `name` FROM token_groups" +
+		" ORDER BY `name`"
+	const query2Cmd = "SELECT `group`,`token` FROM token_group_members"
+	const query3Cmd = "SELECT `group`,`pattern`,`role` FROM group_grants" +
+		" ORDER BY `pattern`"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, query1Cmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	index := make(map[string]int)
+	for rows.Next() {
+		var g Group
+		if err = rows.Scan(&g.Name); err != nil {
+			return
+		}
+		g.Members = make([]string, 0)
+		g.Grants = make([]HostGrant, 0)
+		index[g.Name] = len(groups)
+		groups = append(groups, g)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	rows.Close()
+
+	if rows, err = v.QueryContext(ctx, query2Cmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, token string
+		if err = rows.Scan(&name, &token); err != nil {
+			return
+		}
+		if i, ok := index[name]; ok {
+			groups[i].Members = append(groups[i].Members, cliTokenPrefix + token)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	rows.Close()
+
+	if rows, err = v.QueryContext(ctx, query3Cmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			g HostGrant
+		)
+		if err = rows.Scan(&name, &g.Pattern, &g.Role); err != nil {
+			return
+		}
+		if i, ok := index[name]; ok {
+			groups[i].Grants = append(groups[i].Grants, g)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SetGroupMember(group string, token string, member bool)(err error){
+	const query1Cmd = "SELECT 1 FROM token_groups" +
+		" WHERE `name`=?"
+	const query2Cmd = "SELECT 1 FROM tokens" +
+		" WHERE `token`=?"
+	const insertCmd = "INSERT IGNORE INTO token_group_members (`group`, `token`)" +
+		" VALUES (?, ?)"
+	const deleteCmd = "DELETE FROM token_group_members" +
+		" WHERE `group`=? AND `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if !member {
+		if _, err = execTx(tx, deleteCmd, group, token); err != nil {
+			return
+		}
+	}else{
+		if err = tx.QueryRowContext(ctx, query1Cmd, group).Scan(&ok); err != nil {
+			if err == sql.ErrNoRows {
+				err = GroupNotExistsErr
+			}
+			return
+		}
+		if err = tx.QueryRowContext(ctx, query2Cmd, token).Scan(&ok); err != nil {
+			if err == sql.ErrNoRows {
+				err = TokenNotExistsErr
+			}
+			return
+		}
+		if _, err = execTx(tx, insertCmd, group, token); err != nil {
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SetGroupGrant(group string, pattern string, role Role)(err error){
+	const queryCmd = "SELECT 1 FROM token_groups" +
+		" WHERE `name`=?"
+	const insertCmd = "INSERT INTO group_grants (`group`, `pattern`, `role`)" +
+		" VALUES (?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE `role`=VALUES(`role`)"
+	const deleteCmd = "DELETE FROM group_grants" +
+		" WHERE `group`=? AND `pattern`=?"
+
+	if err = checkHostPattern(pattern); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if role == RoleNone {
+		if _, err = execTx(tx, deleteCmd, group, pattern); err != nil {
+			return
+		}
+	}else{
+		var ok bool
+		if err = tx.QueryRowContext(ctx, queryCmd, group).Scan(&ok); err != nil {
+			if err == sql.ErrNoRows {
+				err = GroupNotExistsErr
+			}
+			return
+		}
+		if _, err = execTx(tx, insertCmd, group, pattern, role); err != nil {
+			return
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)CreateUser(username string, password string)(err error){
+	const queryCmd = "SELECT 1 FROM users" +
+		" WHERE `username`=?"
+	const insertCmd = "INSERT INTO users (`username`, `password`, `created_at`)" +
+		" VALUES (?, ?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, queryCmd, username).Scan(&exists); err == nil {
+		return UserExistsErr
+	}else if err != sql.ErrNoRows {
+		return
+	}
+	if _, err = execTx(tx, insertCmd, username, password, time.Now().UTC()); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)RemoveUser(username string)(err error){
+	const delete1Cmd = "DELETE FROM tokens" +
+		" WHERE `username`=?"
+	const delete2Cmd = "DELETE FROM users" +
+		" WHERE `username`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = execTx(tx, delete1Cmd, username); err != nil {
+		return
+	}
+	res, err := execTx(tx, delete2Cmd, username)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return UserNotExistsErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)ListUsers()(users []User, err error){
+	const queryCmd = "SELECT `username`,`password`!='',`created_at`" +
+		" FROM users"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user User
+		if err = rows.Scan(&user.Username, &user.HasPassword, &user.CreatedAt); err != nil {
+			return
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)GetUserPassword(username string)(password string, err error){
+	const queryCmd = "SELECT `password` FROM users" +
+		" WHERE `username`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if err = v.DB.QueryRowContext(ctx, queryCmd, username).Scan(&password); err != nil {
+		if err == sql.ErrNoRows {
+			err = UserNotExistsErr
+		}
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SetUserPassword(username string, password string)(err error){
+	// MySQL does not count the rows that are not changed, so check the user first
+	const queryCmd = "SELECT 1 FROM users" +
+		" WHERE `username`=?"
+	const updateCmd = "UPDATE users SET" +
+		" `password`=?" +
+		" WHERE `username`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, queryCmd, username).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			err = UserNotExistsErr
+		}
+		return
+	}
+	if _, err = execTx(tx, updateCmd, password, username); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)NewUserToken(username string, expiration *time.Time)(token string, err error){
+	const queryCmd = "SELECT 1 FROM users" +
+		" WHERE `username`=?"
+	const insertCmd = "INSERT INTO tokens (`token`, `expiration`, `username`)" +
+		" VALUES (?, ?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if token, err = generateToken(); err != nil {
+		return
+	}
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, queryCmd, username).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			err = UserNotExistsErr
+		}
+		return "", err
+	}
+	if _, err = execTx(tx, insertCmd, token, expiration, username); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	token = cliTokenPrefix + token
+	return
+}
+
+func (v *MySQLAPI)SeenDevice(device DeviceRecord)(err error){
+	const insertCmd = "INSERT INTO devices (`host`, `id`, `type`, `label`, `first_seen`, `last_seen`, `last_addr`)" +
+		" VALUES (?, ?, ?, ?, ?, ?, ?)" +
+		" ON DUPLICATE KEY UPDATE `type`=VALUES(`type`), `label`=VALUES(`label`)," +
+		" `last_seen`=VALUES(`last_seen`), `last_addr`=VALUES(`last_addr`)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	seen := device.LastSeen.UnixMilli()
+	if _, err = execTx(tx, insertCmd, device.Host, device.Id, device.Device, device.Label,
+		seen, seen, device.LastAddr); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)ListDevices(host string)(devices []DeviceRecord, err error){
+	const queryCmd = "SELECT `id`,`type`,`label`,`note`,`tags`,`first_seen`,`last_seen`,`last_addr` FROM devices" +
+		" WHERE `host`=?" +
+		" ORDER BY `id`"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, host); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DeviceRecord
+		if d, err = scanDevice(rows.Scan); err != nil {
+			return
+		}
+		d.Host = host
+		devices = append(devices, d)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+// scanDevice scans a row of `id`,`type`,`label`,`note`,`tags`,`first_seen`,`last_seen`,`last_addr`
+func scanDevice(scan func(dest ...any)(error))(d DeviceRecord, err error){
+	var (
+		tags string
+		firstSeen, lastSeen int64
+	)
+	if err = scan(&d.Id, &d.Device, &d.Label, &d.Note, &tags, &firstSeen, &lastSeen, &d.LastAddr); err != nil {
+		return
+	}
+	d.Tags = splitScopes(tags)
+	d.FirstSeen = time.UnixMilli(firstSeen).UTC()
+	d.LastSeen = time.UnixMilli(lastSeen).UTC()
+	return
+}
+
+func (v *MySQLAPI)GetDevice(host string, id int64)(device DeviceRecord, err error){
+	const queryCmd = "SELECT `id`,`type`,`label`,`note`,`tags`,`first_seen`,`last_seen`,`last_addr` FROM devices" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if device, err = scanDevice(v.DB.QueryRowContext(ctx, queryCmd, host, id).Scan); err != nil {
+		if err == sql.ErrNoRows {
+			err = DeviceNotExistsErr
+		}
+		return
+	}
+	device.Host = host
+	return
+}
+
+func (v *MySQLAPI)SetDeviceNote(host string, id int64, note string)(err error){
+	const queryCmd = "SELECT 1 FROM devices" +
+		" WHERE `host`=? AND `id`=?"
+	const updateCmd = "UPDATE devices SET `note`=?" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// RowsAffected is zero if the note is not changed, so check the existence first
+	var ok bool
+	if err = tx.QueryRowContext(ctx, queryCmd, host, id).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = DeviceNotExistsErr
+		}
+		return
+	}
+	if _, err = execTx(tx, updateCmd, note, host, id); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SetDeviceTags(host string, id int64, tags []string)(err error){
+	const queryCmd = "SELECT 1 FROM devices" +
+		" WHERE `host`=? AND `id`=?"
+	const updateCmd = "UPDATE devices SET `tags`=?" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var ok bool
+	if err = tx.QueryRowContext(ctx, queryCmd, host, id).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = DeviceNotExistsErr
+		}
+		return
+	}
+	if _, err = execTx(tx, updateCmd, strings.Join(tags, " "), host, id); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)ForgetDevice(host string, id int64)(err error){
+	const deleteCmd = "DELETE FROM devices" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := execTx(tx, deleteCmd, host, id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return DeviceNotExistsErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+// messageColumns are the columns that scanMessage reads
+const messageColumns = "`id`,`host`,`device`,`data`,`status`,`created_at`,`expires_at`,`delivered_at`"
+
+// scanMessage reads a row of device_outbox selected with messageColumns
+func scanMessage(scan func(dest ...any)(error))(msg QueuedMessage, err error){
+	var (
+		data string
+		createdAt, expiresAt int64
+		deliveredAt sql.NullInt64
+	)
+	if err = scan(&msg.Id, &msg.Host, &msg.Device, &data, &msg.Status, &createdAt, &expiresAt, &deliveredAt); err != nil {
+		return
+	}
+	if err = json.Unmarshal(([]byte)(data), &msg.Data); err != nil {
+		return
+	}
+	msg.CreatedAt = time.UnixMilli(createdAt).UTC()
+	msg.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+	if deliveredAt.Valid {
+		t := time.UnixMilli(deliveredAt.Int64).UTC()
+		msg.DeliveredAt = &t
+	}
+	return
+}
+
+func (v *MySQLAPI)QueueMessage(msg *QueuedMessage, limit int)(err error){
+	const countCmd = "SELECT COUNT(*) FROM device_outbox" +
+		" WHERE `host`=? AND `device`=? AND `status`=?" +
+		" FOR UPDATE"
+	const insertCmd = "INSERT INTO device_outbox (`host`, `device`, `data`, `status`, `created_at`, `expires_at`)" +
+		" VALUES (?, ?, ?, ?, ?, ?)"
+
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err = tx.QueryRowContext(ctx, countCmd, msg.Host, msg.Device, MessageQueued).Scan(&n); err != nil {
+		return
+	}
+	if n >= limit {
+		return OutboxLimitErr
+	}
+	res, err := execTx(tx, insertCmd, msg.Host, msg.Device, data, MessageQueued,
+		msg.CreatedAt.UnixMilli(), msg.ExpiresAt.UnixMilli())
+	if err != nil {
+		return
+	}
+	if msg.Id, err = res.LastInsertId(); err != nil {
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	msg.Status = MessageQueued
+	msg.DeliveredAt = nil
+	return
+}
+
+func (v *MySQLAPI)queryMessages(queryCmd string, args ...any)(msgs []QueuedMessage, err error){
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg QueuedMessage
+		if msg, err = scanMessage(rows.Scan); err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)PendingMessages(host string, device int64, now time.Time)(msgs []QueuedMessage, err error){
+	const queryCmd = "SELECT " + messageColumns + " FROM device_outbox" +
+		" WHERE `host`=? AND `device`=? AND `status`=? AND `expires_at`>=?" +
+		" ORDER BY `id`"
+	return v.queryMessages(queryCmd, host, device, MessageQueued, now.UnixMilli())
+}
+
+func (v *MySQLAPI)ListMessages(host string, device int64)(msgs []QueuedMessage, err error){
+	const queryCmd = "SELECT " + messageColumns + " FROM device_outbox" +
+		" WHERE `host`=? AND `device`=?" +
+		" ORDER BY `id`"
+	return v.queryMessages(queryCmd, host, device)
+}
+
+func (v *MySQLAPI)GetMessage(id int64)(msg QueuedMessage, err error){
+	const queryCmd = "SELECT " + messageColumns + " FROM device_outbox" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if msg, err = scanMessage(v.DB.QueryRowContext(ctx, queryCmd, id).Scan); err == sql.ErrNoRows {
+		err = MessageNotExistsErr
+	}
+	return
+}
+
+func (v *MySQLAPI)SetMessageDelivered(id int64, at time.Time)(err error){
+	const updateCmd = "UPDATE device_outbox SET `status`=?, `delivered_at`=?" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := execTx(tx, updateCmd, MessageDelivered, at.UnixMilli(), id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return MessageNotExistsErr
+	}
+
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *MySQLAPI)SweepMessages(now time.Time, purgeBefore time.Time)(n int64, err error){
+	const updateCmd = "UPDATE device_outbox SET `status`=?" +
+		" WHERE `status`=? AND `expires_at`<?"
+	const deleteCmd = "DELETE FROM device_outbox" +
+		" WHERE `status`<>? AND `created_at`<?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := execTx(tx, updateCmd, MessageExpired, MessageQueued, now.UnixMilli())
+	if err != nil {
+		return
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return
 	}
-	if _, err = execTx(tx, cmd, token, server); err != nil {
+	if _, err = execTx(tx, deleteCmd, MessageQueued, purgeBefore.UnixMilli()); err != nil {
 		return
 	}
 
@@ -0,0 +1,1374 @@
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteAPI is a pure-Go DataAPI implementation that keeps everything in a single file.
+// It is meant for small single-host deployments and tests,
+// where starting a MySQL server is not worth it.
+type SQLiteAPI struct {
+	DB *sql.DB
+}
+
+var _ DataAPI = (*SQLiteAPI)(nil)
+
+// NewSQLiteAPI opens (or creates) the database at path.
+// The special path ":memory:" gives a private database that is lost after close.
+func NewSQLiteAPI(path string)(v *SQLiteAPI, err error){
+	v = &SQLiteAPI{}
+
+	if v.DB, err = openSQLiteDB(path); err != nil {
+		return
+	}
+	if err = migrateUp(v.DB, "sqlite"); err != nil {
+		return
+	}
+
+	if err = v.createAndLogRootTokenIfNotExists(); err != nil {
+		return
+	}
+	return
+}
+
+func openSQLiteDB(path string)(db *sql.DB, err error){
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"foreign_keys(1)", "busy_timeout(5000)"},
+	}.Encode()
+	if db, err = sql.Open("sqlite", dsn); err != nil {
+		return
+	}
+	// SQLite only allows one writer at a time, and every connection to ":memory:" is a new database
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+	if err = db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return
+}
+
+func (v *SQLiteAPI)Close()(error){
+	return v.DB.Close()
+}
+
+func sqliteNow()(int64){
+	return time.Now().Unix()
+}
+
+func sqliteTime(t *time.Time)(any){
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+func sqliteParseTime(t sql.NullInt64)(*time.Time){
+	if !t.Valid {
+		return nil
+	}
+	v := time.Unix(t.Int64, 0).UTC()
+	return &v
+}
+
+func (v *SQLiteAPI)createAndLogRootTokenIfNotExists()(err error){
+	const queryCmd = "SELECT 1 FROM tokens" +
+		" WHERE (`expiration` IS NULL OR `expiration`>=?)" +
+		" AND `root`=TRUE"
+	const insertCmd = "INSERT INTO tokens (`token`, `root`, `expiration`)" +
+		" VALUES (?, TRUE, NULL)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var ok bool
+	if err = v.DB.QueryRowContext(ctx, queryCmd, sqliteNow()).Scan(&ok); err == nil && ok {
+		return
+	}
+
+	loger.Warn("Root token is not exists, creating one...")
+
+	token, err := generateToken()
+	if err != nil {
+		return
+	}
+
+	if _, err = v.ExecContext(ctx, insertCmd, token); err != nil {
+		return
+	}
+
+	loger.Warn("****************************************************************")
+	loger.Warnf("new_root_token=%s", cliTokenPrefix + token)
+	loger.Warn("****************************************************************")
+	return
+}
+
+func (v *SQLiteAPI)QueryContext(ctx context.Context, cmd string, args ...any)(rows *sql.Rows, err error){
+	loger.Debugf("Query sql cmd: %s\n  args: %v", cmd, args)
+	return v.DB.QueryContext(ctx, cmd, args...)
+}
+
+func (v *SQLiteAPI)ExecContext(ctx context.Context, cmd string, args ...any)(res sql.Result, err error){
+	loger.Debugf("Exec sql cmd: %s\n  args: %v", cmd, args)
+	return v.DB.ExecContext(ctx, cmd, args...)
+}
+
+func (v *SQLiteAPI)NewCliToken(expiration *time.Time)(token string, err error){
+	const insertCmd = "INSERT INTO tokens (`token`, `expiration`)" +
+		" VALUES (?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if token, err = generateToken(); err != nil {
+		return
+	}
+	if _, err = v.ExecContext(ctx, insertCmd, token, sqliteTime(expiration)); err != nil {
+		return
+	}
+	token = cliTokenPrefix + token
+	return
+}
+
+func (v *SQLiteAPI)NewDaemonToken(server string, expiration *time.Time)(token string, err error){
+	const insertCmd = "INSERT INTO daemon_tokens (`token`, `server`, `expiration`)" +
+		" VALUES (?, ?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if token, err = generateToken(); err != nil {
+		return
+	}
+	if _, err = v.ExecContext(ctx, insertCmd, token, server, sqliteTime(expiration)); err != nil {
+		return
+	}
+	token = daemonTokenPrefix + token
+	return
+}
+
+func (v *SQLiteAPI)RemoveCliToken(token string)(err error){
+	const deleteCmd = "DELETE FROM tokens" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if _, err = v.ExecContext(ctx, deleteCmd, token); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)RemoveDaemonToken(token string)(err error){
+	const deleteCmd = "DELETE FROM daemon_tokens" +
+		" WHERE `token`=?"
+
+	if len(token) != daemonTokenLen || token[:len(daemonTokenPrefix)] != daemonTokenPrefix {
+		return TokenNotExistsErr
+	}
+	token = token[len(daemonTokenPrefix):]
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if _, err = v.ExecContext(ctx, deleteCmd, token); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)ListTokens()(tokens []Token, err error){
+	const queryCmd = "SELECT `token`,`root`,`expiration`,`username`,`scopes`" +
+		" FROM tokens"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			tk Token
+			expiration sql.NullInt64
+			username sql.NullString
+			scopes sql.NullString
+		)
+		if err = rows.Scan(&tk.Token, &tk.Root, &expiration, &username, &scopes); err != nil {
+			return
+		}
+		tk.Token = cliTokenPrefix + tk.Token
+		tk.Expiration = sqliteParseTime(expiration)
+		tk.Username = username.String
+		tk.Scopes = splitScopes(scopes.String)
+		tokens = append(tokens, tk)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)ListDaemonTokens()(tokens []DaemonToken, err error){
+	const queryCmd = "SELECT `token`,`server`,`expiration`" +
+		" FROM daemon_tokens"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			tk DaemonToken
+			expiration sql.NullInt64
+		)
+		if err = rows.Scan(&tk.Token, &tk.Server, &expiration); err != nil {
+			return
+		}
+		tk.Token = daemonTokenPrefix + tk.Token
+		tk.Expiration = sqliteParseTime(expiration)
+		tokens = append(tokens, tk)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)AuthCli(token string)(ok bool){
+	const queryCmd = "SELECT 1 FROM tokens" +
+		" WHERE (`expiration` IS NULL OR `expiration`>=?)" +
+		" AND `token`=?"
+
+	if token, ok = preProcessCliToken(token); !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if err := v.DB.QueryRowContext(ctx, queryCmd, sqliteNow(), token).Scan(&ok); err != nil {
+		return false
+	}
+	return
+}
+
+func (v *SQLiteAPI)AuthDaemon(token string, server string)(ok bool){
+	const queryCmd = "SELECT 1 FROM daemon_tokens" +
+		" WHERE (`expiration` IS NULL OR `expiration`>=?)" +
+		" AND `token`=? AND `server`=?"
+
+	if len(token) != daemonTokenLen || token[:len(daemonTokenPrefix)] != daemonTokenPrefix {
+		return false
+	}
+	token = token[len(daemonTokenPrefix):]
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if err := v.DB.QueryRowContext(ctx, queryCmd, sqliteNow(), token, server).Scan(&ok); err != nil {
+		return false
+	}
+	return
+}
+
+func (v *SQLiteAPI)GetUserInfo(token string)(info UserInfo, err error){
+	const queryCmd = "SELECT `username` FROM tokens" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var username sql.NullString
+	if err = v.DB.QueryRowContext(ctx, queryCmd, token).
+		Scan(&username); err != nil {
+		return
+	}
+	if username.Valid {
+		info.Username = username.String
+		info.IsUser = true
+	}else{
+		info.Username = "cli-" + token[:4]
+	}
+	return
+}
+
+func (v *SQLiteAPI)CheckRootToken(rtToken string)(ok bool){
+	const queryCmd = "SELECT `root` FROM tokens" +
+		" WHERE (`expiration` IS NULL OR `expiration`>=?)" +
+		" AND `token`=?"
+
+	if rtToken, ok = preProcessCliToken(rtToken); !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if err := v.DB.QueryRowContext(ctx, queryCmd, sqliteNow(), rtToken).Scan(&ok); err != nil {
+		return false
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetRoot(token string, value bool)(err error){
+	const updateCmd = "UPDATE tokens SET" +
+		" `root`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if _, err = v.ExecContext(ctx, updateCmd, value, token); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)GetScopes(token string)(scopes []string, err error){
+	const queryCmd = "SELECT `scopes` FROM tokens" +
+		" WHERE (`expiration` IS NULL OR `expiration`>=?)" +
+		" AND `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return nil, TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var s sql.NullString
+	if err = v.DB.QueryRowContext(ctx, queryCmd, sqliteNow(), token).Scan(&s); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	return splitScopes(s.String), nil
+}
+
+func (v *SQLiteAPI)SetScopes(token string, scopes []string)(err error){
+	const updateCmd = "UPDATE tokens SET" +
+		" `scopes`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, joinScopes(scopes), token)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return TokenNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetCliTokenExpiration(token string, expiration *time.Time)(err error){
+	const updateCmd = "UPDATE tokens SET" +
+		" `expiration`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, sqliteTime(expiration), token)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return TokenNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetDaemonTokenExpiration(token string, expiration *time.Time)(err error){
+	const updateCmd = "UPDATE daemon_tokens SET" +
+		" `expiration`=?" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessDaemonToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, sqliteTime(expiration), token)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return TokenNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)RemoveExpiredTokens()(n int64, err error){
+	// token_grants, token_group_members and cli_web_plugins are removed by the foreign key cascade
+	const delete1Cmd = "DELETE FROM tokens" +
+		" WHERE `expiration` IS NOT NULL AND `expiration`<?"
+	const delete2Cmd = "DELETE FROM daemon_tokens" +
+		" WHERE `expiration` IS NOT NULL AND `expiration`<?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 30)
+	defer cancel()
+
+	now := sqliteNow()
+	for _, cmd := range []string{delete1Cmd, delete2Cmd} {
+		var res sql.Result
+		if res, err = v.ExecContext(ctx, cmd, now); err != nil {
+			return
+		}
+		m, _ := res.RowsAffected()
+		n += m
+	}
+	return
+}
+
+func (v *SQLiteAPI)CreateServer(id string)(err error){
+	const insertCmd = "INSERT INTO servers (`id`)" +
+		" VALUES (?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if _, err = v.ExecContext(ctx, insertCmd, id); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)RemoveServer(id string)(err error){
+	// grants on patterns are kept, since they may match other servers
+	const delete1Cmd = "DELETE FROM token_grants" +
+		" WHERE `pattern`=?"
+	const delete2Cmd = "DELETE FROM group_grants" +
+		" WHERE `pattern`=?"
+	const delete3Cmd = "DELETE FROM devices" +
+		" WHERE `host`=?"
+	const delete4Cmd = "DELETE FROM device_outbox" +
+		" WHERE `host`=?"
+	const delete5Cmd = "DELETE FROM servers" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, cmd := range []string{delete1Cmd, delete2Cmd, delete3Cmd, delete4Cmd, delete5Cmd} {
+		if _, err = tx.ExecContext(ctx, cmd, id); err != nil {
+			return
+		}
+	}
+	return tx.Commit()
+}
+
+// tokenGrants returns the grants of the token and its groups.
+// err will be TokenNotExistsErr if the token is not exists or expired
+func (v *SQLiteAPI)tokenGrants(ctx context.Context, token string)(root bool, grants []HostGrant, err error){
+	const query1Cmd = "SELECT `root` FROM tokens" +
+		" WHERE (`expiration` IS NULL OR `expiration`>=?)" +
+		" AND `token`=?"
+	const query2Cmd = "SELECT `pattern`,`role` FROM token_grants" +
+		" WHERE `token`=?" +
+		" UNION ALL" +
+		" SELECT g.`pattern`,g.`role` FROM group_grants AS g" +
+		" JOIN token_group_members AS m ON m.`group`=g.`group`" +
+		" WHERE m.`token`=?"
+
+	if err = v.DB.QueryRowContext(ctx, query1Cmd, sqliteNow(), token).Scan(&root); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	if root {
+		return
+	}
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, query2Cmd, token, token); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g HostGrant
+		if err = rows.Scan(&g.Pattern, &g.Role); err != nil {
+			return
+		}
+		grants = append(grants, g)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)ListServers(token string)(servers []string, err error){
+	const queryCmd = "SELECT `id` FROM servers"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = PermDeniedErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	root, grants, err := v.tokenGrants(ctx, token)
+	if err != nil {
+		return
+	}
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var server string
+		if err = rows.Scan(&server); err != nil {
+			return
+		}
+		servers = append(servers, server)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if !root {
+		servers = filterHosts(grants, servers, RoleViewer)
+	}
+	return
+}
+
+func (v *SQLiteAPI)HasServer(id string)(ok bool, err error){
+	const queryCmd = "SELECT 1 FROM servers" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var one int
+	if err = v.DB.QueryRowContext(ctx, queryCmd, id).Scan(&one); err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return
+	}
+	return true, nil
+}
+
+func (v *SQLiteAPI)CheckPerm(token string, server string)(ok bool){
+	return v.GetRole(token, server) >= RoleViewer
+}
+
+func (v *SQLiteAPI)SetPerm(token string, server string, value bool)(err error){
+	if !value {
+		return v.SetGrant(token, server, RoleNone)
+	}
+	// an admin grant is not downgraded
+	return v.setGrant(token, server, RoleOperator, true)
+}
+
+func (v *SQLiteAPI)GetRole(token string, host string)(role Role){
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return RoleNone
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	root, grants, err := v.tokenGrants(ctx, token)
+	if err != nil {
+		return RoleNone
+	}
+	if root {
+		return RoleAdmin
+	}
+	return resolveRole(grants, host)
+}
+
+func (v *SQLiteAPI)ListGrants(token string)(grants []HostGrant, err error){
+	const queryCmd = "SELECT `pattern`,`role` FROM token_grants" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, token); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g HostGrant
+		if err = rows.Scan(&g.Pattern, &g.Role); err != nil {
+			return
+		}
+		grants = append(grants, g)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	sortGrants(grants)
+	return
+}
+
+func (v *SQLiteAPI)SetGrant(token string, pattern string, role Role)(err error){
+	return v.setGrant(token, pattern, role, false)
+}
+
+// setGrant sets the role of the token on the pattern, if keepAdmin is true an existing admin grant is kept
+func (v *SQLiteAPI)setGrant(token string, pattern string, role Role, keepAdmin bool)(err error){
+	const queryCmd = "SELECT 1 FROM tokens" +
+		" WHERE `token`=?"
+	const insertCmd = "INSERT INTO token_grants (`token`, `pattern`, `role`)" +
+		" VALUES (?, ?, ?)" +
+		" ON CONFLICT (`token`, `pattern`) DO UPDATE SET `role`=excluded.`role`"
+	const upgradeCmd = "INSERT INTO token_grants (`token`, `pattern`, `role`)" +
+		" VALUES (?, ?, ?)" +
+		" ON CONFLICT (`token`, `pattern`) DO UPDATE SET `role`=excluded.`role`" +
+		" WHERE `role`<>?"
+	const deleteCmd = "DELETE FROM token_grants" +
+		" WHERE `token`=? AND `pattern`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+	if err = checkHostPattern(pattern); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if role == RoleNone {
+		_, err = v.ExecContext(ctx, deleteCmd, token, pattern)
+		return
+	}
+	if err = v.DB.QueryRowContext(ctx, queryCmd, token).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	if keepAdmin {
+		_, err = v.ExecContext(ctx, upgradeCmd, token, pattern, role, RoleAdmin)
+	}else{
+		_, err = v.ExecContext(ctx, insertCmd, token, pattern, role)
+	}
+	return
+}
+
+func (v *SQLiteAPI)CreateGroup(name string)(err error){
+	const queryCmd = "SELECT 1 FROM token_groups" +
+		" WHERE `name`=?"
+	const insertCmd = "INSERT INTO token_groups (`name`)" +
+		" VALUES (?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var ok bool
+	if err = v.DB.QueryRowContext(ctx, queryCmd, name).Scan(&ok); err == nil {
+		return GroupExistsErr
+	}else if err != sql.ErrNoRows {
+		return
+	}
+	if _, err = v.ExecContext(ctx, insertCmd, name); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)RemoveGroup(name string)(err error){
+	const deleteCmd = "DELETE FROM token_groups" +
+		" WHERE `name`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, deleteCmd, name)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return GroupNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)ListGroups()(groups []Group, err error){
+	const query1Cmd = "SELECT `name` FROM token_groups" +
+		" ORDER BY `name`"
+	const query2Cmd = "SELECT `group`,`token` FROM token_group_members"
+	const query3Cmd = "SELECT `group`,`pattern`,`role` FROM group_grants" +
+		" ORDER BY `pattern`"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, query1Cmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	index := make(map[string]int)
+	for rows.Next() {
+		var g Group
+		if err = rows.Scan(&g.Name); err != nil {
+			return
+		}
+		g.Members = make([]string, 0)
+		g.Grants = make([]HostGrant, 0)
+		index[g.Name] = len(groups)
+		groups = append(groups, g)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	rows.Close()
+
+	if rows, err = v.QueryContext(ctx, query2Cmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, token string
+		if err = rows.Scan(&name, &token); err != nil {
+			return
+		}
+		if i, ok := index[name]; ok {
+			groups[i].Members = append(groups[i].Members, cliTokenPrefix + token)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	rows.Close()
+
+	if rows, err = v.QueryContext(ctx, query3Cmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name string
+			g HostGrant
+		)
+		if err = rows.Scan(&name, &g.Pattern, &g.Role); err != nil {
+			return
+		}
+		if i, ok := index[name]; ok {
+			groups[i].Grants = append(groups[i].Grants, g)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetGroupMember(group string, token string, member bool)(err error){
+	const query1Cmd = "SELECT 1 FROM token_groups" +
+		" WHERE `name`=?"
+	const query2Cmd = "SELECT 1 FROM tokens" +
+		" WHERE `token`=?"
+	const insertCmd = "INSERT OR IGNORE INTO token_group_members (`group`, `token`)" +
+		" VALUES (?, ?)"
+	const deleteCmd = "DELETE FROM token_group_members" +
+		" WHERE `group`=? AND `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		return TokenNotExistsErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if !member {
+		_, err = v.ExecContext(ctx, deleteCmd, group, token)
+		return
+	}
+	if err = v.DB.QueryRowContext(ctx, query1Cmd, group).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = GroupNotExistsErr
+		}
+		return
+	}
+	if err = v.DB.QueryRowContext(ctx, query2Cmd, token).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = TokenNotExistsErr
+		}
+		return
+	}
+	if _, err = v.ExecContext(ctx, insertCmd, group, token); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetGroupGrant(group string, pattern string, role Role)(err error){
+	const queryCmd = "SELECT 1 FROM token_groups" +
+		" WHERE `name`=?"
+	const insertCmd = "INSERT INTO group_grants (`group`, `pattern`, `role`)" +
+		" VALUES (?, ?, ?)" +
+		" ON CONFLICT (`group`, `pattern`) DO UPDATE SET `role`=excluded.`role`"
+	const deleteCmd = "DELETE FROM group_grants" +
+		" WHERE `group`=? AND `pattern`=?"
+
+	if err = checkHostPattern(pattern); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if role == RoleNone {
+		_, err = v.ExecContext(ctx, deleteCmd, group, pattern)
+		return
+	}
+	var ok bool
+	if err = v.DB.QueryRowContext(ctx, queryCmd, group).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = GroupNotExistsErr
+		}
+		return
+	}
+	if _, err = v.ExecContext(ctx, insertCmd, group, pattern, role); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)CreateUser(username string, password string)(err error){
+	const queryCmd = "SELECT 1 FROM users" +
+		" WHERE `username`=?"
+	const insertCmd = "INSERT INTO users (`username`, `password`, `created_at`)" +
+		" VALUES (?, ?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, queryCmd, username).Scan(&exists); err == nil {
+		return UserExistsErr
+	}else if err != sql.ErrNoRows {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, insertCmd, username, password, sqliteNow()); err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+func (v *SQLiteAPI)RemoveUser(username string)(err error){
+	const delete1Cmd = "DELETE FROM tokens" +
+		" WHERE `username`=?"
+	const delete2Cmd = "DELETE FROM users" +
+		" WHERE `username`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, delete1Cmd, username); err != nil {
+		return
+	}
+	res, err := tx.ExecContext(ctx, delete2Cmd, username)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return UserNotExistsErr
+	}
+	return tx.Commit()
+}
+
+func (v *SQLiteAPI)ListUsers()(users []User, err error){
+	const queryCmd = "SELECT `username`,`password`!='',`created_at`" +
+		" FROM users"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			user User
+			createdAt int64
+		)
+		if err = rows.Scan(&user.Username, &user.HasPassword, &createdAt); err != nil {
+			return
+		}
+		user.CreatedAt = time.Unix(createdAt, 0).UTC()
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)GetUserPassword(username string)(password string, err error){
+	const queryCmd = "SELECT `password` FROM users" +
+		" WHERE `username`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if err = v.DB.QueryRowContext(ctx, queryCmd, username).Scan(&password); err != nil {
+		if err == sql.ErrNoRows {
+			err = UserNotExistsErr
+		}
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetUserPassword(username string, password string)(err error){
+	const updateCmd = "UPDATE users SET" +
+		" `password`=?" +
+		" WHERE `username`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, password, username)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return UserNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)NewUserToken(username string, expiration *time.Time)(token string, err error){
+	const queryCmd = "SELECT 1 FROM users" +
+		" WHERE `username`=?"
+	const insertCmd = "INSERT INTO tokens (`token`, `expiration`, `username`)" +
+		" VALUES (?, ?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if token, err = generateToken(); err != nil {
+		return
+	}
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRowContext(ctx, queryCmd, username).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			err = UserNotExistsErr
+		}
+		return "", err
+	}
+	if _, err = tx.ExecContext(ctx, insertCmd, token, sqliteTime(expiration), username); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+
+	token = cliTokenPrefix + token
+	return
+}
+
+func (v *SQLiteAPI)SeenDevice(device DeviceRecord)(err error){
+	const insertCmd = "INSERT INTO devices (`host`, `id`, `type`, `label`, `first_seen`, `last_seen`, `last_addr`)" +
+		" VALUES (?, ?, ?, ?, ?, ?, ?)" +
+		" ON CONFLICT (`host`, `id`) DO UPDATE SET `type`=excluded.`type`, `label`=excluded.`label`," +
+		" `last_seen`=excluded.`last_seen`, `last_addr`=excluded.`last_addr`"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	seen := device.LastSeen.UnixMilli()
+	_, err = v.ExecContext(ctx, insertCmd, device.Host, device.Id, device.Device, device.Label,
+		seen, seen, device.LastAddr)
+	return
+}
+
+func (v *SQLiteAPI)ListDevices(host string)(devices []DeviceRecord, err error){
+	const queryCmd = "SELECT `id`,`type`,`label`,`note`,`tags`,`first_seen`,`last_seen`,`last_addr` FROM devices" +
+		" WHERE `host`=?" +
+		" ORDER BY `id`"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, host); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d DeviceRecord
+		if d, err = scanDevice(rows.Scan); err != nil {
+			return
+		}
+		d.Host = host
+		devices = append(devices, d)
+	}
+	err = rows.Err()
+	return
+}
+
+func (v *SQLiteAPI)GetDevice(host string, id int64)(device DeviceRecord, err error){
+	const queryCmd = "SELECT `id`,`type`,`label`,`note`,`tags`,`first_seen`,`last_seen`,`last_addr` FROM devices" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if device, err = scanDevice(v.DB.QueryRowContext(ctx, queryCmd, host, id).Scan); err != nil {
+		if err == sql.ErrNoRows {
+			err = DeviceNotExistsErr
+		}
+		return
+	}
+	device.Host = host
+	return
+}
+
+func (v *SQLiteAPI)SetDeviceNote(host string, id int64, note string)(err error){
+	const updateCmd = "UPDATE devices SET `note`=?" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, note, host, id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return DeviceNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetDeviceTags(host string, id int64, tags []string)(err error){
+	const updateCmd = "UPDATE devices SET `tags`=?" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, strings.Join(tags, " "), host, id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return DeviceNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)ForgetDevice(host string, id int64)(err error){
+	const deleteCmd = "DELETE FROM devices" +
+		" WHERE `host`=? AND `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, deleteCmd, host, id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return DeviceNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)QueueMessage(msg *QueuedMessage, limit int)(err error){
+	const countCmd = "SELECT COUNT(*) FROM device_outbox" +
+		" WHERE `host`=? AND `device`=? AND `status`=?"
+	const insertCmd = "INSERT INTO device_outbox (`host`, `device`, `data`, `status`, `created_at`, `expires_at`)" +
+		" VALUES (?, ?, ?, ?, ?, ?)"
+
+	data, err := json.Marshal(msg.Data)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err = tx.QueryRowContext(ctx, countCmd, msg.Host, msg.Device, MessageQueued).Scan(&n); err != nil {
+		return
+	}
+	if n >= limit {
+		return OutboxLimitErr
+	}
+	res, err := tx.ExecContext(ctx, insertCmd, msg.Host, msg.Device, data, MessageQueued,
+		msg.CreatedAt.UnixMilli(), msg.ExpiresAt.UnixMilli())
+	if err != nil {
+		return
+	}
+	if msg.Id, err = res.LastInsertId(); err != nil {
+		return
+	}
+	if err = tx.Commit(); err != nil {
+		return
+	}
+	msg.Status = MessageQueued
+	msg.DeliveredAt = nil
+	return
+}
+
+func (v *SQLiteAPI)queryMessages(queryCmd string, args ...any)(msgs []QueuedMessage, err error){
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, args...); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg QueuedMessage
+		if msg, err = scanMessage(rows.Scan); err != nil {
+			return
+		}
+		msgs = append(msgs, msg)
+	}
+	err = rows.Err()
+	return
+}
+
+func (v *SQLiteAPI)PendingMessages(host string, device int64, now time.Time)(msgs []QueuedMessage, err error){
+	const queryCmd = "SELECT " + messageColumns + " FROM device_outbox" +
+		" WHERE `host`=? AND `device`=? AND `status`=? AND `expires_at`>=?" +
+		" ORDER BY `id`"
+	return v.queryMessages(queryCmd, host, device, MessageQueued, now.UnixMilli())
+}
+
+func (v *SQLiteAPI)ListMessages(host string, device int64)(msgs []QueuedMessage, err error){
+	const queryCmd = "SELECT " + messageColumns + " FROM device_outbox" +
+		" WHERE `host`=? AND `device`=?" +
+		" ORDER BY `id`"
+	return v.queryMessages(queryCmd, host, device)
+}
+
+func (v *SQLiteAPI)GetMessage(id int64)(msg QueuedMessage, err error){
+	const queryCmd = "SELECT " + messageColumns + " FROM device_outbox" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if msg, err = scanMessage(v.DB.QueryRowContext(ctx, queryCmd, id).Scan); err == sql.ErrNoRows {
+		err = MessageNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)SetMessageDelivered(id int64, at time.Time)(err error){
+	const updateCmd = "UPDATE device_outbox SET `status`=?, `delivered_at`=?" +
+		" WHERE `id`=?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	res, err := v.ExecContext(ctx, updateCmd, MessageDelivered, at.UnixMilli(), id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return MessageNotExistsErr
+	}
+	return
+}
+
+func (v *SQLiteAPI)SweepMessages(now time.Time, purgeBefore time.Time)(n int64, err error){
+	const updateCmd = "UPDATE device_outbox SET `status`=?" +
+		" WHERE `status`=? AND `expires_at`<?"
+	const deleteCmd = "DELETE FROM device_outbox" +
+		" WHERE `status`<>? AND `created_at`<?"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	tx, err := v.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, updateCmd, MessageExpired, MessageQueued, now.UnixMilli())
+	if err != nil {
+		return
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return
+	}
+	if _, err = tx.ExecContext(ctx, deleteCmd, MessageQueued, purgeBefore.UnixMilli()); err != nil {
+		return
+	}
+	err = tx.Commit()
+	return
+}
+
+func (v *SQLiteAPI)ListCliWebScripts(token string)(scripts []WebScriptId, err error){
+	const queryCmd = "SELECT `plugin`, `version` FROM cli_web_plugins" +
+		" WHERE `token`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var rows *sql.Rows
+	if rows, err = v.QueryContext(ctx, queryCmd, token); err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var script WebScriptId
+		if err = rows.Scan(&script.Id, &script.Version); err != nil {
+			return
+		}
+		scripts = append(scripts, script)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)AddCliWebScript(token string, plugin WebScriptId)(err error){
+	const insertCmd = "INSERT INTO cli_web_plugins (`token`, `plugin`, `version`)" +
+		" VALUES (?, ?, ?)"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if _, err = v.ExecContext(ctx, insertCmd, token, plugin.Id, plugin.Version); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLiteAPI)DelCliWebScript(token string, plugin string)(err error){
+	const deleteCmd = "DELETE FROM cli_web_plugins" +
+		" WHERE `token`=? AND `plugin`=?"
+
+	var ok bool
+	if token, ok = preProcessCliToken(token); !ok {
+		err = TokenNotExistsErr
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	if _, err = v.ExecContext(ctx, deleteCmd, token, plugin); err != nil {
+		return
+	}
+	return
+}
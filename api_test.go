@@ -0,0 +1,489 @@
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testDataAPI(t *testing.T, api DataAPI){
+	tokens, err := api.ListTokens()
+	if err != nil {
+		t.Fatalf("Cannot list tokens: %v", err)
+	}
+	if len(tokens) != 1 || !tokens[0].Root {
+		t.Fatalf("Expect one root token, got %v", tokens)
+	}
+	root := tokens[0].Token
+	if !api.AuthCli(root) || !api.CheckRootToken(root) {
+		t.Errorf("Root token %q cannot be authed", root)
+	}
+
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create cli token: %v", err)
+	}
+	if !api.AuthCli(tk) {
+		t.Errorf("New token %q cannot be authed", tk)
+	}
+	if api.CheckRootToken(tk) {
+		t.Errorf("New token %q should not be root", tk)
+	}
+	if info, err := api.GetUserInfo(tk); err != nil {
+		t.Errorf("Cannot get user info: %v", err)
+	}else if info.Username != "cli-" + tk[len(cliTokenPrefix):len(cliTokenPrefix) + 4] || info.IsUser {
+		t.Errorf("Unexpected username %q", info.Username)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	expired, err := api.NewCliToken(&past)
+	if err != nil {
+		t.Fatalf("Cannot create expired cli token: %v", err)
+	}
+	if api.AuthCli(expired) {
+		t.Errorf("Expired token %q should not be authed", expired)
+	}
+
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	if err = api.CreateServer("h2"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	if api.CheckPerm(tk, "h1") {
+		t.Errorf("Token should not have permission on h1 before SetPerm")
+	}
+	if err = api.SetPerm(tk, "h1", true); err != nil {
+		t.Fatalf("Cannot set perm: %v", err)
+	}
+	if !api.CheckPerm(tk, "h1") {
+		t.Errorf("Token should have permission on h1 after SetPerm")
+	}
+	if !api.CheckPerm(root, "h2") {
+		t.Errorf("Root token should have permission on every server")
+	}
+	if servers, err := api.ListServers(tk); err != nil || len(servers) != 1 || servers[0] != "h1" {
+		t.Errorf("Unexpected servers for token: %v, %v", servers, err)
+	}
+	if servers, err := api.ListServers(root); err != nil || len(servers) != 2 {
+		t.Errorf("Unexpected servers for root: %v, %v", servers, err)
+	}
+	if ok, err := api.HasServer("h1"); err != nil || !ok {
+		t.Errorf("Expect server h1 to exist, got %v, %v", ok, err)
+	}
+	if ok, err := api.HasServer("h3"); err != nil || ok {
+		t.Errorf("Expect server h3 to not exist, got %v, %v", ok, err)
+	}
+	if err = api.SetPerm(tk, "h1", false); err != nil {
+		t.Fatalf("Cannot unset perm: %v", err)
+	}
+	if api.CheckPerm(tk, "h1") {
+		t.Errorf("Token should not have permission on h1 after unset")
+	}
+
+	if scopes, err := api.GetScopes(tk); err != nil || scopes != nil {
+		t.Errorf("New token should not be limited, got %v, %v", scopes, err)
+	}
+	if err = api.SetScopes(tk, []string{ScopeHostsRead, ScopeTerminalRead}); err != nil {
+		t.Fatalf("Cannot set scopes: %v", err)
+	}
+	if !checkScope(api, tk, ScopeTerminalRead) || checkScope(api, tk, ScopeDeviceExec) {
+		t.Errorf("Unexpected scopes after SetScopes")
+	}
+	if tokens, _ := api.ListTokens(); !func()(bool){
+		for _, t := range tokens {
+			if t.Token == tk {
+				return len(t.Scopes) == 2
+			}
+		}
+		return false
+	}() {
+		t.Errorf("ListTokens does not return the scopes, got %v", tokens)
+	}
+	if err = api.SetScopes(tk, nil); err != nil {
+		t.Fatalf("Cannot clear scopes: %v", err)
+	}
+	if !checkScope(api, tk, ScopeDeviceExec) {
+		t.Errorf("Token should not be limited after clearing scopes")
+	}
+	if checkScope(api, expired, ScopeHostsRead) {
+		t.Errorf("Expired token should not pass the scope check")
+	}
+
+	if err = api.SetRoot(tk, true); err != nil {
+		t.Fatalf("Cannot set root: %v", err)
+	}
+	if !api.CheckRootToken(tk) {
+		t.Errorf("Token should be root after SetRoot")
+	}
+	if err = api.SetRoot(tk, false); err != nil {
+		t.Fatalf("Cannot unset root: %v", err)
+	}
+
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	if !api.AuthDaemon(dtk, "h1") {
+		t.Errorf("Daemon token %q cannot be authed", dtk)
+	}
+	if api.AuthDaemon(dtk, "h2") {
+		t.Errorf("Daemon token %q should not be authed on another server", dtk)
+	}
+	if dtokens, err := api.ListDaemonTokens(); err != nil || len(dtokens) != 1 || dtokens[0].Token != dtk {
+		t.Errorf("Unexpected daemon tokens: %v, %v", dtokens, err)
+	}
+
+	script := WebScriptId{Id: "plugin_a", Version: "1.0.0"}
+	if err = api.AddCliWebScript(tk, script); err != nil {
+		t.Fatalf("Cannot add web script: %v", err)
+	}
+	if scripts, err := api.ListCliWebScripts(tk); err != nil || len(scripts) != 1 || scripts[0] != script {
+		t.Errorf("Unexpected web scripts: %v, %v", scripts, err)
+	}
+	if err = api.DelCliWebScript(tk, script.Id); err != nil {
+		t.Fatalf("Cannot delete web script: %v", err)
+	}
+	if scripts, err := api.ListCliWebScripts(tk); err != nil || len(scripts) != 0 {
+		t.Errorf("Unexpected web scripts after delete: %v, %v", scripts, err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	shortTk, err := api.NewCliToken(&future)
+	if err != nil {
+		t.Fatalf("Cannot create cli token: %v", err)
+	}
+	if err = api.SetPerm(shortTk, "h2", true); err != nil {
+		t.Fatalf("Cannot set perm: %v", err)
+	}
+	if err = api.SetCliTokenExpiration(shortTk, &past); err != nil {
+		t.Fatalf("Cannot set token expiration: %v", err)
+	}
+	if api.AuthCli(shortTk) || api.CheckPerm(shortTk, "h2") {
+		t.Errorf("Token %q should be expired after SetCliTokenExpiration", shortTk)
+	}
+	if err = api.SetDaemonTokenExpiration(dtk, &past); err != nil {
+		t.Fatalf("Cannot set daemon token expiration: %v", err)
+	}
+	if api.AuthDaemon(dtk, "h1") {
+		t.Errorf("Daemon token %q should be expired after SetDaemonTokenExpiration", dtk)
+	}
+	if err = api.SetDaemonTokenExpiration(dtk, nil); err != nil {
+		t.Fatalf("Cannot clear daemon token expiration: %v", err)
+	}
+	if !api.AuthDaemon(dtk, "h1") {
+		t.Errorf("Daemon token %q should not be expired after clearing expiration", dtk)
+	}
+	if n, err := api.RemoveExpiredTokens(); err != nil || n != 2 {
+		t.Errorf("Expect to remove 2 expired tokens, got %d, %v", n, err)
+	}
+	if err = api.SetCliTokenExpiration(shortTk, nil); err != TokenNotExistsErr {
+		t.Errorf("Expired token should be removed, got %v", err)
+	}
+
+	if err = api.CreateUser("alice", "hash1"); err != nil {
+		t.Fatalf("Cannot create user: %v", err)
+	}
+	if err = api.CreateUser("alice", ""); err != UserExistsErr {
+		t.Errorf("Expect UserExistsErr, got %v", err)
+	}
+	utk, err := api.NewUserToken("alice", nil)
+	if err != nil {
+		t.Fatalf("Cannot create user token: %v", err)
+	}
+	if info, err := api.GetUserInfo(utk); err != nil || info.Username != "alice" || !info.IsUser {
+		t.Errorf("Unexpected user info %v, %v", info, err)
+	}
+	if _, err = api.NewUserToken("bob", nil); err != UserNotExistsErr {
+		t.Errorf("Expect UserNotExistsErr, got %v", err)
+	}
+	if err = api.SetUserPassword("alice", "hash2"); err != nil {
+		t.Fatalf("Cannot set user password: %v", err)
+	}
+	if hash, err := api.GetUserPassword("alice"); err != nil || hash != "hash2" {
+		t.Errorf("Unexpected user password %q, %v", hash, err)
+	}
+	if users, err := api.ListUsers(); err != nil || len(users) != 1 || users[0].Username != "alice" || !users[0].HasPassword {
+		t.Errorf("Unexpected users %v, %v", users, err)
+	}
+	if err = api.RemoveUser("alice"); err != nil {
+		t.Fatalf("Cannot remove user: %v", err)
+	}
+	if api.AuthCli(utk) {
+		t.Errorf("Token %q should be removed with its user", utk)
+	}
+
+	if role := api.GetRole(root, "any"); role != RoleAdmin {
+		t.Errorf("Root token should be admin on every host, got %v", role)
+	}
+	if err = api.SetGrant(tk, "h*", RoleViewer); err != nil {
+		t.Fatalf("Cannot set grant: %v", err)
+	}
+	if err = api.SetGrant(tk, "h1", RoleAdmin); err != nil {
+		t.Fatalf("Cannot set grant: %v", err)
+	}
+	if role := api.GetRole(tk, "h1"); role != RoleAdmin {
+		t.Errorf("Expect admin on h1, got %v", role)
+	}
+	if role := api.GetRole(tk, "h2"); role != RoleViewer {
+		t.Errorf("Expect viewer on h2, got %v", role)
+	}
+	if role := api.GetRole(tk, "x1"); role != RoleNone {
+		t.Errorf("Expect no role on x1, got %v", role)
+	}
+	if servers, err := api.ListServers(tk); err != nil || len(servers) != 2 {
+		t.Errorf("Unexpected servers for token with pattern grant: %v, %v", servers, err)
+	}
+	if grants, err := api.ListGrants(tk); err != nil || len(grants) != 2 || grants[0] != (HostGrant{"h*", RoleViewer}) {
+		t.Errorf("Unexpected grants %v, %v", grants, err)
+	}
+	if err = api.SetPerm(tk, "h1", true); err != nil {
+		t.Fatalf("Cannot set perm: %v", err)
+	}
+	if role := api.GetRole(tk, "h1"); role != RoleAdmin {
+		t.Errorf("Expect SetPerm to keep admin on h1, got %v", role)
+	}
+	if err = api.SetPerm(tk, "h*", true); err != nil {
+		t.Fatalf("Cannot set perm: %v", err)
+	}
+	if role := api.GetRole(tk, "h2"); role != RoleOperator {
+		t.Errorf("Expect SetPerm to upgrade h2 to operator, got %v", role)
+	}
+	if err = api.SetGrant(tk, "h*", RoleViewer); err != nil {
+		t.Fatalf("Cannot set grant: %v", err)
+	}
+	if err = api.SetGrant(tk, "h[", RoleViewer); !errors.Is(err, InvalidPatternErr) {
+		t.Errorf("Expect InvalidPatternErr, got %v", err)
+	}
+
+	if err = api.CreateGroup("ops"); err != nil {
+		t.Fatalf("Cannot create group: %v", err)
+	}
+	if err = api.CreateGroup("ops"); err != GroupExistsErr {
+		t.Errorf("Expect GroupExistsErr, got %v", err)
+	}
+	gtk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create cli token: %v", err)
+	}
+	if err = api.SetGroupMember("ops", gtk, true); err != nil {
+		t.Fatalf("Cannot add group member: %v", err)
+	}
+	if err = api.SetGroupGrant("ops", "h2", RoleOperator); err != nil {
+		t.Fatalf("Cannot set group grant: %v", err)
+	}
+	if role := api.GetRole(gtk, "h2"); role != RoleOperator {
+		t.Errorf("Expect operator on h2 from group, got %v", role)
+	}
+	if api.CheckPerm(gtk, "h1") {
+		t.Errorf("Group member should not have permission on h1")
+	}
+	if groups, err := api.ListGroups(); err != nil || len(groups) != 1 ||
+		len(groups[0].Members) != 1 || groups[0].Members[0] != gtk || len(groups[0].Grants) != 1 {
+		t.Errorf("Unexpected groups %v, %v", groups, err)
+	}
+	if err = api.SetGroupMember("ops", gtk, false); err != nil {
+		t.Fatalf("Cannot remove group member: %v", err)
+	}
+	if role := api.GetRole(gtk, "h2"); role != RoleNone {
+		t.Errorf("Expect no role after leaving the group, got %v", role)
+	}
+	if err = api.RemoveGroup("ops"); err != nil {
+		t.Fatalf("Cannot remove group: %v", err)
+	}
+	if err = api.RemoveGroup("ops"); err != GroupNotExistsErr {
+		t.Errorf("Expect GroupNotExistsErr, got %v", err)
+	}
+
+	first := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	last := time.Now().Truncate(time.Millisecond)
+	if err = api.SeenDevice(DeviceRecord{Host: "h1", Id: 3, Device: "turtle", LastSeen: first, LastAddr: "1.2.3.4:5"}); err != nil {
+		t.Fatalf("Cannot record device: %v", err)
+	}
+	if err = api.SeenDevice(DeviceRecord{Host: "h1", Id: 1, Device: "computer", LastSeen: first}); err != nil {
+		t.Fatalf("Cannot record device: %v", err)
+	}
+	if err = api.SetDeviceNote("h1", 3, "digging at -120 64"); err != nil {
+		t.Fatalf("Cannot set device note: %v", err)
+	}
+	if err = api.SetDeviceTags("h1", 3, []string{"miner", "north"}); err != nil {
+		t.Fatalf("Cannot set device tags: %v", err)
+	}
+	if err = api.SeenDevice(DeviceRecord{Host: "h1", Id: 3, Device: "turtle", Label: "miner", LastSeen: last, LastAddr: "1.2.3.4:6"}); err != nil {
+		t.Fatalf("Cannot record device: %v", err)
+	}
+	if devices, err := api.ListDevices("h1"); err != nil || len(devices) != 2 {
+		t.Errorf("Expect 2 devices, got %v, %v", devices, err)
+	}else if d := devices[1]; d.Id != 3 || d.Label != "miner" || d.Note != "digging at -120 64" ||
+		!equalStrings(d.Tags, []string{"miner", "north"}) ||
+		!d.FirstSeen.Equal(first) || !d.LastSeen.Equal(last) || d.LastAddr != "1.2.3.4:6" {
+		t.Errorf("Unexpected device record %+v", d)
+	}else if len(devices[0].Tags) != 0 {
+		t.Errorf("Expect no tags, got %v", devices[0].Tags)
+	}
+	if d, err := api.GetDevice("h1", 3); err != nil || d.Host != "h1" || !equalStrings(d.Tags, []string{"miner", "north"}) {
+		t.Errorf("Unexpected device record %+v, %v", d, err)
+	}
+	if _, err = api.GetDevice("h1", 4); !errors.Is(err, DeviceNotExistsErr) {
+		t.Errorf("Expect DeviceNotExistsErr, got %v", err)
+	}
+	if err = api.SetDeviceNote("h1", 4, "x"); !errors.Is(err, DeviceNotExistsErr) {
+		t.Errorf("Expect DeviceNotExistsErr, got %v", err)
+	}
+	if err = api.SetDeviceTags("h1", 4, nil); !errors.Is(err, DeviceNotExistsErr) {
+		t.Errorf("Expect DeviceNotExistsErr, got %v", err)
+	}
+	if err = api.ForgetDevice("h1", 1); err != nil {
+		t.Fatalf("Cannot forget device: %v", err)
+	}
+	if err = api.ForgetDevice("h1", 1); !errors.Is(err, DeviceNotExistsErr) {
+		t.Errorf("Expect DeviceNotExistsErr, got %v", err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond).UTC()
+	queued := make([]QueuedMessage, 3)
+	for i := range queued {
+		queued[i] = QueuedMessage{
+			Host: "h1",
+			Device: 3,
+			Data: Map{"type": "event", "n": (float64)(i)},
+			CreatedAt: now,
+			ExpiresAt: now.Add(time.Hour),
+		}
+		if i == 1 {
+			queued[i].ExpiresAt = now.Add(-time.Second)
+		}
+		if err = api.QueueMessage(&queued[i], 3); err != nil {
+			t.Fatalf("Cannot queue message: %v", err)
+		}
+	}
+	if err = api.QueueMessage(&QueuedMessage{Host: "h1", Device: 3, CreatedAt: now, ExpiresAt: now}, 3); !errors.Is(err, OutboxLimitErr) {
+		t.Errorf("Expect OutboxLimitErr, got %v", err)
+	}
+	if msgs, err := api.PendingMessages("h1", 3, now); err != nil || len(msgs) != 2 ||
+		msgs[0].Id != queued[0].Id || msgs[1].Id != queued[2].Id || msgs[1].Data["n"] != 2.0 {
+		t.Errorf("Unexpected pending messages %v, %v", msgs, err)
+	}
+	if err = api.SetMessageDelivered(queued[0].Id, now); err != nil {
+		t.Fatalf("Cannot set message delivered: %v", err)
+	}
+	if n, err := api.SweepMessages(now, now.Add(-time.Hour)); err != nil || n != 1 {
+		t.Errorf("Expect 1 message to expire, got %d, %v", n, err)
+	}
+	if msgs, err := api.ListMessages("h1", 3); err != nil || len(msgs) != 3 ||
+		msgs[0].Status != MessageDelivered || !msgs[0].DeliveredAt.Equal(now) ||
+		msgs[1].Status != MessageExpired || msgs[2].Status != MessageQueued {
+		t.Errorf("Unexpected messages %v, %v", msgs, err)
+	}
+	if _, err = api.GetMessage(queued[2].Id + 100); !errors.Is(err, MessageNotExistsErr) {
+		t.Errorf("Expect MessageNotExistsErr, got %v", err)
+	}
+	// the queued messages are kept until they expire
+	if _, err = api.SweepMessages(now, now.Add(time.Hour)); err != nil {
+		t.Fatalf("Cannot sweep messages: %v", err)
+	}
+	if msgs, err := api.ListMessages("h1", 3); err != nil || len(msgs) != 1 || msgs[0].Id != queued[2].Id {
+		t.Errorf("Expect only the queued message to be kept, got %v, %v", msgs, err)
+	}
+
+	if err = api.RemoveServer("h1"); err != nil {
+		t.Fatalf("Cannot remove server: %v", err)
+	}
+	if devices, err := api.ListDevices("h1"); err != nil || len(devices) != 0 {
+		t.Errorf("Devices should be removed with their server, got %v, %v", devices, err)
+	}
+	if _, err = api.GetMessage(queued[2].Id); !errors.Is(err, MessageNotExistsErr) {
+		t.Errorf("Messages should be removed with their server, got %v", err)
+	}
+	if api.AuthDaemon(dtk, "h1") {
+		t.Errorf("Daemon token should be removed with its server")
+	}
+	if grants, err := api.ListGrants(tk); err != nil || len(grants) != 1 || grants[0].Pattern != "h*" {
+		t.Errorf("Only the grant on h1 should be removed with the server, got %v, %v", grants, err)
+	}
+	if err = api.RemoveCliToken(tk); err != nil {
+		t.Fatalf("Cannot remove cli token: %v", err)
+	}
+	if api.AuthCli(tk) {
+		t.Errorf("Removed token %q should not be authed", tk)
+	}
+}
+
+func TestSQLiteAPI(t *testing.T){
+	api, err := NewSQLiteAPI(":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %v", err)
+	}
+	defer api.Close()
+	testDataAPI(t, api)
+}
+
+func TestMemAPI(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	testDataAPI(t, api)
+}
+
+func TestMemAPISnapshot(t *testing.T){
+	snapshot := filepath.Join(t.TempDir(), "snapshot.json")
+	api, err := NewMemAPI(snapshot)
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create cli token: %v", err)
+	}
+	if err = api.SetPerm(tk, "h1", true); err != nil {
+		t.Fatalf("Cannot set perm: %v", err)
+	}
+
+	api2, err := NewMemAPI(snapshot)
+	if err != nil {
+		t.Fatalf("Cannot reload memory api: %v", err)
+	}
+	if !api2.AuthCli(tk) {
+		t.Errorf("Token %q is lost after reload", tk)
+	}
+	if !api2.CheckPerm(tk, "h1") {
+		t.Errorf("Permission is lost after reload")
+	}
+	if tokens, _ := api2.ListTokens(); len(tokens) != 2 {
+		t.Errorf("Expect 2 tokens after reload, got %v", tokens)
+	}
+}
+
+func TestMemAPISnapshotRollback(t *testing.T){
+	dir := t.TempDir()
+	api, err := NewMemAPI(filepath.Join(dir, "snapshot.json"))
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	// the snapshot cannot be written after its directory is removed
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatalf("Cannot remove snapshot dir: %v", err)
+	}
+	if err = api.CreateServer("h2"); err == nil {
+		t.Fatalf("Expect CreateServer to fail")
+	}
+	if ok, _ := api.HasServer("h2"); ok {
+		t.Errorf("Server h2 should not be kept when the snapshot is not saved")
+	}
+	if err = api.RemoveServer("h1"); err == nil {
+		t.Fatalf("Expect RemoveServer to fail")
+	}
+	if ok, _ := api.HasServer("h1"); !ok {
+		t.Errorf("Server h1 should be kept when the snapshot is not saved")
+	}
+}
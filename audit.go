@@ -0,0 +1,117 @@
+
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit = 500
+	maxAuditSummaryLen = 512
+)
+
+// AuditEntry records one privileged action
+type AuditEntry struct {
+	Id      int64     `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	// Token is the masked token that did the action, see maskToken
+	Token   string    `json:"token"`
+	User    string    `json:"user"`
+	Addr    string    `json:"addr"`
+	Host    string    `json:"host,omitempty"`
+	Device  *int64    `json:"device,omitempty"`
+	Summary string    `json:"summary"`
+}
+
+// AuditFilter selects the entries to query, the zero value of each field matches everything
+type AuditFilter struct {
+	Action string
+	User   string
+	// Token matches the masked tokens that start with it
+	Token  string
+	Host   string
+	Device *int64
+	Since  time.Time
+	Until  time.Time
+
+	Offset int
+	Limit  int
+}
+
+func (f *AuditFilter)match(e *AuditEntry)(bool){
+	if len(f.Action) != 0 && e.Action != f.Action {
+		return false
+	}
+	if len(f.User) != 0 && e.User != f.User {
+		return false
+	}
+	if len(f.Token) != 0 && (len(e.Token) < len(f.Token) || e.Token[:len(f.Token)] != f.Token) {
+		return false
+	}
+	if len(f.Host) != 0 && e.Host != f.Host {
+		return false
+	}
+	if f.Device != nil && (e.Device == nil || *e.Device != *f.Device) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// limit returns the page size that the implementations should use
+func (f *AuditFilter)limit()(int){
+	if f.Limit <= 0 {
+		return defaultAuditLimit
+	}
+	if f.Limit > maxAuditLimit {
+		return maxAuditLimit
+	}
+	return f.Limit
+}
+
+// AuditAPI is an append-only storage of audit entries
+type AuditAPI interface {
+	// AddAudit saves the entry and sets its Id
+	AddAudit(entry *AuditEntry)(err error)
+	// QueryAudit returns the matched entries from the newest one, and the count of all matched entries
+	QueryAudit(filter AuditFilter)(entries []AuditEntry, total int64, err error)
+}
+
+// maskToken keeps only the token prefix and the first few characters,
+// which is enough to tell the tokens apart without leaking them
+func maskToken(token string)(string){
+	if tk, ok := preProcessCliToken(token); ok {
+		return cliTokenPrefix + tk[:8]
+	}
+	if tk, ok := preProcessDaemonToken(token); ok {
+		return daemonTokenPrefix + tk[:8]
+	}
+	return ""
+}
+
+// auditSummary encodes v as json, and cuts it if it's too long
+func auditSummary(v any)(string){
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	default:
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return "<" + err.Error() + ">"
+		}
+		s = (string)(buf)
+	}
+	if len(s) > maxAuditSummaryLen {
+		s = s[:maxAuditSummaryLen] + "..."
+	}
+	return s
+}
@@ -0,0 +1,108 @@
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// FileAuditAPI appends the audit entries to a file as json lines.
+// The file is never rewritten, so it can be shipped or rotated by other tools.
+type FileAuditAPI struct {
+	path string
+
+	mux    sync.Mutex
+	fd     *os.File
+	lastId int64
+}
+
+var _ AuditAPI = (*FileAuditAPI)(nil)
+
+func NewFileAuditAPI(path string)(v *FileAuditAPI, err error){
+	v = &FileAuditAPI{
+		path: path,
+	}
+	// continue the ids from the existing entries
+	if err = v.scan(func(e *AuditEntry){
+		if e.Id > v.lastId {
+			v.lastId = e.Id
+		}
+	}); err != nil {
+		return
+	}
+	if v.fd, err = os.OpenFile(path, os.O_WRONLY | os.O_APPEND | os.O_CREATE, 0600); err != nil {
+		return
+	}
+	return
+}
+
+func (v *FileAuditAPI)Close()(error){
+	return v.fd.Close()
+}
+
+// scan calls cb with each entry in the file in order, broken lines are skipped
+func (v *FileAuditAPI)scan(cb func(e *AuditEntry))(err error){
+	fd, err := os.Open(v.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer fd.Close()
+	sc := bufio.NewScanner(fd)
+	sc.Buffer(nil, 1024 * 1024)
+	for sc.Scan() {
+		var e AuditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil {
+			continue
+		}
+		cb(&e)
+	}
+	return sc.Err()
+}
+
+func (v *FileAuditAPI)AddAudit(entry *AuditEntry)(err error){
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	entry.Id = v.lastId + 1
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	buf = append(buf, '\n')
+	if _, err = v.fd.Write(buf); err != nil {
+		return
+	}
+	v.lastId = entry.Id
+	return
+}
+
+func (v *FileAuditAPI)QueryAudit(filter AuditFilter)(entries []AuditEntry, total int64, err error){
+	// hold the lock so we will not read a half written line
+	v.mux.Lock()
+	defer v.mux.Unlock()
+
+	var matched []AuditEntry
+	if err = v.scan(func(e *AuditEntry){
+		if filter.match(e) {
+			matched = append(matched, *e)
+		}
+	}); err != nil {
+		return
+	}
+	total = (int64)(len(matched))
+	// the newest entry is at the end of the file
+	end := len(matched) - filter.Offset
+	start := end - filter.limit()
+	if start < 0 {
+		start = 0
+	}
+	for i := end - 1; i >= start; i-- {
+		entries = append(entries, matched[i])
+	}
+	return
+}
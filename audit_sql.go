@@ -0,0 +1,132 @@
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// SQLAuditAPI saves the audit entries into the audit_log table.
+// The table is created by the migrations of both mysql and sqlite,
+// so it can share the database with MySQLAPI or SQLiteAPI.
+type SQLAuditAPI struct {
+	DB *sql.DB
+}
+
+var _ AuditAPI = (*SQLAuditAPI)(nil)
+
+func NewSQLAuditAPI(db *sql.DB)(v *SQLAuditAPI){
+	return &SQLAuditAPI{
+		DB: db,
+	}
+}
+
+func (v *SQLAuditAPI)AddAudit(entry *AuditEntry)(err error){
+	const insertCmd = "INSERT INTO audit_log" +
+		" (`time`, `action`, `token`, `user`, `addr`, `host`, `device`, `summary`)" +
+		" VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+	defer cancel()
+
+	var device sql.NullInt64
+	if entry.Device != nil {
+		device = sql.NullInt64{Int64: *entry.Device, Valid: true}
+	}
+	loger.Debugf("Exec sql cmd: %s\n  args: %v", insertCmd, entry)
+	res, err := v.DB.ExecContext(ctx, insertCmd, entry.Time.UnixMilli(), entry.Action, entry.Token,
+		entry.User, entry.Addr, entry.Host, device, entry.Summary)
+	if err != nil {
+		return
+	}
+	if entry.Id, err = res.LastInsertId(); err != nil {
+		return
+	}
+	return
+}
+
+func (v *SQLAuditAPI)QueryAudit(filter AuditFilter)(entries []AuditEntry, total int64, err error){
+	const countCmd = "SELECT COUNT(*) FROM audit_log"
+	const queryCmd = "SELECT `id`,`time`,`action`,`token`,`user`,`addr`,`host`,`device`,`summary`" +
+		" FROM audit_log"
+
+	var (
+		conds []string
+		args []any
+	)
+	if len(filter.Action) != 0 {
+		conds = append(conds, "`action`=?")
+		args = append(args, filter.Action)
+	}
+	if len(filter.User) != 0 {
+		conds = append(conds, "`user`=?")
+		args = append(args, filter.User)
+	}
+	if len(filter.Token) != 0 {
+		conds = append(conds, "`token` LIKE ? ESCAPE '!'")
+		args = append(args, escapeLike(filter.Token) + "%")
+	}
+	if len(filter.Host) != 0 {
+		conds = append(conds, "`host`=?")
+		args = append(args, filter.Host)
+	}
+	if filter.Device != nil {
+		conds = append(conds, "`device`=?")
+		args = append(args, *filter.Device)
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "`time`>=?")
+		args = append(args, filter.Since.UnixMilli())
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "`time`<?")
+		args = append(args, filter.Until.UnixMilli())
+	}
+	var where string
+	if len(conds) != 0 {
+		where = " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
+	defer cancel()
+
+	if err = v.DB.QueryRowContext(ctx, countCmd + where, args...).Scan(&total); err != nil {
+		return
+	}
+
+	cmd := queryCmd + where + " ORDER BY `id` DESC LIMIT ? OFFSET ?"
+	args = append(args, filter.limit(), filter.Offset)
+	loger.Debugf("Query sql cmd: %s\n  args: %v", cmd, args)
+	rows, err := v.DB.QueryContext(ctx, cmd, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			e AuditEntry
+			t int64
+			device sql.NullInt64
+		)
+		if err = rows.Scan(&e.Id, &t, &e.Action, &e.Token, &e.User, &e.Addr, &e.Host, &device, &e.Summary); err != nil {
+			return
+		}
+		e.Time = time.UnixMilli(t).UTC()
+		if device.Valid {
+			e.Device = &device.Int64
+		}
+		entries = append(entries, e)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+// escapeLike escapes the wildcards of the LIKE operator with '!',
+// since mysql and sqlite treat '\' differently
+func escapeLike(s string)(string){
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
@@ -0,0 +1,126 @@
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testAuditAPI(t *testing.T, api AuditAPI){
+	base := time.Now().UTC().Truncate(time.Millisecond)
+	dev := (int64)(3)
+	entries := []AuditEntry{
+		{Time: base, Action: "login", User: "alice", Addr: "127.0.0.1:1000"},
+		{Time: base.Add(time.Second), Action: "exec", Token: "cli_aaaaaaaa", User: "alice", Host: "h1", Device: &dev, Summary: "print(1)"},
+		{Time: base.Add(2 * time.Second), Action: "exec", Token: "cli_bbbbbbbb", Host: "h2", Summary: "print(2)"},
+		{Time: base.Add(3 * time.Second), Action: "create_token", Token: "cli_aaaaaaaa", User: "alice"},
+		{Time: base.Add(4 * time.Second), Action: "grant", Token: "cli_aaaaaaaa", User: "alice", Host: "h1"},
+	}
+	for i := range entries {
+		if err := api.AddAudit(&entries[i]); err != nil {
+			t.Fatalf("Cannot add audit entry: %v", err)
+		}
+		if i > 0 && entries[i].Id <= entries[i - 1].Id {
+			t.Errorf("Audit ids should be increasing, got %d after %d", entries[i].Id, entries[i - 1].Id)
+		}
+	}
+
+	res, total, err := api.QueryAudit(AuditFilter{})
+	if err != nil {
+		t.Fatalf("Cannot query audit log: %v", err)
+	}
+	if total != 5 || len(res) != 5 {
+		t.Fatalf("Expect 5 entries, got %d (total %d)", len(res), total)
+	}
+	if res[0].Action != "grant" || res[4].Action != "login" {
+		t.Errorf("Entries should be newest first, got %s ... %s", res[0].Action, res[4].Action)
+	}
+	if !res[4].Time.Equal(base) {
+		t.Errorf("Expect time %v, got %v", base, res[4].Time)
+	}
+	if res[3].Device == nil || *res[3].Device != dev || res[3].Summary != "print(1)" {
+		t.Errorf("Entry fields are not kept: %+v", res[3])
+	}
+
+	check := func(name string, filter AuditFilter, expect ...string){
+		res, _, err := api.QueryAudit(filter)
+		if err != nil {
+			t.Fatalf("%s: cannot query audit log: %v", name, err)
+		}
+		if len(res) != len(expect) {
+			t.Errorf("%s: expect %d entries, got %d", name, len(expect), len(res))
+			return
+		}
+		for i, e := range res {
+			if e.Action != expect[i] {
+				t.Errorf("%s: entry %d expect %s, got %s", name, i, expect[i], e.Action)
+			}
+		}
+	}
+	check("action", AuditFilter{Action: "exec"}, "exec", "exec")
+	check("user", AuditFilter{User: "alice"}, "grant", "create_token", "exec", "login")
+	check("token", AuditFilter{Token: "cli_a"}, "grant", "create_token", "exec")
+	check("host", AuditFilter{Host: "h1"}, "grant", "exec")
+	check("device", AuditFilter{Device: &dev}, "exec")
+	check("since", AuditFilter{Since: base.Add(3 * time.Second)}, "grant", "create_token")
+	check("until", AuditFilter{Until: base.Add(time.Second)}, "login")
+	check("page", AuditFilter{Offset: 1, Limit: 2}, "create_token", "exec")
+	check("last page", AuditFilter{Offset: 4, Limit: 2}, "login")
+
+	_, total, err = api.QueryAudit(AuditFilter{User: "alice", Limit: 1})
+	if err != nil {
+		t.Fatalf("Cannot query audit log: %v", err)
+	}
+	if total != 4 {
+		t.Errorf("Total should count all matched entries, expect 4, got %d", total)
+	}
+}
+
+func TestSQLAuditAPI(t *testing.T){
+	db, err := openSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %v", err)
+	}
+	defer db.Close()
+	if err = migrateUp(db, "sqlite"); err != nil {
+		t.Fatalf("Cannot migrate: %v", err)
+	}
+	testAuditAPI(t, NewSQLAuditAPI(db))
+}
+
+func TestFileAuditAPI(t *testing.T){
+	path := filepath.Join(t.TempDir(), "audit.log")
+	api, err := NewFileAuditAPI(path)
+	if err != nil {
+		t.Fatalf("Cannot open audit log: %v", err)
+	}
+	testAuditAPI(t, api)
+	api.Close()
+
+	api, err = NewFileAuditAPI(path)
+	if err != nil {
+		t.Fatalf("Cannot reopen audit log: %v", err)
+	}
+	defer api.Close()
+	entry := AuditEntry{Time: time.Now().UTC(), Action: "logout"}
+	if err = api.AddAudit(&entry); err != nil {
+		t.Fatalf("Cannot add audit entry: %v", err)
+	}
+	if entry.Id != 6 {
+		t.Errorf("Ids should continue after reopen, expect 6, got %d", entry.Id)
+	}
+	if _, total, _ := api.QueryAudit(AuditFilter{}); total != 6 {
+		t.Errorf("Expect 6 entries after reopen, got %d", total)
+	}
+}
+
+func TestMaskToken(t *testing.T){
+	tk := cliTokenPrefix + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	if m := maskToken(tk); m != cliTokenPrefix + "01234567" {
+		t.Errorf("Unexpected masked token %q", m)
+	}
+	if m := maskToken("not a token"); m != "" {
+		t.Errorf("Invalid token should be masked as empty, got %q", m)
+	}
+}
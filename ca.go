@@ -0,0 +1,429 @@
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile  = "ca.crt"
+	caKeyFile   = "ca.key"
+	caIndexFile = "index.json"
+
+	caValidFor = 10 * 365 * 24 * time.Hour
+	defaultDaemonCertValidFor = 365 * 24 * time.Hour
+)
+
+var (
+	CANotInitedErr = errors.New("Certificate authority is not initialized")
+	CAExistsErr = errors.New("Certificate authority already exists")
+	CertNotExistsErr = errors.New("Certificate not exists")
+	CertRevokedErr = errors.New("Certificate is revoked")
+)
+
+// IssuedCert records a daemon certificate issued by the CertAuthority
+type IssuedCert struct {
+	// Serial is the hex encoded serial number of the certificate
+	Serial    string     `json:"serial"`
+	Host      string     `json:"host"`
+	NotBefore time.Time  `json:"notBefore"`
+	NotAfter  time.Time  `json:"notAfter"`
+	Revoked   *time.Time `json:"revoked,omitempty"`
+}
+
+// CertAuthority is a small CA that issues the client certificates of the daemons.
+// All of its state lives in a directory, the issued and revoked certificates are
+// recorded in index.json, which is reloaded when it changes,
+// so a certificate revoked by the `ca` subcommand is rejected without restarting the server.
+type CertAuthority struct {
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mux          sync.RWMutex
+	index        []*IssuedCert
+	indexModTime time.Time
+	indexSize    int64
+}
+
+func newSerialNumber()(*big.Int, error){
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func formatSerial(serial *big.Int)(string){
+	return fmt.Sprintf("%x", serial)
+}
+
+func writePEMFile(path string, typ string, der []byte, perm os.FileMode)(err error){
+	fd, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_EXCL, perm)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	return pem.Encode(fd, &pem.Block{Type: typ, Bytes: der})
+}
+
+func readPEMFile(path string, typ string)(der []byte, err error){
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%s is not a PEM encoded %s", path, typ)
+	}
+	return block.Bytes, nil
+}
+
+// InitCertAuthority creates a new CA in dir, it fails with CAExistsErr if there is already one
+func InitCertAuthority(dir string, name string)(ca *CertAuthority, err error){
+	if _, err = os.Stat(filepath.Join(dir, caCertFile)); err == nil {
+		return nil, CAExistsErr
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: name},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.Add(caValidFor),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA: true,
+		MaxPathLenZero: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	if err = writePEMFile(filepath.Join(dir, caKeyFile), "PRIVATE KEY", keyDer, 0600); err != nil {
+		return
+	}
+	if err = writePEMFile(filepath.Join(dir, caCertFile), "CERTIFICATE", der, 0644); err != nil {
+		return
+	}
+	return LoadCertAuthority(dir)
+}
+
+// LoadCertAuthority loads the CA that InitCertAuthority created in dir
+func LoadCertAuthority(dir string)(ca *CertAuthority, err error){
+	der, err := readPEMFile(filepath.Join(dir, caCertFile), "CERTIFICATE")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			err = CANotInitedErr
+		}
+		return
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return
+	}
+	if der, err = readPEMFile(filepath.Join(dir, caKeyFile), "PRIVATE KEY"); err != nil {
+		return
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return
+	}
+	key, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported CA key type %T", k)
+	}
+	ca = &CertAuthority{
+		dir: dir,
+		cert: cert,
+		key: key,
+	}
+	if err = ca.reloadIndex(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (ca *CertAuthority)Certificate()(*x509.Certificate){
+	return ca.cert
+}
+
+// Pool returns a cert pool that only contains the CA certificate
+func (ca *CertAuthority)Pool()(pool *x509.CertPool){
+	pool = x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return
+}
+
+func (ca *CertAuthority)indexPath()(string){
+	return filepath.Join(ca.dir, caIndexFile)
+}
+
+// reloadIndex reads index.json again if it was modified since the last load
+func (ca *CertAuthority)reloadIndex()(err error){
+	stat, err := os.Stat(ca.indexPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return
+	}
+	ca.mux.RLock()
+	same := stat.ModTime().Equal(ca.indexModTime) && stat.Size() == ca.indexSize
+	ca.mux.RUnlock()
+	if same {
+		return
+	}
+	data, err := os.ReadFile(ca.indexPath())
+	if err != nil {
+		return
+	}
+	var index []*IssuedCert
+	if err = json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("Cannot parse %s: %w", ca.indexPath(), err)
+	}
+	ca.mux.Lock()
+	ca.index = index
+	ca.indexModTime = stat.ModTime()
+	ca.indexSize = stat.Size()
+	ca.mux.Unlock()
+	return
+}
+
+// saveIndex must be called with the write lock held
+func (ca *CertAuthority)saveIndex()(err error){
+	data, err := json.MarshalIndent(ca.index, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp := ca.indexPath() + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, ca.indexPath()); err != nil {
+		return
+	}
+	if stat, err := os.Stat(ca.indexPath()); err == nil {
+		ca.indexModTime = stat.ModTime()
+		ca.indexSize = stat.Size()
+	}
+	return
+}
+
+func (ca *CertAuthority)sign(tmpl *x509.Certificate)(certPEM []byte, keyPEM []byte, err error){
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return
+}
+
+// IssueDaemonCert issues a client certificate for the host,
+// the host id is saved as both the common name and a DNS SAN.
+func (ca *CertAuthority)IssueDaemonCert(host string, validFor time.Duration)(certPEM []byte, keyPEM []byte, info IssuedCert, err error){
+	if err = ca.reloadIndex(); err != nil {
+		return
+	}
+	if validFor <= 0 {
+		validFor = defaultDaemonCertValidFor
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: host},
+		DNSNames: []string{host},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.Add(validFor),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if certPEM, keyPEM, err = ca.sign(tmpl); err != nil {
+		return
+	}
+	info = IssuedCert{
+		Serial: formatSerial(serial),
+		Host: host,
+		NotBefore: tmpl.NotBefore,
+		NotAfter: tmpl.NotAfter,
+	}
+
+	ca.mux.Lock()
+	defer ca.mux.Unlock()
+	ca.index = append(ca.index, &info)
+	if err = ca.saveIndex(); err != nil {
+		ca.index = ca.index[:len(ca.index) - 1]
+		return
+	}
+	return
+}
+
+// IssueServerCert issues a certificate for the TLS listener itself, it is not recorded in the index
+func (ca *CertAuthority)IssueServerCert(names []string, validFor time.Duration)(cert tls.Certificate, err error){
+	serial, err := newSerialNumber()
+	if err != nil {
+		return
+	}
+	if len(names) == 0 {
+		names = []string{"localhost"}
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{CommonName: names[0]},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.Add(validFor),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, n := range names {
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		}else{
+			tmpl.DNSNames = append(tmpl.DNSNames, n)
+		}
+	}
+	certPEM, keyPEM, err := ca.sign(tmpl)
+	if err != nil {
+		return
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Revoke marks the certificate with the serial as revoked
+func (ca *CertAuthority)Revoke(serial string)(err error){
+	if err = ca.reloadIndex(); err != nil {
+		return
+	}
+	ca.mux.Lock()
+	defer ca.mux.Unlock()
+	for _, c := range ca.index {
+		if c.Serial == serial {
+			if c.Revoked == nil {
+				now := time.Now().UTC().Truncate(time.Second)
+				c.Revoked = &now
+				if err = ca.saveIndex(); err != nil {
+					c.Revoked = nil
+					return
+				}
+			}
+			return nil
+		}
+	}
+	return CertNotExistsErr
+}
+
+// List returns all issued certificates, sorted by the host id
+func (ca *CertAuthority)List()(certs []IssuedCert, err error){
+	if err = ca.reloadIndex(); err != nil {
+		return
+	}
+	ca.mux.RLock()
+	defer ca.mux.RUnlock()
+	certs = make([]IssuedCert, len(ca.index))
+	for i, c := range ca.index {
+		certs[i] = *c
+	}
+	sort.SliceStable(certs, func(i, j int)(bool){ return certs[i].Host < certs[j].Host })
+	return
+}
+
+// IsRevoked reports whether the certificate is revoked.
+// Certificates that are not in the index are also treated as revoked
+func (ca *CertAuthority)IsRevoked(serial *big.Int)(bool){
+	if err := ca.reloadIndex(); err != nil {
+		loger.Errorf("Cannot reload certificate index: %v", err)
+	}
+	s := formatSerial(serial)
+	ca.mux.RLock()
+	defer ca.mux.RUnlock()
+	for _, c := range ca.index {
+		if c.Serial == s {
+			return c.Revoked != nil
+		}
+	}
+	return true
+}
+
+// DaemonTLSConfig returns a tls config that requires a valid and unrevoked daemon certificate,
+// getCert provides the certificate of the server
+func (ca *CertAuthority)DaemonTLSConfig(getCert func(*tls.ClientHelloInfo)(*tls.Certificate, error))(cfg *tls.Config){
+	return &tls.Config{
+		GetCertificate: getCert,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: ca.Pool(),
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState)(error){
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("No client certificate")
+			}
+			if leaf := cs.PeerCertificates[0]; ca.IsRevoked(leaf.SerialNumber) {
+				return fmt.Errorf("%w: %s", CertRevokedErr, formatSerial(leaf.SerialNumber))
+			}
+			return nil
+		},
+	}
+}
+
+// certHostId returns the host id that a verified daemon certificate is issued for.
+// If want is not empty, it must be the common name or one of the DNS SANs of the certificate
+func certHostId(cert *x509.Certificate, want string)(host string, ok bool){
+	if len(want) == 0 {
+		if len(cert.Subject.CommonName) != 0 {
+			return cert.Subject.CommonName, true
+		}
+		if len(cert.DNSNames) == 1 {
+			return cert.DNSNames[0], true
+		}
+		return "", false
+	}
+	if cert.Subject.CommonName == want {
+		return want, true
+	}
+	for _, n := range cert.DNSNames {
+		if n == want {
+			return want, true
+		}
+	}
+	return "", false
+}
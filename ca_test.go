@@ -0,0 +1,113 @@
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCertAuthority(t *testing.T){
+	dir := t.TempDir()
+	ca, err := InitCertAuthority(dir, "test CA")
+	if err != nil {
+		t.Fatalf("Cannot init CA: %v", err)
+	}
+	if _, err = InitCertAuthority(dir, "test CA"); !errors.Is(err, CAExistsErr) {
+		t.Errorf("Init CA twice should fail with CAExistsErr, got %v", err)
+	}
+	if _, err = LoadCertAuthority(t.TempDir()); !errors.Is(err, CANotInitedErr) {
+		t.Errorf("Load CA from an empty dir should fail with CANotInitedErr, got %v", err)
+	}
+
+	serverCert, err := ca.IssueServerCert([]string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Cannot issue server cert: %v", err)
+	}
+	certPEM, keyPEM, info, err := ca.IssueDaemonCert("h1", 0)
+	if err != nil {
+		t.Fatalf("Cannot issue daemon cert: %v", err)
+	}
+	if info.Host != "h1" {
+		t.Errorf("Expect host h1, got %q", info.Host)
+	}
+	daemonCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("Cannot load issued daemon cert: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer((http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){
+		host, ok := certHostId(req.TLS.VerifiedChains[0][0], req.Header.Get("X-CC-Host"))
+		if !ok {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(rw, host)
+	}))
+	srv.TLS = ca.DaemonTLSConfig(staticCertificate(serverCert))
+	// httptest uses its own certificate if Certificates is empty
+	srv.TLS.Certificates = []tls.Certificate{serverCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: ca.Pool(),
+				Certificates: []tls.Certificate{daemonCert},
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(host string)(string, error){
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if len(host) != 0 {
+			req.Header.Set("X-CC-Host", host)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return "", errors.New(res.Status)
+		}
+		body, err := io.ReadAll(res.Body)
+		return (string)(body), err
+	}
+	if host, err := get(""); err != nil || host != "h1" {
+		t.Errorf("Expect host h1, got %q, %v", host, err)
+	}
+	if host, err := get("h1"); err != nil || host != "h1" {
+		t.Errorf("Expect host h1, got %q, %v", host, err)
+	}
+	if _, err := get("h2"); err == nil {
+		t.Errorf("The certificate of h1 should not be accepted for h2")
+	}
+
+	// revoke with another instance, as the `ca revoke` subcommand does
+	ca2, err := LoadCertAuthority(dir)
+	if err != nil {
+		t.Fatalf("Cannot load CA: %v", err)
+	}
+	if err = ca2.Revoke(info.Serial); err != nil {
+		t.Fatalf("Cannot revoke cert: %v", err)
+	}
+	if err = ca2.Revoke("00"); !errors.Is(err, CertNotExistsErr) {
+		t.Errorf("Revoke unknown cert should fail with CertNotExistsErr, got %v", err)
+	}
+	certs, err := ca.List()
+	if err != nil {
+		t.Fatalf("Cannot list certs: %v", err)
+	}
+	if len(certs) != 1 || certs[0].Revoked == nil {
+		t.Fatalf("Expect one revoked cert, got %+v", certs)
+	}
+	if _, err := get("h1"); err == nil {
+		t.Errorf("Revoked certificate should be rejected")
+	}
+}
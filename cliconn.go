@@ -6,8 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket"
@@ -21,14 +21,31 @@ type HandlerI interface {
 	Context()(context.Context)
 	GetHost(id string)(*HostServer)
 	GetHosts()([]*HostServer)
+	GetBroker(id string)(*Broker)
+	SendToDevice(hostid string, device int64, data Map)(msg *QueuedMessage, err error)
 	BroadcastToClients(event string, data any, except *CliConn)
+	Audit(token string, entry AuditEntry)
+}
+
+// connPerms is the permission set of a CliConn, it is resolved when the connection is accepted
+// and replaced when the permissions of the token change, so the checks don't need to ask the DataAPI
+type connPerms struct {
+	valid  bool
+	root   bool
+	scopes []string
+
+	// roles are resolved when they are first checked
+	mux   sync.Mutex
+	roles map[string]Role
 }
 
 // This connection is only used when outside of CC
 type CliConn struct {
 	token  string
+	perms  atomic.Pointer[connPerms]
 	req    *http.Request
 	ws     *websocket.Conn
+	wq     *writeQueue
 	addr   string
 
 	handler HandlerI
@@ -39,20 +56,59 @@ type CliConn struct {
 	askMux sync.Mutex
 	askInc int
 	asking map[int]chan<- any
+
+	// running are the requests from the client that can be canceled by a cancel packet
+	runMux  sync.Mutex
+	running map[int]*runningRequest
+
+	// evSubs are the events that the client subscribed to, nil if it never subscribed and receives every event
+	evMux  sync.RWMutex
+	evSubs map[eventSubKey]map[string]struct{}
+
+	// subHosts are the hosts that the client subscribed to channels of
+	subMux   sync.Mutex
+	subHosts map[string]struct{}
+}
+
+type runningRequest struct {
+	cancel context.CancelFunc
 }
 
-func AcceptCliConn(handler HandlerI, token string, rw http.ResponseWriter, req *http.Request)(c *CliConn, err error){
+const (
+	defaultExecTimeout = 5 * time.Minute
+	// defaultExecConcurrency is how many devices a fan-out exec runs on at once
+	defaultExecConcurrency = 8
+	maxExecConcurrency = 64
+)
+
+func AcceptCliConn(handler HandlerI, token string, queue WriteQueueConfig, rw http.ResponseWriter, req *http.Request)(c *CliConn, err error){
 	c = &CliConn{
 		handler: handler,
 		token: token,
 		addr: req.RemoteAddr,
 		asking: make(map[int]chan<- any),
+		running: make(map[int]*runningRequest),
+		subHosts: make(map[string]struct{}),
 	}
+	c.refreshPerms()
 	c.ws, err = websocket.Accept(rw, req, nil)
 	if err != nil {
 		return
 	}
 	c.ctx, c.cancel = context.WithCancel(handler.Context())
+	c.wq = newWriteQueue(c.ws, queue)
+	c.wq.coalesceKey = termUpdateKey
+	c.wq.resync = termResyncPacket
+	c.wq.onClose = func(err error){
+		if c.ctx.Err() != nil {
+			return
+		}
+		loger.Warnf("[%s]: Cannot write to client: %v", c.addr, err)
+		c.cancel()
+		// closing a stuck connection waits for the close handshake to time out
+		go c.ws.Close(websocket.StatusPolicyViolation, err.Error())
+	}
+	c.wq.start(c.ctx)
 	go func(){
 		for {
 			select {
@@ -77,8 +133,21 @@ func (c *CliConn)recv()(data Map, err error){
 	return
 }
 
+// send queues the packet to the client, the slow clients don't block the sender
 func (c *CliConn)send(data Map)(err error){
-	return wsjson.Write(c.ctx, c.ws, data)
+	return c.wq.push(data)
+}
+
+// flush queues the packet and waits until it's written
+func (c *CliConn)flush(data Map)(err error){
+	ctx, cancel := context.WithTimeout(c.ctx, flushTimeout)
+	defer cancel()
+	return c.wq.pushWait(ctx, data)
+}
+
+// QueueStats returns the metric of the write queue
+func (c *CliConn)QueueStats()(WriteQueueStats){
+	return c.wq.Stats()
 }
 
 func (c *CliConn)Reply(id int, data any)(err error){
@@ -95,13 +164,163 @@ func (c *CliConn)Close()(err error){
 	return
 }
 
-func (c *CliConn)checkAndGetHost(rid int, hostid string)(host *HostServer){
-	if !c.handler.CheckPerm(c.token, hostid) {
+func (c *CliConn)audit(action string, host string, device *int64, summary any){
+	c.handler.Audit(c.token, AuditEntry{
+		Action: action,
+		Addr: c.addr,
+		Host: host,
+		Device: device,
+		Summary: auditSummary(summary),
+	})
+}
+
+// refreshPerms resolves the permission set of the token again.
+// If the token is no longer valid the session is closed,
+// and if it lost some permissions the client is told what it lost.
+// The permission set is kept if the token cannot be looked up.
+func (c *CliConn)refreshPerms(){
+	p := &connPerms{
+		roles: make(map[string]Role),
+	}
+	// GetScopes tells a removed or expired token apart from a failed lookup, which AuthCli doesn't
+	scopes, err := c.handler.GetScopes(c.token)
+	if err == nil {
+		p.valid = true
+		p.root = c.handler.CheckRootToken(c.token)
+		p.scopes = scopes
+	}else if !errors.Is(err, TokenNotExistsErr) {
+		loger.Errorf("[%s]: Cannot refresh permissions: %v", c.addr, err)
+		if c.perms.Load() != nil {
+			return
+		}
+	}
+	old := c.perms.Swap(p)
+	if old == nil || c.ws == nil { // not accepted yet
+		return
+	}
+	if !p.valid {
+		go c.revoke("Token was removed or expired")
+		return
+	}
+
+	var lostScopes []string
+	if old.valid {
+		for _, s := range allScopes {
+			if hasScope(old.scopes, s) && !hasScope(p.scopes, s) {
+				lostScopes = append(lostScopes, s)
+			}
+		}
+	}
+	old.mux.Lock()
+	oldRoles := make(map[string]Role, len(old.roles))
+	for host, role := range old.roles {
+		oldRoles[host] = role
+	}
+	old.mux.Unlock()
+	lostHosts := make(Map)
+	for host, role := range oldRoles {
+		if now := c.role(host); now < role {
+			lostHosts[host] = now
+		}
+	}
+	lostRoot := old.root && !p.root
+	if !lostRoot && len(lostScopes) == 0 && len(lostHosts) == 0 {
+		return
+	}
+	reason := "Permissions were reduced"
+	if lostRoot {
+		reason = "Root permission was revoked"
+	}
+	loger.Infof("[%s]: Session downgraded: %s", c.addr, reason)
+	// refreshPerms is called by the writes of the permissions, don't block them
+	go c.send(Map{
+		"type": "session_revoked",
+		"data": Map{
+			"reason": reason,
+			"closed": false,
+			"root": lostRoot,
+			"scopes": lostScopes,
+			"hosts": lostHosts,
+		},
+	})
+}
+
+// revoke tells the client why its session is revoked and closes the connection
+func (c *CliConn)revoke(reason string){
+	loger.Infof("[%s]: Session revoked: %s", c.addr, reason)
+	c.flush(Map{
+		"type": "session_revoked",
+		"data": Map{
+			"reason": reason,
+			"closed": true,
+		},
+	})
+	c.ws.Close(websocket.StatusPolicyViolation, reason)
+	c.cancel()
+}
+
+// role returns the role of the token on the host
+func (c *CliConn)role(host string)(role Role){
+	p := c.perms.Load()
+	if !p.valid {
+		return RoleNone
+	}
+	if p.root {
+		return RoleAdmin
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	role, ok := p.roles[host]
+	if !ok {
+		role = c.handler.GetRole(c.token, host)
+		p.roles[host] = role
+	}
+	return
+}
+
+// hasScope reports whether the token is valid and has the scope
+func (c *CliConn)hasScope(scope string)(bool){
+	p := c.perms.Load()
+	return p.valid && hasScope(p.scopes, scope)
+}
+
+// requireScope replies an error and returns false if the token does not have the scope
+func (c *CliConn)requireScope(rid int, scope string)(bool){
+	if c.hasScope(scope) {
+		return true
+	}
+	c.Reply(rid, Map{
+		"status": "error",
+		"error": fmt.Sprintf("Permission denied, %s scope is required", scope),
+	})
+	return false
+}
+
+// checkRole replies an error and returns false if the token does not have the role on the host
+func (c *CliConn)checkRole(rid int, hostid string, need Role)(bool){
+	role := c.role(hostid)
+	if role == RoleNone {
 		c.Reply(rid, Map{
 			"status": "error",
 			"error": "Host not found or permission denied",
 			"hostid": hostid,
 		})
+		return false
+	}
+	if role < need {
+		c.Reply(rid, Map{
+			"status": "error",
+			"error": fmt.Sprintf("Permission denied, %s role is required", need),
+			"hostid": hostid,
+		})
+		return false
+	}
+	return true
+}
+
+// checkAndGetHost replies an error and returns nil if the token does not have the role on the host
+func (c *CliConn)checkAndGetHost(rid int, hostid string, need Role)(host *HostServer){
+	if !c.checkRole(rid, hostid, need) {
 		return
 	}
 	if host = c.handler.GetHost(hostid); host == nil {
@@ -117,6 +336,7 @@ func (c *CliConn)checkAndGetHost(rid int, hostid string)(host *HostServer){
 
 func (c *CliConn)Handle(){
 	defer c.ws.Close(websocket.StatusInternalError, "500 internal error")
+	defer c.unsubscribeAll()
 	for {
 		data, err := c.recv()
 		if err != nil {
@@ -135,6 +355,9 @@ func (c *CliConn)Handle(){
 		case "reply":
 			rid, _ := data.GetInt("id")
 			c.onReply(rid, data["data"])
+		case "cancel":
+			rid, _ := data.GetInt("id")
+			c.cancelRequest(rid)
 		case "user_info":
 			id, _ := data.GetInt("id")
 			var data UserInfo
@@ -151,16 +374,44 @@ func (c *CliConn)Handle(){
 				"data": data,
 			})
 		case "broadcast_cli":
+			if !c.hasScope(ScopeBroadcast) {
+				break
+			}
 			event, _ := data.GetString("event")
 			data := data.Get("data")
+			c.audit("broadcast_cli", "", nil, Map{"event": event})
 			c.handler.BroadcastToClients(event, data, c)
 		case "broadcast":
 			hid, _ := data.GetString("host")
-			if !c.handler.CheckPerm(c.token, hid) {
+			tdata, _ := data.GetMap("data")
+			if selector, ok := data.GetMap("selector"); ok {
+				// the selected broadcast replies the result of every device
+				id, _ := data.GetInt("id")
+				if !c.requireScope(id, ScopeBroadcast) {
+					break
+				}
+				host := c.checkAndGetHost(id, hid, RoleOperator)
+				if host == nil {
+					break
+				}
+				conns, ok := c.selectConns(id, host, selector)
+				if !ok {
+					break
+				}
+				c.audit("broadcast", hid, nil, Map{"data": tdata, "devices": connIds(conns)})
+				go c.Reply(id, Map{
+					"status": "ok",
+					"res": eachDevice(conns, 0, func(conn *Conn)(any, error){
+						return nil, conn.send(tdata)
+					}, nil),
+				})
+				break
+			}
+			if c.role(hid) < RoleOperator || !c.hasScope(ScopeBroadcast) {
 				break
 			}
-			tdata, _ := data.GetMap("data")
 			if host := c.handler.GetHost(hid); host != nil {
+				c.audit("broadcast", hid, nil, tdata)
 				host.Broadcast(tdata)
 			}
 		case "fire_event":
@@ -169,27 +420,48 @@ func (c *CliConn)Handle(){
 			tid, _ := data.GetInt("term")
 			event, _ := data.GetString("event")
 			args, _ := data.GetList("args")
-			if !c.handler.CheckPerm(c.token, hid) {
+			// the reply is optional, it tells whether the event is queued for the offline device
+			id, hasId := data.GetInt("id")
+			if c.role(hid) < RoleOperator || !c.hasScope(ScopeDeviceExec) {
+				if hasId {
+					c.Reply(id, Map{
+						"status": "error",
+						"error": "Permission denied",
+					})
+				}
 				break
 			}
-			if host := c.handler.GetHost(hid); host != nil {
-				if conn := host.GetConn(cid); conn != nil {
-					conn.FireEventOnTerm(tid, event, args)
+			c.audit("fire_event", hid, &cid, Map{"term": tid, "event": event, "args": args})
+			msg, err := c.handler.SendToDevice(hid, cid, termEventPacket(tid, event, args))
+			if !hasId {
+				if err != nil {
+					loger.Debugf("[%s]: Cannot fire event on device %d of %s: %v", c.addr, cid, hid, err)
 				}
+				break
+			}
+			if err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
 			}
+			c.Reply(id, Map{
+				"status": "ok",
+				"res": Map{
+					"queued": msg != nil,
+					"message": msg,
+				},
+			})
 		case "list_hosts":
 			id, _ := data.GetInt("id")
-			nhosts := c.handler.GetHosts()
-			type connMeta struct {
-				Id     int64  `json:"id"`
-				Addr   string `json:"addr"`
-				Device string `json:"device"`
-				Label  string `json:"label"`
-			}
-			var nilConnMeta = make([]connMeta, 0)
+			if !c.requireScope(id, ScopeHostsRead) {
+				break
+			}
 			type hostMeta struct {
-				Id string        `json:"id"`
-				Conns []connMeta `json:"conns"`
+				Id string          `json:"id"`
+				Role Role          `json:"role"`
+				Conns []deviceMeta `json:"conns"`
 			}
 			permhosts, err := c.handler.ListServers(c.token)
 			if err != nil {
@@ -199,31 +471,12 @@ func (c *CliConn)Handle(){
 				})
 				break
 			}
-			sort.Slice(nhosts, func(i, j int)(bool){ return nhosts[i].Id() < nhosts[j].Id() })
 			hosts := make([]hostMeta, len(permhosts))
 			for i, hid := range permhosts {
-				j := sort.Search(len(nhosts), func(i int)(bool){ return nhosts[i].Id() >= hid })
-				if j < len(nhosts) && nhosts[j].Id() == hid {
-					h := nhosts[j]
-					nconns := h.GetConns()
-					conns := make([]connMeta, len(nconns))
-					for i, c := range nconns {
-						conns[i] = connMeta{
-							Id: c.Id(),
-							Addr: c.Addr(),
-							Device: c.Device(),
-							Label: c.Label(),
-						}
-					}
-					hosts[i] = hostMeta{
-						Id: hid,
-						Conns: conns,
-					}
-				}else{
-					hosts[i] = hostMeta{
-						Id: hid,
-						Conns: nilConnMeta,
-					}
+				hosts[i] = hostMeta{
+					Id: hid,
+					Role: c.role(hid),
+					Conns: listHostDevices(c.handler, hid),
 				}
 			}
 			c.Reply(id, Map{
@@ -233,41 +486,213 @@ func (c *CliConn)Handle(){
 		case "get_host":
 			id, _ := data.GetInt("id")
 			hostid, _ := data.GetString("data")
-			host := c.checkAndGetHost(id, hostid)
-			if host == nil {
+			if !c.requireScope(id, ScopeHostsRead) {
 				break
 			}
-			type connMeta struct {
-				Id     int64  `json:"id"`
-				Addr   string `json:"addr"`
-				Device string `json:"device"`
-				Label  string `json:"label"`
+			// the host may have only offline devices
+			if !c.checkRole(id, hostid, RoleViewer) {
+				break
 			}
 			var res struct {
 				Id string `json:"id"`
-				Conns []connMeta `json:"conns"`
-			}
-			res.Id = host.Id()
-			conns := host.GetConns()
-			res.Conns = make([]connMeta, len(conns))
-			for i, c := range conns {
-				res.Conns[i] = connMeta{
-					Id: c.Id(),
-					Addr: c.Addr(),
-					Device: c.Device(),
-					Label: c.Label(),
+				Role Role `json:"role"`
+				Conns []deviceMeta `json:"conns"`
+			}
+			res.Id = hostid
+			res.Role = c.role(hostid)
+			res.Conns = listHostDevices(c.handler, hostid)
+			c.Reply(id, Map{
+				"status": "ok",
+				"res": res,
+			})
+		case "subscribe", "unsubscribe":
+			id, _ := data.GetInt("id")
+			dt, _ := data.GetMap("data")
+			key, kinds := parseEventSub(dt)
+			if !c.requireScope(id, ScopeHostsRead) {
+				break
+			}
+			if typ == "subscribe" {
+				if key.host != "*" && !c.checkRole(id, key.host, RoleViewer) {
+					break
+				}
+				c.subscribeEvents(key, kinds)
+			}else{
+				c.unsubscribeEvents(key, kinds)
+			}
+			c.Reply(id, Map{
+				"status": "ok",
+				"res": c.listEventSubs(),
+			})
+		case "channel_subscribe", "channel_unsubscribe":
+			id, _ := data.GetInt("id")
+			dt, _ := data.GetMap("data")
+			hostid, _ := dt.GetString("host")
+			topic, _ := dt.GetString("topic")
+			if !c.requireScope(id, ScopeHostsRead) || !c.checkRole(id, hostid, RoleViewer) {
+				break
+			}
+			if typ == "channel_unsubscribe" {
+				c.handler.GetBroker(hostid).Unsubscribe(c, topic)
+				c.Reply(id, Map{
+					"status": "ok",
+				})
+				break
+			}
+			if err := checkTopic(topic, true); err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
+			}
+			c.subMux.Lock()
+			c.subHosts[hostid] = struct{}{}
+			c.subMux.Unlock()
+			// reply first, so the retained values come after it
+			c.Reply(id, Map{
+				"status": "ok",
+			})
+			c.handler.GetBroker(hostid).Subscribe(c, topic, c.onChannelMessage)
+		case "publish":
+			id, _ := data.GetInt("id")
+			dt, _ := data.GetMap("data")
+			hostid, _ := dt.GetString("host")
+			topic, _ := dt.GetString("topic")
+			retain, _ := dt.GetBool("retain")
+			if !c.requireScope(id, ScopeBroadcast) || !c.checkRole(id, hostid, RoleOperator) {
+				break
+			}
+			n, err := c.handler.GetBroker(hostid).Publish(topic, dt["payload"], nil, retain)
+			if err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
+			}
+			c.audit("publish", hostid, nil, Map{"topic": topic, "retain": retain})
+			c.Reply(id, Map{
+				"status": "ok",
+				"res": n,
+			})
+		case "get_message":
+			id, _ := data.GetInt("id")
+			mid, _ := data.GetInt64("data")
+			if !c.requireScope(id, ScopeHostsRead) {
+				break
+			}
+			msg, err := c.handler.GetMessage(mid)
+			if err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
+			}
+			if !c.checkRole(id, msg.Host, RoleViewer) {
+				break
+			}
+			c.Reply(id, Map{
+				"status": "ok",
+				"res": msg,
+			})
+		case "list_messages":
+			id, _ := data.GetInt("id")
+			dt, _ := data.GetMap("data")
+			hostid, _ := dt.GetString("host")
+			connid, _ := dt.GetInt64("conn")
+			if !c.requireScope(id, ScopeHostsRead) || !c.checkRole(id, hostid, RoleViewer) {
+				break
+			}
+			msgs, err := c.handler.ListMessages(hostid, connid)
+			if err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
+			}
+			if msgs == nil {
+				msgs = []QueuedMessage{}
+			}
+			c.Reply(id, Map{
+				"status": "ok",
+				"res": msgs,
+			})
+		case "set_device_tags":
+			id, _ := data.GetInt("id")
+			dt, _ := data.GetMap("data")
+			hostid, _ := dt.GetString("host")
+			connid, _ := dt.GetInt64("conn")
+			tags, _ := dt.GetList("tags")
+			if !c.requireScope(id, ScopeAdmin) || !c.checkRole(id, hostid, RoleAdmin) {
+				break
+			}
+			tg, err := parseTagList(tags)
+			if err == nil {
+				err = c.handler.SetDeviceTags(hostid, connid, tg)
+			}
+			if err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
+			}
+			c.audit(typ, hostid, &connid, Map{"tags": tg})
+			// the offline devices get the tags when they connect
+			res := tg
+			if host := c.handler.GetHost(hostid); host != nil {
+				if conn := host.GetConn(connid); conn != nil {
+					conn.SetAdminTags(tg)
+					res = conn.Tags()
 				}
 			}
 			c.Reply(id, Map{
 				"status": "ok",
 				"res": res,
 			})
+		case "set_device_note", "forget_device":
+			id, _ := data.GetInt("id")
+			dt, _ := data.GetMap("data")
+			hostid, _ := dt.GetString("host")
+			connid, _ := dt.GetInt64("conn")
+			if !c.requireScope(id, ScopeAdmin) || !c.checkRole(id, hostid, RoleAdmin) {
+				break
+			}
+			var err error
+			if typ == "set_device_note" {
+				note, _ := dt.GetString("note")
+				err = c.handler.SetDeviceNote(hostid, connid, note)
+				if err == nil {
+					c.audit(typ, hostid, &connid, Map{"note": note})
+				}
+			}else{
+				err = c.handler.ForgetDevice(hostid, connid)
+				if err == nil {
+					c.audit(typ, hostid, &connid, nil)
+				}
+			}
+			if err != nil {
+				c.Reply(id, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				break
+			}
+			c.Reply(id, Map{
+				"status": "ok",
+			})
 		case "list_terms":
 			id, _ := data.GetInt("id")
 			dt, _ := data.GetMap("data")
 			hostid, _ := dt.GetString("host")
 			connid, _ := dt.GetInt64("conn")
-			host := c.checkAndGetHost(id, hostid)
+			if !c.requireScope(id, ScopeTerminalRead) {
+				break
+			}
+			host := c.checkAndGetHost(id, hostid, RoleViewer)
 			if host == nil {
 				break
 			}
@@ -290,7 +715,10 @@ func (c *CliConn)Handle(){
 			hostid, _ := dt.GetString("host")
 			connid, _ := dt.GetInt64("conn")
 			termid, _ := dt.GetInt("term")
-			host := c.checkAndGetHost(id, hostid)
+			if !c.requireScope(id, ScopeTerminalRead) {
+				break
+			}
+			host := c.checkAndGetHost(id, hostid, RoleViewer)
 			if host == nil {
 				break
 			}
@@ -333,10 +761,28 @@ func (c *CliConn)Handle(){
 			connid, _ := dt.GetInt64("conn")
 			program, _ := dt.GetString("prog")
 			args, _ := dt.GetList("args")
-			host := c.checkAndGetHost(id, hostid)
+			if !c.requireScope(id, ScopeDeviceExec) {
+				break
+			}
+			host := c.checkAndGetHost(id, hostid, RoleOperator)
 			if host == nil {
 				break
 			}
+			if selector, ok := dt.GetMap("selector"); ok {
+				conns, ok := c.selectConns(id, host, selector)
+				if !ok {
+					break
+				}
+				c.audit("run", hostid, nil, Map{"prog": program, "args": args, "devices": connIds(conns)})
+				go c.Reply(id, Map{
+					"status": "ok",
+					"res": eachDevice(conns, 0, func(conn *Conn)(any, error){
+						_, _, err := conn.Run(program, args...)
+						return nil, err
+					}, nil),
+				})
+				break
+			}
 			conn := host.GetConn(connid)
 			if conn == nil {
 				c.Reply(id, Map{
@@ -345,6 +791,7 @@ func (c *CliConn)Handle(){
 				})
 				break
 			}
+			c.audit("run", hostid, &connid, Map{"prog": program, "args": args})
 			_, _, err := conn.Run(program, args...)
 			if err != nil {
 				c.Reply(id, Map{
@@ -362,10 +809,42 @@ func (c *CliConn)Handle(){
 			hostid, _ := dt.GetString("host")
 			connid, _ := dt.GetInt64("conn")
 			codes, _ := dt.GetString("codes")
-			host := c.checkAndGetHost(id, hostid)
+			// timeout is in seconds, it's per device if the exec has a selector
+			timeout := defaultExecTimeout
+			if t, ok := dt.GetFloat("timeout"); ok && t > 0 {
+				timeout = (time.Duration)(t * (float64)(time.Second))
+			}
+			if !c.requireScope(id, ScopeDeviceExec) {
+				break
+			}
+			host := c.checkAndGetHost(id, hostid, RoleOperator)
 			if host == nil {
 				break
 			}
+			if selector, ok := dt.GetMap("selector"); ok {
+				conns, ok := c.selectConns(id, host, selector)
+				if !ok {
+					break
+				}
+				limit := defaultExecConcurrency
+				if n, ok := dt.GetInt("concurrency"); ok && n > 0 {
+					limit = n
+					if limit > maxExecConcurrency {
+						limit = maxExecConcurrency
+					}
+				}
+				c.audit("exec", hostid, nil, Map{"codes": codes, "devices": connIds(conns)})
+				ctx, cancel := context.WithCancel(c.ctx)
+				r := c.startRequest(id, cancel)
+				go func(){
+					defer c.endRequest(id, r)
+					c.Reply(id, Map{
+						"status": "ok",
+						"res": c.fanoutExec(ctx, id, conns, codes, timeout, limit),
+					})
+				}()
+				break
+			}
 			conn := host.GetConn(connid)
 			if conn == nil {
 				c.Reply(id, Map{
@@ -374,11 +853,15 @@ func (c *CliConn)Handle(){
 				})
 				break
 			}
+			c.audit("exec", hostid, &connid, codes)
+			ctx, cancel := context.WithTimeout(c.ctx, timeout)
+			r := c.startRequest(id, cancel)
 			go func(){
-				res, err := conn.Exec(codes)
+				defer c.endRequest(id, r)
+				res, err := conn.ExecContext(ctx, codes)
 				if err != nil {
 					c.Reply(id, Map{
-						"status": "failed",
+						"status": failedStatus(err),
 						"error": err.Error(),
 					})
 					return
@@ -422,15 +905,161 @@ func (c *CliConn)onReply(id int, data any){
 	}
 }
 
+func (c *CliConn)freeAskId(id int){
+	c.askMux.Lock()
+	delete(c.asking, id)
+	c.askMux.Unlock()
+}
+
 func (c *CliConn)Ask(typ string, data any)(res any, err error){
+	return c.AskContext(c.ctx, typ, data)
+}
+
+// AskContext sends the request to the client and waits for its reply,
+// a cancel packet is sent to the client if ctx is done before the reply
+func (c *CliConn)AskContext(ctx context.Context, typ string, data any)(res any, err error){
 	id, resCh := c.allocAskId()
 	if err = c.send(Map{
 		"id": id,
 		"type": typ,
 		"data": data,
 	}); err != nil {
+		c.freeAskId(id)
 		return
 	}
-	res = <-resCh
+	select {
+	case res = <-resCh:
+	case <-ctx.Done():
+		c.freeAskId(id)
+		err = ctx.Err()
+		if c.ctx.Err() == nil {
+			c.send(Map{
+				"type": "cancel",
+				"id": id,
+			})
+		}
+	case <-c.ctx.Done():
+		c.freeAskId(id)
+		err = c.ctx.Err()
+	}
 	return
 }
+
+// startRequest saves the cancel function of a running request, so the client can cancel it by its id
+func (c *CliConn)startRequest(id int, cancel context.CancelFunc)(r *runningRequest){
+	r = &runningRequest{cancel: cancel}
+	c.runMux.Lock()
+	c.running[id] = r
+	c.runMux.Unlock()
+	return
+}
+
+func (c *CliConn)endRequest(id int, r *runningRequest){
+	c.runMux.Lock()
+	if c.running[id] == r {
+		delete(c.running, id)
+	}
+	c.runMux.Unlock()
+	r.cancel()
+}
+
+func (c *CliConn)cancelRequest(id int){
+	c.runMux.Lock()
+	r, ok := c.running[id]
+	c.runMux.Unlock()
+	if ok {
+		loger.Debugf("[%s]: Request %d is canceled by the client", c.addr, id)
+		r.cancel()
+	}
+}
+
+// selectConns replies an error and returns false if the selector is invalid
+func (c *CliConn)selectConns(rid int, host *HostServer, selector Map)(conns []*Conn, ok bool){
+	sel, err := ParseDeviceSelector(selector)
+	if err != nil {
+		c.Reply(rid, Map{
+			"status": "error",
+			"error": err.Error(),
+		})
+		return nil, false
+	}
+	return host.Select(sel), true
+}
+
+func connIds(conns []*Conn)(ids []int64){
+	ids = make([]int64, len(conns))
+	for i, conn := range conns {
+		ids[i] = conn.Id()
+	}
+	return
+}
+
+// execSummary is the reply of a fan-out exec
+type execSummary struct {
+	Total     int            `json:"total"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []deviceResult `json:"results"`
+}
+
+// fanoutExec runs the codes on the devices, each of them has its own timeout.
+// An exec_progress packet is sent to the client with the id of the request once a device is done
+func (c *CliConn)fanoutExec(ctx context.Context, rid int, conns []*Conn, codes string, timeout time.Duration, limit int)(summary execSummary){
+	var (
+		mux  sync.Mutex
+		done int
+	)
+	summary.Total = len(conns)
+	summary.Results = eachDevice(conns, limit, func(conn *Conn)(any, error){
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return conn.ExecContext(ctx, codes)
+	}, func(r deviceResult){
+		mux.Lock()
+		done++
+		n := done
+		mux.Unlock()
+		c.send(Map{
+			"type": "exec_progress",
+			"id": rid,
+			"data": Map{
+				"result": r,
+				"done": n,
+				"total": summary.Total,
+			},
+		})
+	})
+	for _, r := range summary.Results {
+		if r.Status == "ok" {
+			summary.Succeeded++
+		}else{
+			summary.Failed++
+		}
+	}
+	return
+}
+
+// onChannelMessage forwards a message of the subscribed channels,
+// the messages of the hosts that the client lost permission of are dropped
+func (c *CliConn)onChannelMessage(msg ChannelMessage){
+	if c.role(msg.Host) < RoleViewer || !c.hasScope(ScopeHostsRead) {
+		return
+	}
+	c.send(Map{
+		"type": "channel_message",
+		"host": msg.Host,
+		"data": msg,
+	})
+}
+
+func (c *CliConn)unsubscribeAll(){
+	c.subMux.Lock()
+	defer c.subMux.Unlock()
+	for hostid := range c.subHosts {
+		c.handler.GetBroker(hostid).UnsubscribeAll(c)
+	}
+	c.subHosts = nil
+}
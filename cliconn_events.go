@@ -0,0 +1,132 @@
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// eventSubKey is a subscription of the events of a host, conn is -1 for every device of the host.
+// The host "*" is every host that the client can read
+type eventSubKey struct {
+	host string
+	conn int64
+}
+
+type eventSubMeta struct {
+	Host   string   `json:"host"`
+	Conn   *int64   `json:"conn"`
+	Events []string `json:"events"`
+}
+
+// matchEventKind reports whether the kind of an event matches the pattern,
+// a trailing "*" of the pattern matches any suffix, such as "term.*"
+func matchEventKind(pattern string, kind string)(bool){
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(kind, pattern[:len(pattern) - 1])
+	}
+	return pattern == kind
+}
+
+// wantEvent reports whether the client subscribed to the event.
+// A client that never subscribed receives every event
+func (c *CliConn)wantEvent(host string, conn int64, kind string)(bool){
+	c.evMux.RLock()
+	defer c.evMux.RUnlock()
+	if c.evSubs == nil {
+		return true
+	}
+	for _, k := range [...]eventSubKey{{host, conn}, {host, -1}, {"*", -1}} {
+		for pattern := range c.evSubs[k] {
+			if matchEventKind(pattern, kind) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseEventSub reads the key and the event kinds of a subscribe or unsubscribe packet,
+// such as {"host": "h1", "conn": 2, "events": ["term.*"]}
+func parseEventSub(dt Map)(key eventSubKey, kinds []string){
+	key.host, _ = dt.GetString("host")
+	key.conn = -1
+	if id, ok := dt.GetInt64("conn"); ok && key.host != "*" {
+		key.conn = id
+	}
+	events, _ := dt.GetList("events")
+	for i := range events {
+		if kind, ok := events.GetString(i); ok && len(kind) != 0 {
+			kinds = append(kinds, kind)
+		}
+	}
+	return
+}
+
+func (c *CliConn)subscribeEvents(key eventSubKey, kinds []string){
+	if len(kinds) == 0 {
+		kinds = []string{"*"}
+	}
+	c.evMux.Lock()
+	defer c.evMux.Unlock()
+	if c.evSubs == nil {
+		c.evSubs = make(map[eventSubKey]map[string]struct{})
+	}
+	set, ok := c.evSubs[key]
+	if !ok {
+		set = make(map[string]struct{}, len(kinds))
+		c.evSubs[key] = set
+	}
+	for _, k := range kinds {
+		set[k] = struct{}{}
+	}
+}
+
+// unsubscribeEvents removes the kinds from the subscription, or the whole subscription if kinds is empty
+func (c *CliConn)unsubscribeEvents(key eventSubKey, kinds []string){
+	c.evMux.Lock()
+	defer c.evMux.Unlock()
+	if c.evSubs == nil {
+		// the client starts to filter the events once it unsubscribed anything
+		c.evSubs = make(map[eventSubKey]map[string]struct{})
+		return
+	}
+	set, ok := c.evSubs[key]
+	if !ok {
+		return
+	}
+	for _, k := range kinds {
+		delete(set, k)
+	}
+	if len(kinds) == 0 || len(set) == 0 {
+		delete(c.evSubs, key)
+	}
+}
+
+func (c *CliConn)listEventSubs()(subs []eventSubMeta){
+	c.evMux.RLock()
+	defer c.evMux.RUnlock()
+	subs = make([]eventSubMeta, 0, len(c.evSubs))
+	for key, set := range c.evSubs {
+		s := eventSubMeta{
+			Host: key.host,
+			Events: make([]string, 0, len(set)),
+		}
+		if key.conn >= 0 {
+			conn := key.conn
+			s.Conn = &conn
+		}
+		for k := range set {
+			s.Events = append(s.Events, k)
+		}
+		sort.Strings(s.Events)
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int)(bool){
+		if subs[i].Host != subs[j].Host {
+			return subs[i].Host < subs[j].Host
+		}
+		return subs[i].Conn != nil && (subs[j].Conn == nil || *subs[i].Conn < *subs[j].Conn)
+	})
+	return
+}
@@ -0,0 +1,39 @@
+
+package main
+
+import (
+	"testing"
+)
+
+func TestCliConnEventSubs(t *testing.T){
+	c := new(CliConn)
+	if !c.wantEvent("h1", 1, "term.oper") {
+		t.Errorf("Expect the client to receive every event before it subscribed")
+	}
+	c.subscribeEvents(eventSubKey{"*", -1}, []string{"device_*"})
+	c.subscribeEvents(eventSubKey{"h1", 2}, nil)
+	cases := []struct {
+		host string
+		conn int64
+		kind string
+		want bool
+	}{
+		{"h1", 1, "device_join", true},
+		{"h2", 5, "device_leave", true},
+		{"h1", 1, "term.oper", false},
+		{"h1", 2, "term.oper", true},
+		{"h2", 2, "term.oper", false},
+	}
+	for _, cs := range cases {
+		if c.wantEvent(cs.host, cs.conn, cs.kind) != cs.want {
+			t.Errorf("Expect event %s of %s/%d wanted: %v", cs.kind, cs.host, cs.conn, cs.want)
+		}
+	}
+	if subs := c.listEventSubs(); len(subs) != 2 || subs[0].Host != "*" || *subs[1].Conn != 2 {
+		t.Errorf("Unexpected subscriptions %v", subs)
+	}
+	c.unsubscribeEvents(eventSubKey{"h1", 2}, nil)
+	if c.wantEvent("h1", 2, "term.oper") {
+		t.Errorf("Expect the terminal events to be unsubscribed")
+	}
+}
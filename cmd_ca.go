@@ -0,0 +1,125 @@
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func printCAUsage(){
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  ca init [name]          Create the certificate authority for daemon certificates")
+	fmt.Fprintln(os.Stderr, "  ca issue <host> [days]  Issue a certificate for the host, saved as <host>.crt and <host>.key")
+	fmt.Fprintln(os.Stderr, "  ca revoke <serial>      Revoke an issued certificate")
+	fmt.Fprintln(os.Stderr, "  ca list                 List all issued certificates")
+}
+
+func runCACmd(args []string)(code int){
+	if len(args) == 0 {
+		printCAUsage()
+		return 2
+	}
+	dir := config.DaemonTLS.caDir()
+
+	if args[0] == "init" {
+		name := "cc-ws2 daemon CA"
+		if len(args) > 1 {
+			name = args[1]
+		}
+		if _, err := InitCertAuthority(dir, name); err != nil {
+			loger.Errorf("Cannot init certificate authority at %s: %v", dir, err)
+			return 1
+		}
+		fmt.Printf("Certificate authority created at %s\n", dir)
+		return 0
+	}
+
+	ca, err := LoadCertAuthority(dir)
+	if err != nil {
+		if errors.Is(err, CANotInitedErr) {
+			fmt.Fprintf(os.Stderr, "No certificate authority at %s, run `ca init` first\n", dir)
+			return 1
+		}
+		loger.Errorf("Cannot load certificate authority at %s: %v", dir, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "issue":
+		if len(args) < 2 {
+			printCAUsage()
+			return 2
+		}
+		host := args[1]
+		if len(host) == 0 || strings.ContainsAny(host, "/\\") || host == "." || host == ".." {
+			fmt.Fprintf(os.Stderr, "Invalid host id %q\n", host)
+			return 2
+		}
+		var validFor time.Duration
+		if len(args) > 2 {
+			days, err := strconv.Atoi(args[2])
+			if err != nil || days <= 0 {
+				fmt.Fprintf(os.Stderr, "Invalid days %q\n", args[2])
+				return 2
+			}
+			validFor = (time.Duration)(days) * 24 * time.Hour
+		}
+		certPath, keyPath := host + ".crt", host + ".key"
+		for _, p := range []string{certPath, keyPath} {
+			if _, err := os.Stat(p); err == nil {
+				fmt.Fprintf(os.Stderr, "File %s already exists\n", p)
+				return 1
+			}
+		}
+		certPEM, keyPEM, info, err := ca.IssueDaemonCert(host, validFor)
+		if err != nil {
+			loger.Errorf("Cannot issue certificate: %v", err)
+			return 1
+		}
+		if err = os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			loger.Errorf("Cannot write %s: %v", keyPath, err)
+			return 1
+		}
+		if err = os.WriteFile(certPath, certPEM, 0644); err != nil {
+			loger.Errorf("Cannot write %s: %v", certPath, err)
+			return 1
+		}
+		fmt.Printf("Issued certificate %s for %q, expires at %s\n", info.Serial, info.Host, info.NotAfter.Format(time.RFC3339))
+		fmt.Printf("Saved to %s and %s, the CA certificate is %s\n", certPath, keyPath, filepath.Join(dir, caCertFile))
+	case "revoke":
+		if len(args) < 2 {
+			printCAUsage()
+			return 2
+		}
+		if err := ca.Revoke(strings.ToLower(args[1])); err != nil {
+			loger.Errorf("Cannot revoke certificate %s: %v", args[1], err)
+			return 1
+		}
+		fmt.Printf("Revoked %s\n", args[1])
+	case "list":
+		certs, err := ca.List()
+		if err != nil {
+			loger.Errorf("Cannot list certificates: %v", err)
+			return 1
+		}
+		now := time.Now()
+		for _, c := range certs {
+			state := "valid"
+			if c.Revoked != nil {
+				state = "revoked at " + c.Revoked.Format(time.RFC3339)
+			}else if now.After(c.NotAfter) {
+				state = "expired"
+			}
+			fmt.Printf("%s  %-24s  expires %s  %s\n", c.Serial, c.Host, c.NotAfter.Format(time.RFC3339), state)
+		}
+	default:
+		printCAUsage()
+		return 2
+	}
+	return 0
+}
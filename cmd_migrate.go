@@ -0,0 +1,111 @@
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+func openSQLDB(cfg DBConfig)(db *sql.DB, dialect string, err error){
+	switch cfg.Driver {
+	case "", "mysql":
+		username, passwd, dbaddr, dbname := getMySQLEnvs()
+		db, err = openMySQLDB(username, passwd, dbaddr, dbname)
+		return db, "mysql", err
+	case "sqlite":
+		path := cfg.Path
+		if len(path) == 0 {
+			path = filepath.Join(DataDir, "data.db")
+		}
+		db, err = openSQLiteDB(path)
+		return db, "sqlite", err
+	default:
+		return nil, "", fmt.Errorf("Database driver %q does not support migrations", cfg.Driver)
+	}
+}
+
+func printMigrateUsage(){
+	fmt.Fprintln(os.Stderr, "Usage:")
+	fmt.Fprintln(os.Stderr, "  migrate status          Show all migrations and whether they are applied")
+	fmt.Fprintln(os.Stderr, "  migrate up [version]    Apply pending migrations, up to version if given")
+	fmt.Fprintln(os.Stderr, "  migrate down [steps]    Revert the last steps (default 1) applied migrations")
+}
+
+func runMigrateCmd(args []string)(code int){
+	if len(args) == 0 {
+		printMigrateUsage()
+		return 2
+	}
+	var num int
+	if len(args) > 1 {
+		var err error
+		if num, err = strconv.Atoi(args[1]); err != nil || num < 0 {
+			fmt.Fprintf(os.Stderr, "Invalid number %q\n", args[1])
+			return 2
+		}
+	}
+
+	db, dialect, err := openSQLDB(config.DB)
+	if err != nil {
+		loger.Errorf("Cannot open database: %v", err)
+		return 1
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, dialect)
+	if err != nil {
+		loger.Errorf("Cannot load migrations: %v", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute * 10)
+	defer cancel()
+
+	switch args[0] {
+	case "status":
+		status, err := m.Status(ctx)
+		if err != nil {
+			loger.Errorf("Cannot get migration status: %v", err)
+			return 1
+		}
+		for _, s := range status {
+			if s.Applied {
+				fmt.Printf("[x] %04d_%s (applied at %s)\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+			}else{
+				fmt.Printf("[ ] %04d_%s\n", s.Version, s.Name)
+			}
+		}
+	case "up":
+		applied, err := m.Up(ctx, num)
+		for _, mg := range applied {
+			fmt.Printf("Applied %04d_%s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			loger.Errorf("Migrate up failed: %v", err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("Already up to date")
+		}
+	case "down":
+		if num == 0 {
+			num = 1
+		}
+		reverted, err := m.Down(ctx, num)
+		for _, mg := range reverted {
+			fmt.Printf("Reverted %04d_%s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			loger.Errorf("Migrate down failed: %v", err)
+			return 1
+		}
+	default:
+		printMigrateUsage()
+		return 2
+	}
+	return 0
+}
@@ -3,11 +3,15 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"nhooyr.io/websocket"
@@ -32,21 +36,70 @@ func (e *TermNotFoundErr)Error()(string){
 	return fmt.Sprintf("Term is not found with id %d", e.TermId)
 }
 
+var (
+	SessionEndedErr = errors.New("Device session is already ended")
+	OutboxFullErr = errors.New("Device is offline and its outbox is full")
+)
+
+const (
+	sessionPrefix = "ses_"
+	sessionBytes = 24
+	// maxOutboxPackets is the packets that can be buffered while the device is offline
+	maxOutboxPackets = 1024
+	// flushTimeout is how long the last packet to a closing socket can wait in the write queue
+	flushTimeout = 5 * time.Second
+)
+
 type ConnEventListener = func(conn *Conn, event string, args List)
 
+// Conn is the session of a device.
+// The session outlives its websocket, when the device drops the socket it is kept for the grace period of the host,
+// and the device can resume it with the session id by the header X-CC-Session.
+// The packets sent while the device is offline are buffered in the outbox and replayed after it resumed
 type Conn struct {
 	host *HostServer
 
-	req    *http.Request
-	ws     *websocket.Conn
-	addr   string // as same as req.RemoteAddr
+	session string
+
+	wsMux  sync.Mutex
+	ws     *websocket.Conn // nil while the device is offline
+	wq     *writeQueue // the outbound queue of ws
+	addr   string // as same as req.RemoteAddr of the latest socket
+	outbox []Map
+	grace  *time.Timer
+
+	// token is the daemon token that the connection authenticated with, empty if it used a certificate
+	token  string
 	id     int64
 	device string // The device's type, example are [turtle pocket computer]
 	label  string
 
+	// outboxReady is true after the durable outbox is flushed to the current socket,
+	// the packets sent through the outbox are queued until then
+	outboxMux   sync.Mutex
+	outboxReady bool
+
+	// tags are set by the header X-CC-Tags or the tags packet,
+	// adminTags are set by the admins and stored in the device registry,
+	// allTags is the union of them
+	tagMux    sync.RWMutex
+	tags      []string
+	adminTags []string
+	allTags   []string
+
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	startedAt time.Time
+	lastSeen  atomic.Int64 // unix nano of the last packet from the device
+
+	pingMux       sync.Mutex
+	pingSeq       int64
+	pingSent      map[int64]time.Time
+	missedPongs   int
+	pongSupported bool
+	rtt           time.Duration
+
 	askMux sync.Mutex
 	askInc int
 	asking map[int]chan<- any
@@ -72,44 +125,231 @@ func readCCID(req *http.Request)(id int64, err error){
 	return
 }
 
-func AcceptConn(host *HostServer, rw http.ResponseWriter, req *http.Request)(c *Conn, err error){
+func newSessionId()(id string, err error){
+	var buf [sessionBytes]byte
+	if _, err = rand.Read(buf[:]); err != nil {
+		return
+	}
+	return sessionPrefix + base64.RawURLEncoding.EncodeToString(buf[:]), nil
+}
+
+func AcceptConn(host *HostServer, token string, rw http.ResponseWriter, req *http.Request)(c *Conn, err error){
 	c = &Conn{
 		host: host,
 		addr: req.RemoteAddr,
+		token: token,
+		startedAt: time.Now(),
+		pingSent: make(map[int64]time.Time),
 		asking: make(map[int]chan<- any),
 		terms: make(map[int]*Term),
 	}
-	c.ws, err = websocket.Accept(rw, req, nil)
-	if err != nil {
-		return
-	}
-	c.ctx, c.cancel = context.WithCancel(host.ctx)
+	c.lastSeen.Store(c.startedAt.UnixNano())
 	if c.id, err = readCCID(req); err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(rw, err.Error())
+		return
+	}
+	if c.session, err = newSessionId(); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	c.device = req.Header.Get("X-CC-Device")
 	c.label = req.Header.Get("X-CC-Label")
-	go func(){
-		for {
-			select {
-			case <-time.After(10 * time.Second):
-				c.send(Map{
-					"type": "ping",
-				})
-			case <-c.ctx.Done():
-				return
-			}
+	if tags := req.Header.Get("X-CC-Tags"); len(tags) != 0 {
+		if c.tags, err = normalizeTags(strings.Split(tags, ",")); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(rw, err.Error())
+			return
 		}
-	}()
+		c.allTags = c.tags
+	}
+	ws, err := websocket.Accept(rw, req, nil)
+	if err != nil {
+		return
+	}
+	c.ctx, c.cancel = context.WithCancel(host.ctx)
+	if err = c.attach(ws, req.RemoteAddr, false); err != nil {
+		return
+	}
+	go c.pingLoop()
 	return
 }
 
+// Session returns the id that the device can resume the session with
+func (c *Conn)Session()(string){
+	return c.session
+}
+
+// canResume reports whether a reconnecting device can take over the session
+func (c *Conn)canResume(session string, token string)(bool){
+	return len(session) != 0 && session == c.session && token == c.token && c.ctx.Err() == nil
+}
+
+// resume accepts the new socket of the device into the session
+func (c *Conn)resume(rw http.ResponseWriter, req *http.Request)(err error){
+	ws, err := websocket.Accept(rw, req, nil)
+	if err != nil {
+		return
+	}
+	return c.attach(ws, req.RemoteAddr, true)
+}
+
+// attach makes ws the socket of the session, the buffered packets are sent before any new one
+func (c *Conn)attach(ws *websocket.Conn, addr string, resumed bool)(err error){
+	// the durable outbox must be flushed to the new socket first
+	c.outboxMux.Lock()
+	c.outboxReady = false
+	c.outboxMux.Unlock()
+
+	c.wsMux.Lock()
+	if c.ctx.Err() != nil {
+		c.wsMux.Unlock()
+		ws.Close(websocket.StatusGoingAway, "session ended")
+		return SessionEndedErr
+	}
+	if c.grace != nil {
+		c.grace.Stop()
+		c.grace = nil
+	}
+	old := c.ws
+	wasOffline := resumed && old == nil
+	// the session packet, the packets queued for the old socket and the buffered packets are written first.
+	// They are written by the queue, so a stuck socket doesn't hold the lock;
+	// if the writes fail, the socket is detached and the packets are buffered again
+	backlog := make([]Map, 0, 1 + len(c.outbox))
+	backlog = append(backlog, Map{
+		"type": "session",
+		"data": Map{
+			"id": c.session,
+			"resumed": resumed,
+			"grace": (int)(c.host.resumeGrace / time.Second),
+		},
+	})
+	if c.wq != nil {
+		backlog = append(backlog, unsentPackets(c.wq)...)
+	}
+	backlog = append(backlog, c.outbox...)
+	c.outbox = nil
+	c.ws = ws
+	c.wq = c.newQueue(ws, backlog)
+	c.addr = addr
+	c.wsMux.Unlock()
+	c.resetPings()
+
+	if old != nil {
+		old.Close(websocket.StatusGoingAway, "session resumed by another socket")
+	}
+	if resumed {
+		loger.Infof("[%s]: Device %d resumed its session", addr, c.id)
+	}
+	if wasOffline {
+		c.onEvent("#device_online", addr)
+	}
+	return
+}
+
+// detach is called after ws is dropped, the session ends after the grace period if it's not resumed.
+// A nil ws detaches whatever the current socket is
+func (c *Conn)detach(ws *websocket.Conn){
+	c.wsMux.Lock()
+	if ws != nil && c.ws != ws {
+		// the session is already resumed by another socket
+		c.wsMux.Unlock()
+		return
+	}
+	c.ws = nil
+	lost := 0
+	if c.wq != nil {
+		// the packets that are not written yet are replayed after the resumption
+		c.outbox = append(unsentPackets(c.wq), c.outbox...)
+		if len(c.outbox) > maxOutboxPackets {
+			lost = len(c.outbox) - maxOutboxPackets
+			c.outbox = c.outbox[:maxOutboxPackets]
+		}
+		c.wq = nil
+	}
+	grace := c.host.resumeGrace
+	if grace <= 0 || c.ctx.Err() != nil || lost > 0 {
+		c.wsMux.Unlock()
+		if lost > 0 && c.ctx.Err() == nil {
+			// a resumed session must not miss packets, so the device has to start a new one
+			loger.Warnf("[%s]: Device %d lost %d packets that do not fit in the outbox, session ended", c.Addr(), c.id, lost)
+		}
+		c.cancel()
+		return
+	}
+	if c.grace != nil { // already offline
+		c.wsMux.Unlock()
+		return
+	}
+	c.grace = time.AfterFunc(grace, func(){
+		c.wsMux.Lock()
+		offline := c.ws == nil
+		c.wsMux.Unlock()
+		if offline {
+			loger.Infof("[%s]: Device %d did not resume in %v, session ended", c.Addr(), c.id, grace)
+			c.cancel()
+		}
+	})
+	c.wsMux.Unlock()
+	loger.Infof("[%s]: Device %d went offline, keeping the session for %v", c.Addr(), c.id, grace)
+	c.onEvent("#device_offline", (int)(grace / time.Second))
+}
+
+// socket returns the current socket, or nil if the device is offline
+func (c *Conn)socket()(*websocket.Conn){
+	c.wsMux.Lock()
+	defer c.wsMux.Unlock()
+	return c.ws
+}
+
+// unsentPackets stops q and returns the packets to be replayed, the session packet is dropped since a new one is sent
+func unsentPackets(q *writeQueue)(packets []Map){
+	for _, p := range q.stop() {
+		if p["type"] != "session" {
+			packets = append(packets, p)
+		}
+	}
+	return
+}
+
+// queue returns the write queue of the current socket, or nil if the device is offline
+func (c *Conn)queue()(*writeQueue){
+	c.wsMux.Lock()
+	defer c.wsMux.Unlock()
+	return c.wq
+}
+
+// newQueue starts the write queue of ws with the backlog to be written first,
+// the socket is dropped if the queue overflows or a write fails
+func (c *Conn)newQueue(ws *websocket.Conn, backlog []Map)(q *writeQueue){
+	q = newWriteQueue(ws, c.host.writeQueue)
+	q.preload(backlog)
+	q.onClose = func(err error){
+		if c.ctx.Err() != nil {
+			return
+		}
+		loger.Warnf("[%s]: Cannot write to device %d: %v", c.Addr(), c.id, err)
+		c.detach(ws)
+		// closing a stuck connection waits for the close handshake to time out
+		go ws.Close(websocket.StatusGoingAway, err.Error())
+	}
+	q.start(c.ctx)
+	return
+}
+
+// Online reports whether the device is connected now
+func (c *Conn)Online()(bool){
+	return c.socket() != nil
+}
+
 func (c *Conn)Host()(*HostServer){
 	return c.host
 }
 
 func (c *Conn)Addr()(string){
+	c.wsMux.Lock()
+	defer c.wsMux.Unlock()
 	return c.addr
 }
 
@@ -125,6 +365,29 @@ func (c *Conn)Label()(string){
 	return c.label
 }
 
+// Tags returns the normalized tags of the device merged with the tags set by the admins,
+// the result must not be modified
+func (c *Conn)Tags()([]string){
+	c.tagMux.RLock()
+	defer c.tagMux.RUnlock()
+	return c.allTags
+}
+
+// SetAdminTags replaces the tags set by the admins, the tags must be normalized
+func (c *Conn)SetAdminTags(tags []string){
+	c.tagMux.Lock()
+	defer c.tagMux.Unlock()
+	c.adminTags = tags
+	c.allTags = mergeTags(c.tags, c.adminTags)
+}
+
+func (c *Conn)onChannelMessage(msg ChannelMessage){
+	c.send(Map{
+		"type": "channel_message",
+		"data": msg,
+	})
+}
+
 func (c *Conn)Context()(context.Context){
 	return c.ctx
 }
@@ -135,13 +398,48 @@ func (c *Conn)onEvent(event string, args ...any){
 	}
 }
 
-func (c *Conn)recv()(data Map, err error){
-	err = wsjson.Read(c.ctx, c.ws, &data)
+func (c *Conn)recv(ws *websocket.Conn)(data Map, err error){
+	err = wsjson.Read(c.ctx, ws, &data)
 	return
 }
 
+// send queues the packet to the device, or buffers it in the outbox while the device is offline
 func (c *Conn)send(data Map)(err error){
-	return wsjson.Write(c.ctx, c.ws, data)
+	c.wsMux.Lock()
+	q := c.wq
+	if q == nil {
+		defer c.wsMux.Unlock()
+		if err = c.ctx.Err(); err != nil {
+			return
+		}
+		if len(c.outbox) >= maxOutboxPackets {
+			return OutboxFullErr
+		}
+		c.outbox = append(c.outbox, data)
+		return nil
+	}
+	c.wsMux.Unlock()
+	if err = q.push(data); err != nil && c.ctx.Err() == nil {
+		c.wsMux.Lock()
+		if c.wq != q && len(c.outbox) < maxOutboxPackets {
+			// the socket is dropped by the queue, so keep the packet for the resumption
+			c.outbox = append(c.outbox, data)
+			err = nil
+		}
+		c.wsMux.Unlock()
+	}
+	return
+}
+
+// flush queues the packet to the current socket and waits until it's written
+func (c *Conn)flush(data Map)(err error){
+	q := c.queue()
+	if q == nil {
+		return WriteQueueClosedErr
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, flushTimeout)
+	defer cancel()
+	return q.pushWait(ctx, data)
 }
 
 func (c *Conn)Reply(id int, data any)(err error){
@@ -152,49 +450,93 @@ func (c *Conn)Reply(id int, data any)(err error){
 	})
 }
 
+// Revoke tells the daemon why its session is revoked and closes the connection
+func (c *Conn)Revoke(reason string)(err error){
+	loger.Infof("[%s]: Session revoked: %s", c.Addr(), reason)
+	c.send(Map{
+		"type": "session_revoked",
+		"data": Map{
+			"reason": reason,
+			"closed": true,
+		},
+	})
+	return c.Close()
+}
+
+// Close ends the session, it does not wait for the device to resume
 func (c *Conn)Close()(err error){
-	err = c.send(Map{ "type": "terminate" })
+	ws := c.socket()
+	if ws != nil {
+		err = c.flush(Map{ "type": "terminate" })
+	}
 	c.cancel()
-	c.ws.Close(websocket.StatusNormalClosure, "remote closed")
+	if ws != nil {
+		ws.Close(websocket.StatusNormalClosure, "remote closed")
+	}
 	return
 }
 
+// Handle reads the packets from the current socket until it's dropped.
+// The session is kept for the resumption unless the device terminated
 func (c *Conn)Handle(){
-	defer c.ws.Close(websocket.StatusInternalError, "500 internal error")
-	defer c.cancel()
+	ws := c.socket()
+	if ws == nil {
+		return
+	}
+	ended := false
+	defer func(){
+		if ended {
+			c.cancel()
+		}else{
+			c.detach(ws)
+		}
+		ws.Close(websocket.StatusInternalError, "500 internal error")
+	}()
 	for {
-		data, err := c.recv()
+		data, err := c.recv(ws)
 		if err != nil {
 			var cerr *websocket.CloseError
 			if errors.As(err, &cerr) {
-				loger.Infof("[%s]: Disconnected: %v", cerr)
-			}else{
-				loger.Errorf("[%s]: Error when recving data: %v", c.addr, err)
-				c.ws.Close(websocket.StatusInternalError, err.Error())
+				loger.Infof("[%s]: Disconnected: %v", c.Addr(), cerr)
+			}else if c.ctx.Err() == nil {
+				loger.Errorf("[%s]: Error when recving data: %v", c.Addr(), err)
+				ws.Close(websocket.StatusInternalError, err.Error())
 			}
 			return
 		}
-		loger.Debugf("[%s]: Recv: %v", c.addr, data)
+		loger.Debugf("[%s]: Recv: %v", c.Addr(), data)
+		c.lastSeen.Store(time.Now().UnixNano())
 		typ, _ := data.GetString("type")
 		switch typ {
+		case "ping":
+			c.send(Map{
+				"type": "pong",
+				"data": data["data"],
+			})
+		case "pong":
+			dt, _ := data.GetMap("data")
+			seq, _ := dt.GetInt64("seq")
+			c.onPong(seq)
 		case "terminated":
-			loger.Infof("[%s]: Terminated", c.addr)
-			c.ws.Close(websocket.StatusNormalClosure, "terminated")
+			loger.Infof("[%s]: Terminated", c.Addr())
+			ended = true
+			ws.Close(websocket.StatusNormalClosure, "terminated")
 			return
 		case "terminate":
 			if c.TerminateHandler != nil {
 				if !c.TerminateHandler(c) {
-					loger.Debugf("[%s]: Terminate prevented by handler", c.addr)
+					loger.Debugf("[%s]: Terminate prevented by handler", c.Addr())
 					continue
 				}
 			}
-			loger.Infof("[%s]: Terminating", c.addr)
-			if err = c.send(Map{ "type": "terminate" }); err != nil {
-				loger.Warnf("[%s]: Error when sending terminate: %v", c.addr, err)
-				c.ws.Close(websocket.StatusInternalError, err.Error())
+			loger.Infof("[%s]: Terminating", c.Addr())
+			ended = true
+			if err = c.flush(Map{ "type": "terminate" }); err != nil {
+				loger.Warnf("[%s]: Error when sending terminate: %v", c.Addr(), err)
+				ws.Close(websocket.StatusInternalError, err.Error())
 				return
 			}
-			c.ws.Close(websocket.StatusNormalClosure, "terminate")
+			ws.Close(websocket.StatusNormalClosure, "terminate")
 			return
 		case "reply":
 			rid, _ := data.GetInt("id")
@@ -202,6 +544,90 @@ func (c *Conn)Handle(){
 		case "broadcast":
 			tdata, _ := data.GetMap("data")
 			c.host.broadcastExcept(tdata, c)
+		case "send":
+			rid, ok := data.GetInt("id")
+			tdata, _ := data.GetMap("data")
+			go c.onSend(rid, ok, tdata)
+		case "request":
+			rid, ok := data.GetInt("id")
+			if !ok {
+				loger.Debugf("[%s]: Request without id is ignored", c.Addr())
+				break
+			}
+			tdata, _ := data.GetMap("data")
+			go c.onRequest(rid, tdata)
+		case "channel_subscribe":
+			rid, ok := data.GetInt("id")
+			tdata, _ := data.GetMap("data")
+			topic, _ := tdata.GetString("topic")
+			if err := checkTopic(topic, true); err != nil {
+				if ok {
+					c.Reply(rid, Map{
+						"status": "error",
+						"error": err.Error(),
+					})
+				}
+				break
+			}
+			// reply first, so the retained values come after it
+			if ok {
+				c.Reply(rid, Map{
+					"status": "ok",
+				})
+			}
+			c.host.broker.Subscribe(c, topic, c.onChannelMessage)
+		case "channel_unsubscribe":
+			rid, ok := data.GetInt("id")
+			tdata, _ := data.GetMap("data")
+			topic, _ := tdata.GetString("topic")
+			c.host.broker.Unsubscribe(c, topic)
+			if ok {
+				c.Reply(rid, Map{
+					"status": "ok",
+				})
+			}
+		case "publish":
+			rid, ok := data.GetInt("id")
+			tdata, _ := data.GetMap("data")
+			topic, _ := tdata.GetString("topic")
+			retain, _ := tdata.GetBool("retain")
+			n, err := c.host.broker.Publish(topic, tdata["payload"], c.peerInfo(), retain)
+			if ok {
+				if err != nil {
+					c.Reply(rid, Map{
+						"status": "error",
+						"error": err.Error(),
+					})
+				}else{
+					c.Reply(rid, Map{
+						"status": "ok",
+						"res": n,
+					})
+				}
+			}
+		case "tags":
+			rid, ok := data.GetInt("id")
+			tags, _ := data.GetList("data")
+			tg, err := parseTagList(tags)
+			if err == nil {
+				c.tagMux.Lock()
+				c.tags = tg
+				c.allTags = mergeTags(c.tags, c.adminTags)
+				c.tagMux.Unlock()
+			}
+			if ok {
+				if err != nil {
+					c.Reply(rid, Map{
+						"status": "error",
+						"error": err.Error(),
+					})
+				}else{
+					c.Reply(rid, Map{
+						"status": "ok",
+						"res": tg,
+					})
+				}
+			}
 		case "event":
 			event, _ := data.GetString("event")
 			args, _ := data.GetList("args")
@@ -230,7 +656,7 @@ func (c *Conn)Handle(){
 				}
 			}
 		default:
-			loger.Debugf("[%s]: Unknown packet type %q", c.addr, typ)
+			loger.Debugf("[%s]: Unknown packet type %q", c.Addr(), typ)
 		}
 	}
 }
@@ -251,6 +677,12 @@ func (c *Conn)allocAskId()(id int, resCh <-chan any){
 	return
 }
 
+func (c *Conn)freeAskId(id int){
+	c.askMux.Lock()
+	delete(c.asking, id)
+	c.askMux.Unlock()
+}
+
 func (c *Conn)onReply(id int, data any){
 	c.askMux.Lock()
 	replyCh, ok := c.asking[id]
@@ -260,32 +692,59 @@ func (c *Conn)onReply(id int, data any){
 	c.askMux.Unlock()
 	if ok {
 		replyCh <- data
+	}else{
+		loger.Debugf("[%s]: Reply %d is not expected, it may be canceled", c.Addr(), id)
 	}
 }
 
 func (c *Conn)Ask(typ string, data any)(res any, err error){
+	return c.AskContext(context.Background(), typ, data)
+}
+
+// AskContext sends the request to the device and waits for its reply.
+// If ctx is done before the reply, a cancel packet with the request id is sent to the device
+// and the reply will be dropped when it arrives
+func (c *Conn)AskContext(ctx context.Context, typ string, data any)(res any, err error){
 	id, resCh := c.allocAskId()
 	if err = c.send(Map{
 		"id": id,
 		"type": typ,
 		"data": data,
 	}); err != nil {
+		c.freeAskId(id)
 		return
 	}
 	select {
 	case res = <-resCh:
+	case <-ctx.Done():
+		c.freeAskId(id)
+		err = ctx.Err()
+		c.send(Map{
+			"type": "cancel",
+			"id": id,
+		})
 	case <-c.ctx.Done():
+		c.freeAskId(id)
 		err = c.ctx.Err()
 	}
 	return
 }
 
 func (c *Conn)Exec(codes string)(res List, err error){
-	r, err := c.Ask("exec", codes)
+	return c.ExecContext(context.Background(), codes)
+}
+
+// ExecContext runs the lua codes on the device, the execution is canceled when ctx is done
+func (c *Conn)ExecContext(ctx context.Context, codes string)(res List, err error){
+	r, err := c.AskContext(ctx, "exec", codes)
 	if err != nil {
 		return
 	}
-	r0 := (Map)(r.(map[string]any))
+	m, ok := r.(map[string]any)
+	if !ok {
+		return nil, &ExecErr{ fmt.Sprintf("Unexpected reply %v", r) }
+	}
+	r0 := (Map)(m)
 	status, _ := r0.GetString("status")
 	if status != "ok" {
 		errmsg, ok := r0.GetString("err")
@@ -373,11 +832,15 @@ func (c *Conn)onTermOper(tid int, oper string, args List)(res []any, err error){
 	return
 }
 
-func (c *Conn)FireEventOnTerm(tid int, event string, args List)(err error){
-	return c.send(Map{
+func termEventPacket(tid int, event string, args List)(Map){
+	return Map{
 		"type": "term_event",
 		"term": tid,
 		"event": event,
 		"args": args,
-	})
+	}
+}
+
+func (c *Conn)FireEventOnTerm(tid int, event string, args List)(err error){
+	return c.send(termEventPacket(tid, event, args))
 }
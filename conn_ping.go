@@ -0,0 +1,121 @@
+
+package main
+
+import (
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+const (
+	defaultPingInterval = 10 * time.Second
+	defaultMaxMissedPongs = 3
+	// pingWindow is how many recent pings are kept for measuring the late pongs
+	pingWindow = 8
+)
+
+// ConnStats is the liveness of a device
+type ConnStats struct {
+	// RTT is the round-trip time of the last ping in milliseconds, nil before the device answered one
+	RTT      *float64  `json:"rtt"`
+	LastSeen time.Time `json:"last_seen"`
+	// Uptime is the seconds since the session started
+	Uptime   int64     `json:"uptime"`
+	// Queue is the write queue of the current socket, nil while the device is offline
+	Queue    *WriteQueueStats `json:"queue,omitempty"`
+}
+
+func (c *Conn)Stats()(s ConnStats){
+	now := time.Now()
+	c.pingMux.Lock()
+	if c.rtt > 0 {
+		rtt := (float64)(c.rtt) / (float64)(time.Millisecond)
+		s.RTT = &rtt
+	}
+	c.pingMux.Unlock()
+	s.LastSeen = time.Unix(0, c.lastSeen.Load()).UTC()
+	s.Uptime = (int64)(now.Sub(c.startedAt) / time.Second)
+	if q := c.queue(); q != nil {
+		qs := q.Stats()
+		s.Queue = &qs
+	}
+	return
+}
+
+func (c *Conn)pingLoop(){
+	interval := c.host.pingInterval
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.ping()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// ping sends a ping to the device, or drops the socket if the device missed too many pongs.
+// Devices that never answered a ping are not dropped, since the older daemons don't send pongs
+func (c *Conn)ping(){
+	// pings are not buffered while the device is offline
+	ws := c.socket()
+	if ws == nil {
+		return
+	}
+	now := time.Now()
+	maxMissed := c.host.maxMissedPongs
+
+	c.pingMux.Lock()
+	if c.pongSupported && maxMissed > 0 && c.missedPongs >= maxMissed {
+		missed := c.missedPongs
+		c.pingMux.Unlock()
+		loger.Warnf("[%s]: Device %d missed %d pongs, closing the connection", c.Addr(), c.id, missed)
+		c.detach(ws)
+		// closing a dead connection waits for the close handshake to time out
+		go ws.Close(websocket.StatusGoingAway, "ping timeout")
+		return
+	}
+	c.pingSeq++
+	seq := c.pingSeq
+	c.pingSent[seq] = now
+	delete(c.pingSent, seq - pingWindow)
+	c.missedPongs++
+	c.pingMux.Unlock()
+
+	q := c.queue()
+	if q == nil {
+		return
+	}
+	q.push(Map{
+		"type": "ping",
+		"data": Map{
+			"seq": seq,
+			"time": now.UnixMilli(),
+		},
+	})
+}
+
+func (c *Conn)onPong(seq int64){
+	now := time.Now()
+	c.pingMux.Lock()
+	defer c.pingMux.Unlock()
+	c.pongSupported = true
+	c.missedPongs = 0
+	if sent, ok := c.pingSent[seq]; ok {
+		c.rtt = now.Sub(sent)
+		delete(c.pingSent, seq)
+	}
+}
+
+// resetPings forgets the pings sent to the previous socket
+func (c *Conn)resetPings(){
+	c.pingMux.Lock()
+	defer c.pingMux.Unlock()
+	c.missedPongs = 0
+	c.pingSent = make(map[int64]time.Time)
+}
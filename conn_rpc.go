@@ -0,0 +1,153 @@
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	defaultRequestTimeout = 30 * time.Second
+	maxRequestTimeout = 5 * time.Minute
+)
+
+var (
+	NoTargetErr = errors.New("No device matches the target")
+	AmbiguousTargetErr = errors.New("More than one device matches the target of the request")
+	CrossHostDisabledErr = errors.New("Cross-host routing is disabled")
+)
+
+type DeviceOfflineErr struct {
+	Host string
+	Id   int64
+}
+
+func (e *DeviceOfflineErr)Error()(string){
+	return fmt.Sprintf("Device %d of %s is offline", e.Id, e.Host)
+}
+
+// RouteFunc returns the host that the device can send packets to, or an error if it's not permitted
+type RouteFunc = func(from *Conn, hostid string)(*HostServer, error)
+
+// peerInfo is the sender of a routed packet as seen by the receiver
+func (c *Conn)peerInfo()(Map){
+	return Map{
+		"host": c.host.id,
+		"conn": c.id,
+		"device": c.device,
+		"label": c.label,
+	}
+}
+
+// resolveTargets returns the devices addressed by the packet data, such as
+// {"host": "other", "to": {"ids": "5"}}. The host is the sender's one if it's empty.
+// The sender is never a target of itself
+func (c *Conn)resolveTargets(dt Map)(conns []*Conn, err error){
+	host := c.host
+	if hostid, _ := dt.GetString("host"); len(hostid) != 0 && hostid != host.id {
+		if host.route == nil {
+			return nil, CrossHostDisabledErr
+		}
+		if host, err = host.route(c, hostid); err != nil {
+			return
+		}
+	}
+	to, ok := dt.GetMap("to")
+	if !ok {
+		return nil, errors.New("Field 'to' is required")
+	}
+	sel, err := ParseDeviceSelector(to)
+	if err != nil {
+		return
+	}
+	for _, t := range host.Select(sel) {
+		if t != c {
+			conns = append(conns, t)
+		}
+	}
+	if len(conns) == 0 {
+		return nil, NoTargetErr
+	}
+	return
+}
+
+// onSend delivers the payload to every target as a message packet.
+// The packets are not buffered for the offline targets, they are reported as delivery errors
+func (c *Conn)onSend(rid int, hasId bool, dt Map){
+	targets, err := c.resolveTargets(dt)
+	if err != nil {
+		if hasId {
+			c.Reply(rid, Map{
+				"status": "error",
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+	msg := Map{
+		"type": "message",
+		"data": Map{
+			"from": c.peerInfo(),
+			"payload": dt["payload"],
+		},
+	}
+	results := eachDevice(targets, 0, func(t *Conn)(any, error){
+		if !t.Online() {
+			return nil, &DeviceOfflineErr{t.host.id, t.id}
+		}
+		return nil, t.send(msg)
+	}, nil)
+	if hasId {
+		c.Reply(rid, Map{
+			"status": "ok",
+			"res": results,
+		})
+	}
+}
+
+// onRequest asks the only target with a request packet, and replies its answer to the sender
+func (c *Conn)onRequest(rid int, dt Map){
+	targets, err := c.resolveTargets(dt)
+	if err == nil && len(targets) > 1 {
+		err = AmbiguousTargetErr
+	}
+	if err == nil && !targets[0].Online() {
+		err = &DeviceOfflineErr{targets[0].host.id, targets[0].id}
+	}
+	if err != nil {
+		c.Reply(rid, Map{
+			"status": "error",
+			"error": err.Error(),
+		})
+		return
+	}
+	target := targets[0]
+	// timeout is in seconds
+	timeout := defaultRequestTimeout
+	if t, ok := dt.GetFloat("timeout"); ok && t > 0 {
+		if timeout = (time.Duration)(t * (float64)(time.Second)); timeout > maxRequestTimeout {
+			timeout = maxRequestTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	defer cancel()
+	res, err := target.AskContext(ctx, "request", Map{
+		"from": c.peerInfo(),
+		"payload": dt["payload"],
+	})
+	if err != nil {
+		c.Reply(rid, Map{
+			"status": failedStatus(err),
+			"error": err.Error(),
+			"conn": target.id,
+		})
+		return
+	}
+	c.Reply(rid, Map{
+		"status": "ok",
+		"conn": target.id,
+		"res": res,
+	})
+}
@@ -0,0 +1,519 @@
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestConnExecContext(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/wsd", &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-CC-Auth": {dtk},
+			"X-CC-Host": {"h1"},
+			"X-CC-ID": {"1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	// the fake device replies the exec of "return 1" and ignores the others
+	packets := make(chan Map, 16)
+	go func(){
+		for {
+			var msg Map
+			if err := wsjson.Read(ctx, ws, &msg); err != nil {
+				close(packets)
+				return
+			}
+			if msg["type"] == "exec" && msg["data"] == "return 1" {
+				wsjson.Write(ctx, ws, Map{
+					"type": "reply",
+					"id": msg["id"],
+					"data": Map{"status": "ok", "res": List{1}},
+				})
+			}
+			packets <- msg
+		}
+	}()
+
+	var conn *Conn
+	for i := 0; conn == nil; i++ {
+		if i > 100 {
+			t.Fatalf("The device is not connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+		if host := h.GetHost("h1"); host != nil {
+			conn = host.GetConn(1)
+		}
+	}
+
+	res, err := conn.ExecContext(ctx, "return 1")
+	if err != nil || len(res) != 1 {
+		t.Fatalf("Expect the exec to succeed, got %v, %v", res, err)
+	}
+
+	ectx, ecancel := context.WithTimeout(ctx, 50 * time.Millisecond)
+	defer ecancel()
+	if _, err = conn.ExecContext(ectx, "while true do end"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expect the exec to time out, got %v", err)
+	}
+	var execId any
+	for msg := range packets {
+		if msg["type"] == "exec" && msg["data"] == "while true do end" {
+			execId = msg["id"]
+		}else if msg["type"] == "cancel" {
+			if msg["id"] != execId {
+				t.Errorf("Expect cancel of request %v, got %v", execId, msg["id"])
+			}
+			break
+		}
+	}
+	conn.askMux.Lock()
+	n := len(conn.asking)
+	conn.askMux.Unlock()
+	// the shell started on connect is still running
+	if n != 1 {
+		t.Errorf("Expect the timed out request to be freed, %d requests are pending", n)
+	}
+}
+
+func TestConnPingTimeout(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	h.SetDevicePing(20 * time.Millisecond, 2)
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/wsd", &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-CC-Auth": {dtk},
+			"X-CC-Host": {"h1"},
+			"X-CC-ID": {"1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	// the fake device answers the first ping only, then hangs
+	answered := make(chan struct{})
+	go func(){
+		pinged := false
+		for {
+			var msg Map
+			if err := wsjson.Read(ctx, ws, &msg); err != nil {
+				return
+			}
+			if msg["type"] == "ping" && !pinged {
+				pinged = true
+				wsjson.Write(ctx, ws, Map{
+					"type": "pong",
+					"data": msg["data"],
+				})
+				close(answered)
+			}
+		}
+	}()
+	select {
+	case <-answered:
+	case <-ctx.Done():
+		t.Fatalf("The device is not pinged")
+	}
+
+	conn := h.GetHost("h1").GetConn(1)
+	for i := 0; conn.Stats().RTT == nil; i++ {
+		if i > 100 {
+			t.Fatalf("Expect the rtt to be measured")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; conn.Online(); i++ {
+		if i > 100 {
+			t.Fatalf("Expect the device to be dropped after missing pongs")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if conn.Context().Err() != nil {
+		t.Errorf("The session should be kept for the resumption")
+	}
+}
+
+func TestFanoutExec(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create token: %v", err)
+	}
+	if err = api.SetRoot(tk, true); err != nil {
+		t.Fatalf("Cannot set root: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	// device 1 replies the exec, device 2 hangs, and device 3 is not selected
+	tags := []string{1: "miner,farm-north", 2: "miner", 3: "farm-north"}
+	for id := 1; id < len(tags); id++ {
+		ws, _, err := websocket.Dial(ctx, wsURL + "/wsd", &websocket.DialOptions{
+			HTTPHeader: http.Header{
+				"X-CC-Auth": {dtk},
+				"X-CC-Host": {"h1"},
+				"X-CC-ID": {strconv.Itoa(id)},
+				"X-CC-Tags": {tags[id]},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Cannot dial: %v", err)
+		}
+		defer ws.Close(websocket.StatusNormalClosure, "")
+		go func(id int){
+			for {
+				var msg Map
+				if err := wsjson.Read(ctx, ws, &msg); err != nil {
+					return
+				}
+				if msg["type"] == "exec" && id == 1 {
+					wsjson.Write(ctx, ws, Map{
+						"type": "reply",
+						"id": msg["id"],
+						"data": Map{"status": "ok", "res": List{id}},
+					})
+				}
+			}
+		}(id)
+	}
+	for i := 0; h.GetHost("h1") == nil || h.GetHost("h1").GetConnCount() != 3; i++ {
+		if i > 100 {
+			t.Fatalf("The devices are not connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cli, _, err := websocket.Dial(ctx, wsURL + "/wscli", &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {tk}},
+	})
+	if err != nil {
+		t.Fatalf("Cannot dial cli: %v", err)
+	}
+	defer cli.Close(websocket.StatusNormalClosure, "")
+	if err = wsjson.Write(ctx, cli, Map{
+		"type": "exec",
+		"id": 1,
+		"data": Map{
+			"host": "h1",
+			"selector": Map{"tags": List{"miner"}},
+			"codes": "return 1",
+			"timeout": 0.1,
+			"concurrency": 1,
+		},
+	}); err != nil {
+		t.Fatalf("Cannot send exec: %v", err)
+	}
+	progress := 0
+	for {
+		var msg Map
+		if err := wsjson.Read(ctx, cli, &msg); err != nil {
+			t.Fatalf("Cannot read reply: %v", err)
+		}
+		if msg["type"] == "exec_progress" {
+			progress++
+			continue
+		}
+		if msg["type"] != "reply" {
+			continue
+		}
+		data, _ := msg["data"].(map[string]any)
+		res, _ := data["res"].(map[string]any)
+		if data["status"] != "ok" || res["total"] != 2.0 || res["succeeded"] != 1.0 || res["failed"] != 1.0 {
+			t.Fatalf("Expect one success and one failure, got %v", data)
+		}
+		results, _ := res["results"].([]any)
+		if r, _ := results[1].(map[string]any); r["conn"] != 2.0 || r["status"] != "timeout" {
+			t.Errorf("Expect device 2 to time out, got %v", r)
+		}
+		break
+	}
+	if progress != 2 {
+		t.Errorf("Expect 2 exec_progress packets, got %d", progress)
+	}
+}
+
+func TestDeviceRPC(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	for _, id := range []string{"h1", "h2"} {
+		if err = api.CreateServer(id); err != nil {
+			t.Fatalf("Cannot create server: %v", err)
+		}
+	}
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	dtk2, err := api.NewDaemonToken("h2", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	h.SetDeviceRoutes(map[string][]string{"h1": {"h2"}})
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	dial := func(token string, host string, id string, label string)(ws *websocket.Conn, packets <-chan Map){
+		ws, _, err := websocket.Dial(ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/wsd", &websocket.DialOptions{
+			HTTPHeader: http.Header{
+				"X-CC-Auth": {token},
+				"X-CC-Host": {host},
+				"X-CC-ID": {id},
+				"X-CC-Label": {label},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Cannot dial: %v", err)
+		}
+		ch := make(chan Map, 16)
+		go func(){
+			defer close(ch)
+			for {
+				var msg Map
+				if err := wsjson.Read(ctx, ws, &msg); err != nil {
+					return
+				}
+				// the storage answers the requests
+				if msg["type"] == "request" && label == "storage" {
+					wsjson.Write(ctx, ws, Map{
+						"type": "reply",
+						"id": msg["id"],
+						"data": Map{"items": 64},
+					})
+				}
+				ch <- msg
+			}
+		}()
+		return ws, ch
+	}
+	readType := func(packets <-chan Map, typ string)(Map){
+		for msg := range packets {
+			if msg["type"] == typ {
+				return msg
+			}
+		}
+		t.Fatalf("Cannot read %s", typ)
+		return nil
+	}
+
+	turtle, tpackets := dial(dtk, "h1", "1", "miner")
+	defer turtle.Close(websocket.StatusNormalClosure, "")
+	storage, spackets := dial(dtk, "h1", "2", "storage")
+	defer storage.Close(websocket.StatusNormalClosure, "")
+	other, opackets := dial(dtk2, "h2", "1", "storage")
+	defer other.Close(websocket.StatusNormalClosure, "")
+	for i := 0; h.GetHost("h1") == nil || h.GetHost("h1").GetConnCount() != 2 || h.GetHost("h2") == nil; i++ {
+		if i > 100 {
+			t.Fatalf("The devices are not connected")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	wsjson.Write(ctx, turtle, Map{
+		"type": "send",
+		"id": 1,
+		"data": Map{"to": Map{"label": "stor*"}, "payload": "hello"},
+	})
+	msg := readType(spackets, "message")
+	if data, _ := msg["data"].(map[string]any); data["payload"] != "hello" {
+		t.Errorf("Expect the message from the turtle, got %v", msg)
+	}
+	if reply := readType(tpackets, "reply"); reply["id"] != 1.0 {
+		t.Errorf("Expect the reply of send, got %v", reply)
+	}
+
+	wsjson.Write(ctx, turtle, Map{
+		"type": "request",
+		"id": 2,
+		"data": Map{"to": Map{"ids": "2"}, "payload": "count"},
+	})
+	reply := readType(tpackets, "reply")
+	data, _ := reply["data"].(map[string]any)
+	res, _ := data["res"].(map[string]any)
+	if reply["id"] != 2.0 || data["status"] != "ok" || res["items"] != 64.0 {
+		t.Errorf("Expect the answer of the storage, got %v", reply)
+	}
+
+	// the route is one-way
+	wsjson.Write(ctx, other, Map{
+		"type": "request",
+		"id": 3,
+		"data": Map{"host": "h1", "to": Map{"label": "storage"}},
+	})
+	reply = readType(opackets, "reply")
+	if data, _ := reply["data"].(map[string]any); data["status"] != "error" {
+		t.Errorf("Expect the cross-host request to be denied, got %v", reply)
+	}
+
+	wsjson.Write(ctx, turtle, Map{
+		"type": "request",
+		"id": 4,
+		"data": Map{"host": "h2", "to": Map{"label": "storage"}},
+	})
+	reply = readType(tpackets, "reply")
+	if data, _ := reply["data"].(map[string]any); data["status"] != "ok" {
+		t.Errorf("Expect the cross-host request to be routed, got %v", reply)
+	}
+
+	other.Close(websocket.StatusGoingAway, "")
+	for i := 0; h.GetHost("h2").GetConn(1).Online(); i++ {
+		if i > 100 {
+			t.Fatalf("The device should be offline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	wsjson.Write(ctx, turtle, Map{
+		"type": "send",
+		"id": 5,
+		"data": Map{"host": "h2", "to": Map{"ids": "1"}},
+	})
+	reply = readType(tpackets, "reply")
+	data, _ = reply["data"].(map[string]any)
+	results, _ := data["res"].([]any)
+	if r, _ := results[0].(map[string]any); len(results) != 1 || r["status"] != "failed" {
+		t.Errorf("Expect the offline target to be a delivery error, got %v", reply)
+	}
+}
+
+func TestDeviceOutbox(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	h.SetOutbox(&OutboxConfig{TTL: 60, MaxMessages: 2})
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+
+	var queued []*QueuedMessage
+	for i := 1; i <= 2; i++ {
+		msg, err := h.SendToDevice("h1", 1, Map{"type": "note", "n": i})
+		if err != nil || msg == nil {
+			t.Fatalf("Expect the packet to be queued, got %v, %v", msg, err)
+		}
+		queued = append(queued, msg)
+	}
+	if _, err := h.SendToDevice("h1", 1, Map{"type": "note", "n": 3}); !errors.Is(err, OutboxLimitErr) {
+		t.Fatalf("Expect the outbox to be full, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/wsd", &websocket.DialOptions{
+		HTTPHeader: http.Header{
+			"X-CC-Auth": {dtk},
+			"X-CC-Host": {"h1"},
+			"X-CC-ID": {"1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	readNote := func()(float64){
+		for {
+			var msg Map
+			if err := wsjson.Read(ctx, ws, &msg); err != nil {
+				t.Fatalf("Cannot read note: %v", err)
+			}
+			if msg["type"] == "note" {
+				n, _ := msg["n"].(float64)
+				return n
+			}
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		if n := readNote(); n != (float64)(i) {
+			t.Fatalf("Expect note %d, got %v", i, n)
+		}
+	}
+	// the new packet is sent after the queued ones
+	if _, err := h.SendToDevice("h1", 1, Map{"type": "note", "n": 3}); err != nil {
+		t.Fatalf("Cannot send to device: %v", err)
+	}
+	if n := readNote(); n != 3 {
+		t.Fatalf("Expect note 3, got %v", n)
+	}
+	for _, m := range queued {
+		msg, err := h.GetMessage(m.Id)
+		if err != nil {
+			t.Fatalf("Cannot get message %d: %v", m.Id, err)
+		}
+		if msg.Status != MessageDelivered || msg.DeliveredAt == nil {
+			t.Errorf("Expect message %d to be delivered, got %s", m.Id, msg.Status)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deviceMeta is a device of a host as shown to the clients,
+// which is either connected or only known from the device registry
+type deviceMeta struct {
+	Id     int64    `json:"id"`
+	Addr   string   `json:"addr"`
+	Device string   `json:"device"`
+	Label  string   `json:"label"`
+	Tags   []string `json:"tags"`
+	// Online is false if the device dropped its socket, or it's not connected at all
+	Online bool `json:"online"`
+	// Connected is false if the device has no live session
+	Connected bool       `json:"connected"`
+	Note      string     `json:"note"`
+	FirstSeen *time.Time `json:"first_seen"`
+	ConnStats
+}
+
+// listHostDevices returns the connected devices of the host and the offline ones in the registry, ordered by id
+func listHostDevices(handler HandlerI, hostid string)(devices []deviceMeta){
+	records, err := handler.ListDevices(hostid)
+	if err != nil {
+		loger.Errorf("Cannot list the devices of %s: %v", hostid, err)
+	}
+	index := make(map[int64]int, len(records))
+	devices = make([]deviceMeta, 0, len(records))
+	for _, r := range records {
+		firstSeen := r.FirstSeen
+		index[r.Id] = len(devices)
+		devices = append(devices, deviceMeta{
+			Id: r.Id,
+			Addr: r.LastAddr,
+			Device: r.Device,
+			Label: r.Label,
+			Note: r.Note,
+			Tags: r.Tags,
+			FirstSeen: &firstSeen,
+			ConnStats: ConnStats{
+				LastSeen: r.LastSeen,
+			},
+		})
+	}
+	if host := handler.GetHost(hostid); host != nil {
+		for _, c := range host.GetConns() {
+			meta := deviceMeta{
+				Id: c.Id(),
+				Addr: c.Addr(),
+				Device: c.Device(),
+				Label: c.Label(),
+				Tags: c.Tags(),
+				Online: c.Online(),
+				Connected: true,
+				ConnStats: c.Stats(),
+			}
+			if i, ok := index[meta.Id]; ok {
+				meta.Note = devices[i].Note
+				meta.FirstSeen = devices[i].FirstSeen
+				devices[i] = meta
+			}else{
+				devices = append(devices, meta)
+			}
+		}
+	}
+	sort.Slice(devices, func(i, j int)(bool){ return devices[i].Id < devices[j].Id })
+	return
+}
+
+// recordDevice saves the device into the registry, the failures are only logged
+func (h *Handler)recordDevice(hostid string, conn *Conn){
+	if err := h.SeenDevice(DeviceRecord{
+		Host: hostid,
+		Id: conn.Id(),
+		Device: conn.Device(),
+		Label: conn.Label(),
+		LastSeen: time.Now(),
+		LastAddr: conn.Addr(),
+	}); err != nil {
+		loger.Errorf("Cannot record device %d of %s: %v", conn.Id(), hostid, err)
+	}
+}
+
+// loadDeviceTags applies the tags that the admins stored in the device registry to the conn
+func (h *Handler)loadDeviceTags(hostid string, conn *Conn){
+	d, err := h.GetDevice(hostid, conn.Id())
+	if err != nil {
+		loger.Errorf("Cannot load tags of device %d of %s: %v", conn.Id(), hostid, err)
+		return
+	}
+	conn.SetAdminTags(d.Tags)
+}
+
+// failedStatus returns the reply status of a request that failed with err
+func failedStatus(err error)(string){
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	return "failed"
+}
+
+// deviceResult is the result of a request on one of the selected devices
+type deviceResult struct {
+	Conn   int64  `json:"conn"`
+	Status string `json:"status"`
+	Res    any    `json:"res,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// eachDevice calls fn on the devices concurrently with at most limit calls at once, limit <= 0 means no limit.
+// onDone is called after each device is done if it's not nil.
+// The results are in the same order as conns
+func eachDevice(conns []*Conn, limit int, fn func(conn *Conn)(res any, err error), onDone func(r deviceResult))(results []deviceResult){
+	results = make([]deviceResult, len(conns))
+	var sem chan struct{}
+	if limit > 0 {
+		sem = make(chan struct{}, limit)
+	}
+	var wg sync.WaitGroup
+	for i, conn := range conns {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		wg.Add(1)
+		go func(r *deviceResult, conn *Conn){
+			defer wg.Done()
+			if sem != nil {
+				defer func(){ <-sem }()
+			}
+			r.Conn = conn.Id()
+			if res, err := fn(conn); err != nil {
+				r.Status = failedStatus(err)
+				r.Error = err.Error()
+			}else{
+				r.Status = "ok"
+				r.Res = res
+			}
+			if onDone != nil {
+				onDone(*r)
+			}
+		}(&results[i], conn)
+	}
+	wg.Wait()
+	return
+}
@@ -2,10 +2,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/kmcsr/cc-ws2/plugin"
 )
@@ -20,22 +25,54 @@ type Handler struct {
 	hostMux sync.RWMutex
 	hosts   map[string]*HostServer
 
+	// brokers are kept apart from the hosts, so the retained values outlive the devices
+	brokerMux sync.Mutex
+	brokers   map[string]*Broker
+
 	cliMux  sync.RWMutex
 	clients map[*CliConn]struct{}
 
 	hookManager *plugin.HookManager
+
+	audit AuditAPI
+
+	tickets *TicketStore
+	limiter *AuthLimiter
+
+	// resumeGrace is how long the session of a dropped device is kept, 0 ends it at once
+	resumeGrace time.Duration
+	pingInterval time.Duration
+	maxMissedPongs int
+	// deviceRoutes are the other hosts that the devices of a host can send packets to
+	deviceRoutes map[string][]string
+	// outbox is the durable outbox of the devices, nil if it's disabled
+	outbox *OutboxConfig
+	cliQueue    WriteQueueConfig
+	deviceQueue WriteQueueConfig
 }
 
 var _ HandlerI = (*Handler)(nil)
 
-func NewHandler(dtapi DataAPI, fsapi FsAPI)(h *Handler){
+// NewHandler creates a handler, audit can be nil to disable the audit log
+func NewHandler(dtapi DataAPI, fsapi FsAPI, audit AuditAPI)(h *Handler){
 	h = &Handler{
 		DataAPI: dtapi,
 		FsAPI: fsapi,
+		audit: audit,
+		tickets: NewTicketStore(defaultTicketTTL),
+		resumeGrace: defaultResumeGrace,
+		pingInterval: defaultPingInterval,
+		maxMissedPongs: defaultMaxMissedPongs,
+		cliQueue: defaultClientWriteQueue,
+		deviceQueue: defaultDeviceWriteQueue,
 		hosts: make(map[string]*HostServer),
+		brokers: make(map[string]*Broker),
 		clients: make(map[*CliConn]struct{}),
 	}
 	h.ctx, h.cancel = context.WithCancel(context.Background())
+	if cached, ok := dtapi.(*CachedDataAPI); ok {
+		cached.OnInvalidate(h.onPermsChanged)
+	}
 	var err error
 	if h.hookManager, err = plugin.NewHookManager(h.ctx, h.newHookAPI); err != nil {
 		loger.Panic(err) // TODO: maybe return err?
@@ -51,17 +88,10 @@ type hookAPI struct {
 var _ plugin.HookAPI = (*hookAPI)(nil)
 
 func (api *hookAPI)FireEvent(ctx context.Context, hostid string, deviceid int64, data map[string]any)(err error){
-	host := api.h.GetHost(hostid)
-	if host == nil {
+	if api.h.outbox == nil && api.h.GetHost(hostid) == nil {
 		return fmt.Errorf("Host %q is not exists", hostid)
 	}
-	conn := host.GetConn(deviceid)
-	if conn == nil {
-		return fmt.Errorf("Device %d is not connected", deviceid)
-	}
-	if err = conn.send((Map)(data)); err != nil {
-		return
-	}
+	_, err = api.h.SendToDevice(hostid, deviceid, (Map)(data))
 	return
 }
 
@@ -80,11 +110,151 @@ func (h *Handler)HookManager()(*plugin.HookManager){
 	return h.hookManager
 }
 
+// StartTokenSweeper removes expired tokens from the database every interval until the handler is closed
+func (h *Handler)StartTokenSweeper(interval time.Duration){
+	go func(){
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				n, err := h.RemoveExpiredTokens()
+				if err != nil {
+					loger.Errorf("Cannot remove expired tokens: %v", err)
+				}else if n > 0 {
+					loger.Infof("Removed %d expired tokens", n)
+				}
+			case <-h.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Audit records a privileged action, the Time and User fields are filled from the token.
+// Failures are only logged, so they never block the action.
+func (h *Handler)Audit(token string, entry AuditEntry){
+	if h.audit == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.Token = maskToken(token)
+	if info, err := h.GetUserInfo(token); err == nil {
+		entry.User = info.Username
+	}
+	if err := h.audit.AddAudit(&entry); err != nil {
+		loger.Errorf("Cannot save audit entry %s by %s: %v", entry.Action, entry.Token, err)
+	}
+}
+
+// auditReq records a privileged action done through the web api
+func (h *Handler)auditReq(req *http.Request, action string, host string, summary any){
+	h.Audit(req.Header.Get("Authorization"), AuditEntry{
+		Action: action,
+		Addr: req.RemoteAddr,
+		Host: host,
+		Summary: auditSummary(summary),
+	})
+}
+
+// SetAuthLimiter enables the rate limit and lockout of the authentication attempts, nil disables them.
+// It must be called before serving
+func (h *Handler)SetAuthLimiter(l *AuthLimiter){
+	h.limiter = l
+	if l != nil {
+		l.OnLockout = func(event LockoutEvent){
+			h.Audit("", AuditEntry{
+				Action: "lockout",
+				Summary: auditSummary(event),
+			})
+		}
+	}
+}
+
+// SetResumeGrace sets how long the session of a dropped device is kept for it to resume.
+// It must be called before serving
+func (h *Handler)SetResumeGrace(d time.Duration){
+	h.resumeGrace = d
+}
+
+// SetDevicePing sets the interval of the pings to the devices,
+// and how many pongs a device can miss before its connection is closed.
+// It must be called before serving
+func (h *Handler)SetDevicePing(interval time.Duration, maxMissed int){
+	h.pingInterval = interval
+	h.maxMissedPongs = maxMissed
+}
+
+// SetDeviceRoutes sets the other hosts that the devices of each host can send packets to,
+// "*" as the source or the target matches every host.
+// It must be called before serving
+func (h *Handler)SetDeviceRoutes(routes map[string][]string){
+	h.deviceRoutes = routes
+}
+
+// SetWriteQueues sets the outbound queues of the client and the device connections,
+// the zero fields are set to the defaults. It must be called before serving
+func (h *Handler)SetWriteQueues(client WriteQueueConfig, device WriteQueueConfig)(err error){
+	if err = client.check(); err != nil {
+		return
+	}
+	if err = device.check(); err != nil {
+		return
+	}
+	h.cliQueue = client.withDefaults(defaultClientWriteQueue)
+	h.deviceQueue = device.withDefaults(defaultDeviceWriteQueue)
+	return
+}
+
+func (h *Handler)canRoute(from string, to string)(bool){
+	for _, src := range []string{from, "*"} {
+		for _, dst := range h.deviceRoutes[src] {
+			if dst == to || dst == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *Handler)newHostServer(id string)(s *HostServer){
+	s = NewHostServer(h.ctx, id)
+	s.resumeGrace = h.resumeGrace
+	s.pingInterval = h.pingInterval
+	s.maxMissedPongs = h.maxMissedPongs
+	s.writeQueue = h.deviceQueue
+	s.route = h.routeDevice
+	s.broker = h.GetBroker(id)
+	return
+}
+
+// GetBroker returns the pub/sub channels of the host, it's created if not exists
+func (h *Handler)GetBroker(id string)(b *Broker){
+	h.brokerMux.Lock()
+	defer h.brokerMux.Unlock()
+	if b = h.brokers[id]; b == nil {
+		b = NewBroker(id)
+		h.brokers[id] = b
+	}
+	return
+}
+
+// routeDevice allows a device to reach the other host only if the route is configured
+func (h *Handler)routeDevice(from *Conn, hostid string)(host *HostServer, err error){
+	if !h.canRoute(from.Host().Id(), hostid) {
+		return nil, fmt.Errorf("Permission denied for host %q", hostid)
+	}
+	if host = h.GetHost(hostid); host == nil {
+		return nil, fmt.Errorf("%w on host %q", NoTargetErr, hostid)
+	}
+	return
+}
+
 func (h *Handler)CreateHost(id string)(s *HostServer){
 	h.hostMux.Lock()
 	defer h.hostMux.Unlock()
 	if _, ok := h.hosts[id]; !ok {
-		s = NewHostServer(h.ctx, id)
+		s = h.newHostServer(id)
 		h.hosts[id] = s
 	}
 	return
@@ -102,7 +272,7 @@ func (h *Handler)getOrCreateHost(id string)(host *HostServer){
 	host, ok = h.hosts[id]
 	h.hostMux.RUnlock()
 	if !ok {
-		host = NewHostServer(h.ctx, id)
+		host = h.newHostServer(id)
 		h.hostMux.Lock()
 		h.hosts[id] = host
 		h.hostMux.Unlock()
@@ -117,6 +287,9 @@ func (h *Handler)removeHost(id string){
 		delete(h.hosts, id)
 	}
 	h.hostMux.Unlock()
+	h.brokerMux.Lock()
+	delete(h.brokers, id)
+	h.brokerMux.Unlock()
 	if ok {
 		host.Destroy()
 	}
@@ -132,6 +305,54 @@ func (h *Handler)GetHosts()(hosts []*HostServer){
 	return
 }
 
+// onPermsChanged refreshes the permission sets of the clients that use the token,
+// and closes the daemon connections whose token is no longer valid.
+// All connections are checked if the token is empty,
+// including the ones authenticated by certificates, which are closed if their host is removed
+func (h *Handler)onPermsChanged(token string){
+	h.cliMux.RLock()
+	clients := make([]*CliConn, 0, 1)
+	for c, _ := range h.clients {
+		if len(token) == 0 || c.token == token {
+			clients = append(clients, c)
+		}
+	}
+	h.cliMux.RUnlock()
+	for _, c := range clients {
+		c.refreshPerms()
+	}
+
+	for _, host := range h.GetHosts() {
+		checked, exists := false, true
+		for _, conn := range host.GetConns() {
+			if len(conn.token) == 0 {
+				if len(token) != 0 {
+					continue
+				}
+				// the certificates are checked in the TLS handshake, but the host can be removed after that
+				if !checked {
+					checked = true
+					var err error
+					if exists, err = h.HasServer(host.Id()); err != nil {
+						loger.Errorf("Cannot check server %q: %v", host.Id(), err)
+						exists = true
+					}
+				}
+				if !exists {
+					go conn.Revoke("Host was removed")
+				}
+				continue
+			}
+			if len(token) != 0 && conn.token != token {
+				continue
+			}
+			if !h.AuthDaemon(conn.token, host.Id()) {
+				go conn.Revoke("Daemon token was removed or expired")
+			}
+		}
+	}
+}
+
 func (h *Handler)BroadcastToClients(event string, data any, except *CliConn){
 	h.cliMux.RLock()
 	defer h.cliMux.RUnlock()
@@ -146,11 +367,16 @@ func (h *Handler)BroadcastToClients(event string, data any, except *CliConn){
 	}
 }
 
-func (h *Handler)BroadcastToClientsWithHost(hostid string, typ string, data any){
+// BroadcastToClientsWithHost sends the event of the device to the clients that can read the host and subscribed to it
+func (h *Handler)BroadcastToClientsWithHost(hostid string, connid int64, typ string, data any){
+	scope := ScopeHostsRead
+	if strings.HasPrefix(typ, "term.") {
+		scope = ScopeTerminalRead
+	}
 	h.cliMux.RLock()
 	defer h.cliMux.RUnlock()
 	for c, _ := range h.clients {
-		if h.CheckPerm(c.token, hostid) {
+		if c.role(hostid) >= RoleViewer && c.hasScope(scope) && c.wantEvent(hostid, connid, typ) {
 			c.send(Map{
 				"type": typ,
 				"host": hostid,
@@ -167,7 +393,7 @@ func (h *Handler)onWsdEvent(host *HostServer, conn *Conn, event string, args Lis
 	hostid := host.Id()
 	if event[0] == '#' { // internal events
 		event = event[1:]
-		h.BroadcastToClientsWithHost(hostid, event, Map{
+		h.BroadcastToClientsWithHost(hostid, conn.Id(), event, Map{
 			"conn": conn.Id(),
 			"args": args,
 		})
@@ -188,7 +414,7 @@ func (h *Handler)onWsdEvent(host *HostServer, conn *Conn, event string, args Lis
 		}
 		return
 	}
-	h.BroadcastToClientsWithHost(hostid, "device_event", Map{
+	h.BroadcastToClientsWithHost(hostid, conn.Id(), "device_event", Map{
 		"conn": conn.Id(),
 		"event": event,
 		"args": args,
@@ -206,32 +432,62 @@ func (h *Handler)serveWsd(rw http.ResponseWriter, req *http.Request){
 	)
 	authTk = req.Header.Get("X-CC-Auth")
 	remoteHost = req.Header.Get("X-CC-Host")
-	if !h.AuthDaemon(authTk, remoteHost) {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) != 0 {
+		authTk = ""
+		// the daemon is authenticated by its client certificate, which is already verified in the handshake
+		var ok bool
+		if remoteHost, ok = certHostId(req.TLS.VerifiedChains[0][0], remoteHost); !ok {
+			loger.Warnf("[%s] Daemon certificate %s does not match host %q", remoteAddr,
+				formatSerial(req.TLS.VerifiedChains[0][0].SerialNumber), req.Header.Get("X-CC-Host"))
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(rw, "401 Unauthorized")
+			return
+		}
+		// the certificate outlives the server, so the server must still be registered
+		if ok, err = h.HasServer(remoteHost); err != nil {
+			loger.Errorf("Cannot check server %q: %v", remoteHost, err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}else if !ok {
+			loger.Warnf("[%s] Daemon certificate of removed host %q is rejected", remoteAddr, remoteHost)
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(rw, "401 Unauthorized")
+			return
+		}
+	}else if !h.AuthDaemon(authTk, remoteHost) {
 		rw.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprintf(rw, "401 Unauthorized")
 		return
 	}
 	host := h.getOrCreateHost(remoteHost)
 
-	conn, err := host.AcceptConn(rw, req)
+	conn, resumed, err := host.AcceptConn(authTk, rw, req)
 	if err != nil {
 		loger.Errorf("Error when accepting [%s]: %v", remoteAddr, err)
 		return
 	}
-	conn.OnEvent = func(conn *Conn, event string, args List){
-		h.onWsdEvent(host, conn, event, args)
-	}
-	h.BroadcastToClientsWithHost(remoteHost, "device_join", Map{
-		"conn": conn.Id(),
-		"addr": conn.Addr(),
-		"device": conn.Device(),
-		"label": conn.Label(),
-	})
-	defer func(){
-		h.BroadcastToClientsWithHost(remoteHost, "device_leave", Map{
+	h.recordDevice(remoteHost, conn)
+	h.loadDeviceTags(remoteHost, conn)
+	go h.flushOutbox(remoteHost, conn)
+	if !resumed {
+		conn.OnEvent = func(conn *Conn, event string, args List){
+			h.onWsdEvent(host, conn, event, args)
+		}
+		h.BroadcastToClientsWithHost(remoteHost, conn.Id(), "device_join", Map{
 			"conn": conn.Id(),
+			"addr": conn.Addr(),
+			"device": conn.Device(),
+			"label": conn.Label(),
 		})
-	}()
+		// the device leaves when its session ends, not when a socket is dropped
+		go func(){
+			<-conn.Context().Done()
+			h.recordDevice(remoteHost, conn)
+			h.BroadcastToClientsWithHost(remoteHost, conn.Id(), "device_leave", Map{
+				"conn": conn.Id(),
+			})
+		}()
+	}
 	conn.Handle()
 }
 
@@ -239,18 +495,13 @@ func (h *Handler)serveWscli(rw http.ResponseWriter, req *http.Request){
 	remoteAddr := req.RemoteAddr
 	loger.Tracef("[%s] (a client) connecting with: %v", remoteAddr, req.Header)
 
-	var (
-		authTk string
-		err error
-	)
-	que := req.URL.Query()
-	authTk = que.Get("authTk")
-	if !h.AuthCli(authTk) {
+	authTk, ok := h.authStream(req, TicketWscli)
+	if !ok {
 		rw.WriteHeader(http.StatusUnauthorized)
 		fmt.Fprintf(rw, "401 Unauthorized")
 		return
 	}
-	conn, err := AcceptCliConn(h, authTk, rw, req)
+	conn, err := AcceptCliConn(h, authTk, h.cliQueue, rw, req)
 	if err != nil {
 		loger.Errorf("Error when accepting cli [%s]: %v", remoteAddr, err)
 		return
@@ -266,14 +517,141 @@ func (h *Handler)serveWscli(rw http.ResponseWriter, req *http.Request){
 	conn.Handle()
 }
 
+// authStream returns the cli token of a streaming request.
+// The token comes from the single-use `ticket` query issued by /api/ticket,
+// or the Authorization header for the clients that can set it.
+// The `authTk` query is still accepted, but it leaks the token into the logs
+func (h *Handler)authStream(req *http.Request, purpose string)(token string, ok bool){
+	que := req.URL.Query()
+	if ticket := que.Get("ticket"); len(ticket) != 0 {
+		if token, ok = h.tickets.Redeem(ticket, purpose); !ok {
+			return "", false
+		}
+	}else if token = req.Header.Get("Authorization"); len(token) == 0 {
+		if token = que.Get("authTk"); len(token) != 0 {
+			loger.Warnf("[%s] Passing the token by `authTk` is deprecated, please use a ticket from /api/ticket", req.RemoteAddr)
+		}
+	}
+	// the token may be removed after the ticket is issued
+	if !h.AuthCli(token) {
+		return "", false
+	}
+	return token, true
+}
+
 func (h *Handler)NewServeMux()(mux *http.ServeMux){
 	mux = http.NewServeMux()
 	mux.Handle("/main/", webAssetsHandler)
-	mux.Handle("/api/", http.StripPrefix("/api", h.newApiMux()))
-	mux.HandleFunc("/wscli", h.serveWscli)
-	mux.HandleFunc("/wsd", h.serveWsd)
+	mux.Handle("/api/", h.limitAuth(http.StripPrefix("/api", h.newApiMux())))
+	mux.Handle("/wscli", h.limitAuth((http.HandlerFunc)(h.serveWscli)))
+	mux.Handle("/wsd", h.limitAuth((http.HandlerFunc)(h.serveWsd)))
 	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request){
 		http.NotFound(rw, req)
 	})
 	return
 }
+
+// requestCredential returns the credential that the request is trying to authenticate with
+func requestCredential(req *http.Request)(string){
+	if tk := req.Header.Get("Authorization"); len(tk) != 0 {
+		return tk
+	}
+	if tk := req.Header.Get("X-CC-Auth"); len(tk) != 0 {
+		return tk
+	}
+	que := req.URL.Query()
+	if tk := que.Get("ticket"); len(tk) != 0 {
+		return tk
+	}
+	return que.Get("authTk")
+}
+
+// limitAuth rejects the requests from the ips and tokens that are locked out or sending too fast,
+// and reports the result of the authentication to the limiter by the response status
+func (h *Handler)limitAuth(next http.Handler)(http.Handler){
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){
+		if h.limiter == nil {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		token := requestCredential(req)
+		isLogin := req.URL.Path == "/api/login"
+		// the requests without any credential do not touch the tokens
+		if len(token) == 0 && !isLogin {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		ip := h.limiter.ClientIP(req)
+		if err := h.limiter.Allow(ip, token); err != nil {
+			var retry time.Duration
+			if le, ok := err.(*AuthLimitedErr); ok {
+				retry = le.RetryAfter
+			}
+			secs := (int)((retry + time.Second - 1) / time.Second)
+			rw.Header().Set("Retry-After", strconv.Itoa(secs))
+			writeJson(rw, http.StatusTooManyRequests, Map{
+				"status": "error",
+				"error": err.Error(),
+				"retry_after": secs,
+			})
+			return
+		}
+		srw := &statusResponseWriter{ResponseWriter: rw}
+		next.ServeHTTP(srw, req)
+		switch {
+		case srw.status == http.StatusUnauthorized:
+			// a valid token without the permission is not a failed guess
+			failed := isLogin || !strings.HasPrefix(req.URL.Path, "/api/") || !h.AuthCli(token)
+			if failed {
+				h.limiter.Done(ip, token, false)
+			}
+		case srw.status != 0 && srw.status < 400:
+			h.limiter.Done(ip, token, true)
+		}
+	})
+}
+
+func remoteIP(addr string)(string){
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// statusResponseWriter remembers the status code, and still supports the websocket upgrade
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusResponseWriter)WriteHeader(status int){
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter)Write(buf []byte)(int, error){
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *statusResponseWriter)Flush(){
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusResponseWriter)Hijack()(net.Conn, *bufio.ReadWriter, error){
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijack", w.ResponseWriter)
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return hj.Hijack()
+}
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (h *Handler)newApiMux()(mux *http.ServeMux){
@@ -21,15 +23,36 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	})
 	mux.HandleFunc("/create_token", func(rw http.ResponseWriter, req *http.Request){
 		token := req.Header.Get("Authorization")
-		if !h.CheckRootToken(token) {
+		if !h.checkAdmin(token) {
 			writeUnauth(rw)
 			return
 		}
-		tk, err := h.NewCliToken(nil) // TODO: exp time
+		exp, err := parseExpiration(req)
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		scopes, err := parseScopes(req.FormValue("scopes"))
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		tk, err := h.NewCliToken(exp)
 		if err != nil {
 			writeInternalError(rw, err)
 			return
 		}
+		if len(scopes) != 0 {
+			if err = h.SetScopes(tk, scopes); err != nil {
+				// a token without scopes is unlimited, so it must not be left behind
+				if er := h.RemoveCliToken(tk); er != nil {
+					loger.Errorf("Cannot remove token %s after failing to set its scopes: %v", maskToken(tk), er)
+				}
+				writeInternalError(rw, err)
+				return
+			}
+		}
+		h.auditReq(req, "create_token", "", Map{"token": maskToken(tk), "expiration": exp, "scopes": scopes})
 		writeJson(rw, http.StatusOK, Map{
 			"status": "ok",
 			"token": tk,
@@ -37,7 +60,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	})
 	mux.HandleFunc("/remove_token", func(rw http.ResponseWriter, req *http.Request){
 		rtToken := req.Header.Get("Authorization")
-		if !h.CheckRootToken(rtToken) {
+		if !h.checkAdmin(rtToken) {
 			writeUnauth(rw)
 			return
 		}
@@ -47,23 +70,30 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 			writeInternalError(rw, err)
 			return
 		}
+		h.auditReq(req, "remove_token", "", Map{"token": maskToken(token)})
 		writeJson(rw, http.StatusOK, Map{
 			"status": "ok",
 		})
 	})
 	mux.HandleFunc("/create_daemon_token", func(rw http.ResponseWriter, req *http.Request){
 		token := req.Header.Get("Authorization")
-		if !h.CheckRootToken(token) {
+		if !h.checkAdmin(token) {
 			writeUnauth(rw)
 			return
 		}
 		values := req.URL.Query()
 		server := values.Get("server")
-		tk, err := h.NewDaemonToken(server, nil) // TODO: exp time
+		exp, err := parseExpiration(req)
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		tk, err := h.NewDaemonToken(server, exp)
 		if err != nil {
 			writeInternalError(rw, err)
 			return
 		}
+		h.auditReq(req, "create_daemon_token", server, Map{"token": maskToken(tk), "expiration": exp})
 		writeJson(rw, http.StatusOK, Map{
 			"status": "ok",
 			"token": tk,
@@ -71,7 +101,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	})
 	mux.HandleFunc("/remove_daemon_token", func(rw http.ResponseWriter, req *http.Request){
 		rtToken := req.Header.Get("Authorization")
-		if !h.CheckRootToken(rtToken) {
+		if !h.checkAdmin(rtToken) {
 			writeUnauth(rw)
 			return
 		}
@@ -81,13 +111,392 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 			writeInternalError(rw, err)
 			return
 		}
+		h.auditReq(req, "remove_daemon_token", "", Map{"token": maskToken(token)})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/token_expiration", func(rw http.ResponseWriter, req *http.Request){
+		rtToken := req.Header.Get("Authorization")
+		if !h.checkAdmin(rtToken) {
+			writeUnauth(rw)
+			return
+		}
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token := req.FormValue("token")
+		exp, err := parseExpiration(req)
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		if exp == nil && req.FormValue("never") != "true" {
+			writeBadRequest(rw, errors.New("One of `ttl`, `expiration` or `never=true` is required"))
+			return
+		}
+		if _, ok := preProcessDaemonToken(token); ok {
+			err = h.SetDaemonTokenExpiration(token, exp)
+		}else{
+			err = h.SetCliTokenExpiration(token, exp)
+		}
+		if err != nil {
+			if errors.Is(err, TokenNotExistsErr) {
+				writeJson(rw, http.StatusNotFound, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				return
+			}
+			writeInternalError(rw, err)
+			return
+		}
+		h.auditReq(req, "token_expiration", "", Map{"token": maskToken(token), "expiration": exp})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"expiration": exp,
+		})
+	})
+	mux.HandleFunc("/token_scopes", func(rw http.ResponseWriter, req *http.Request){
+		rtToken := req.Header.Get("Authorization")
+		token := req.FormValue("token")
+		switch req.Method {
+		case "GET":
+			// a token can always see its own scopes
+			if !h.checkSelfOrAdmin(rtToken, token) {
+				writeUnauth(rw)
+				return
+			}
+			scopes, err := h.GetScopes(token)
+			if err != nil {
+				writeApiError(rw, err)
+				return
+			}
+			if scopes == nil {
+				scopes = make([]string, 0)
+			}
+			writeJson(rw, http.StatusOK, Map{
+				"status": "ok",
+				"data": scopes,
+			})
+		case "POST":
+			if !h.checkAdmin(rtToken) {
+				writeUnauth(rw)
+				return
+			}
+			scopes, err := parseScopes(req.FormValue("scopes"))
+			if err != nil {
+				writeBadRequest(rw, err)
+				return
+			}
+			if err = h.SetScopes(token, scopes); err != nil {
+				writeApiError(rw, err)
+				return
+			}
+			h.auditReq(req, "token_scopes", "", Map{"token": maskToken(token), "scopes": scopes})
+			writeJson(rw, http.StatusOK, Map{
+				"status": "ok",
+			})
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/login", func(rw http.ResponseWriter, req *http.Request){
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := readJsonBody(req, &body); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		if err := checkUserPassword(h, body.Username, body.Password); err != nil {
+			if errors.Is(err, InvalidCredentialErr) {
+				loger.Infof("[%s] Failed login attempt for user %q", req.RemoteAddr, body.Username)
+				h.Audit("", AuditEntry{
+					Action: "login_failed",
+					User: body.Username,
+					Addr: req.RemoteAddr,
+				})
+				writeJson(rw, http.StatusUnauthorized, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				return
+			}
+			writeInternalError(rw, err)
+			return
+		}
+		exp := time.Now().Add((time.Duration)(config.LoginTokenTTL) * time.Second).UTC()
+		tk, err := h.NewUserToken(body.Username, &exp)
+		if err != nil {
+			writeInternalError(rw, err)
+			return
+		}
+		loger.Infof("[%s] User %q logged in", req.RemoteAddr, body.Username)
+		h.Audit(tk, AuditEntry{
+			Action: "login",
+			User: body.Username,
+			Addr: req.RemoteAddr,
+		})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"token": tk,
+			"expiration": exp,
+		})
+	})
+	mux.HandleFunc("/ticket", func(rw http.ResponseWriter, req *http.Request){
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		token := req.Header.Get("Authorization")
+		if !h.AuthCli(token) {
+			writeUnauth(rw)
+			return
+		}
+		purpose := req.FormValue("for")
+		if len(purpose) == 0 {
+			purpose = TicketWscli
+		}
+		if !isValidTicketPurpose(purpose) {
+			writeBadRequest(rw, fmt.Errorf("Unknown ticket purpose %q", purpose))
+			return
+		}
+		ticket, exp, err := h.tickets.Issue(token, purpose)
+		if err != nil {
+			writeInternalError(rw, err)
+			return
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"ticket": ticket,
+			"expiration": exp.UTC(),
+		})
+	})
+	mux.HandleFunc("/logout", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.AuthCli(token) {
+			writeUnauth(rw)
+			return
+		}
+		info, err := h.GetUserInfo(token)
+		if err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		// the root and the service tokens are not issued by login, so they cannot be revoked by logging out
+		if !info.IsUser {
+			writeJson(rw, http.StatusForbidden, Map{
+				"status": "error",
+				"error": "Only the tokens of the users can log out",
+			})
+			return
+		}
+		if err = h.RemoveCliToken(token); err != nil {
+			writeInternalError(rw, err)
+			return
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/users", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		users, err := h.ListUsers()
+		if err != nil {
+			writeInternalError(rw, err)
+			return
+		}
+		if users == nil {
+			users = make([]User, 0)
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"data": users,
+		})
+	})
+	mux.HandleFunc("/create_user", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := readJsonBody(req, &body); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		if err := checkUsername(body.Username); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		var hash string
+		if len(body.Password) != 0 {
+			var err error
+			if hash, err = hashPassword(body.Password); err != nil {
+				writeBadRequest(rw, err)
+				return
+			}
+		}
+		if err := h.CreateUser(body.Username, hash); err != nil {
+			if errors.Is(err, UserExistsErr) {
+				writeJson(rw, http.StatusConflict, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				return
+			}
+			writeInternalError(rw, err)
+			return
+		}
+		h.auditReq(req, "create_user", "", Map{"username": body.Username})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/remove_user", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		username := req.FormValue("username")
+		if err := h.RemoveUser(username); err != nil {
+			if errors.Is(err, UserNotExistsErr) {
+				writeJson(rw, http.StatusNotFound, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				return
+			}
+			writeInternalError(rw, err)
+			return
+		}
+		h.auditReq(req, "remove_user", "", Map{"username": username})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/user_password", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.AuthCli(token) {
+			writeUnauth(rw)
+			return
+		}
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var body struct {
+			Username    string `json:"username"`
+			Password    string `json:"password"`
+			OldPassword string `json:"old_password"`
+		}
+		if err := readJsonBody(req, &body); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		// non-root users can only change their own password with the old one
+		if !h.checkAdmin(token) {
+			info, err := h.GetUserInfo(token)
+			if err != nil || info.Username != body.Username {
+				writeUnauth(rw)
+				return
+			}
+			if err = checkUserPassword(h, body.Username, body.OldPassword); err != nil {
+				writeUnauth(rw)
+				return
+			}
+		}
+		var hash string
+		if len(body.Password) != 0 {
+			var err error
+			if hash, err = hashPassword(body.Password); err != nil {
+				writeBadRequest(rw, err)
+				return
+			}
+		}
+		if err := h.SetUserPassword(body.Username, hash); err != nil {
+			if errors.Is(err, UserNotExistsErr) {
+				writeJson(rw, http.StatusNotFound, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				return
+			}
+			writeInternalError(rw, err)
+			return
+		}
+		h.auditReq(req, "user_password", "", Map{"username": body.Username})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/create_user_token", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		username := req.FormValue("username")
+		exp, err := parseExpiration(req)
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		scopes, err := parseScopes(req.FormValue("scopes"))
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		tk, err := h.NewUserToken(username, exp)
+		if err != nil {
+			if errors.Is(err, UserNotExistsErr) {
+				writeJson(rw, http.StatusNotFound, Map{
+					"status": "error",
+					"error": err.Error(),
+				})
+				return
+			}
+			writeInternalError(rw, err)
+			return
+		}
+		if len(scopes) != 0 {
+			if err = h.SetScopes(tk, scopes); err != nil {
+				// a token without scopes is unlimited, so it must not be left behind
+				if er := h.RemoveCliToken(tk); er != nil {
+					loger.Errorf("Cannot remove token %s after failing to set its scopes: %v", maskToken(tk), er)
+				}
+				writeInternalError(rw, err)
+				return
+			}
+		}
+		h.auditReq(req, "create_user_token", "", Map{"username": username, "token": maskToken(tk), "expiration": exp, "scopes": scopes})
 		writeJson(rw, http.StatusOK, Map{
 			"status": "ok",
+			"token": tk,
 		})
 	})
 	mux.HandleFunc("/create_server", func(rw http.ResponseWriter, req *http.Request){
 		token := req.Header.Get("Authorization")
-		if !h.CheckRootToken(token) {
+		if !h.checkAdmin(token) {
 			writeUnauth(rw)
 			return
 		}
@@ -97,13 +506,14 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 			writeInternalError(rw, err)
 			return
 		}
+		h.auditReq(req, "create_server", sid, nil)
 		writeJson(rw, http.StatusOK, Map{
 			"status": "ok",
 		})
 	})
 	mux.HandleFunc("/remove_server", func(rw http.ResponseWriter, req *http.Request){
 		token := req.Header.Get("Authorization")
-		if !h.CheckRootToken(token) {
+		if !h.checkAdmin(token) {
 			writeUnauth(rw)
 			return
 		}
@@ -114,13 +524,14 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 			return
 		}
 		h.removeHost(sid)
+		h.auditReq(req, "remove_server", sid, nil)
 		writeJson(rw, http.StatusOK, Map{
 			"status": "ok",
 		})
 	})
 	mux.HandleFunc("/tokens", func(rw http.ResponseWriter, req *http.Request){
 		token := req.Header.Get("Authorization")
-		if !h.CheckRootToken(token) {
+		if !h.checkAdmin(token) {
 			writeUnauth(rw)
 			return
 		}
@@ -139,7 +550,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	})
 	mux.HandleFunc("/daemon_tokens", func(rw http.ResponseWriter, req *http.Request){
 		token := req.Header.Get("Authorization")
-		if !h.CheckRootToken(token) {
+		if !h.checkAdmin(token) {
 			writeUnauth(rw)
 			return
 		}
@@ -158,7 +569,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	})
 	mux.HandleFunc("/perm_root", func(rw http.ResponseWriter, req *http.Request){
 		rtToken := req.Header.Get("Authorization")
-		if !h.CheckRootToken(rtToken) {
+		if !h.checkAdmin(rtToken) {
 			writeUnauth(rw)
 			return
 		}
@@ -193,6 +604,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 				writeInternalError(rw, err)
 				return
 			}
+			h.auditReq(req, "perm_root", "", Map{"token": maskToken(token), "value": value})
 			writeJson(rw, http.StatusOK, Map{
 				"status": "ok",
 			})
@@ -202,7 +614,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	})
 	mux.HandleFunc("/perm_server", func(rw http.ResponseWriter, req *http.Request){
 		rtToken := req.Header.Get("Authorization")
-		if !h.CheckRootToken(rtToken) {
+		if !h.checkAdmin(rtToken) {
 			writeUnauth(rw)
 			return
 		}
@@ -231,6 +643,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 				writeInternalError(rw, err)
 				return
 			}
+			h.auditReq(req, "perm_server", id, Map{"token": maskToken(token), "value": value})
 			writeJson(rw, http.StatusOK, Map{
 				"status": "ok",
 			})
@@ -239,11 +652,19 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 		}
 	})
 	mux.HandleFunc("/perm_servers", func(rw http.ResponseWriter, req *http.Request){
-		values := req.URL.Query()
-		token := values.Get("token")
+		rtToken := req.Header.Get("Authorization")
+		token := req.URL.Query().Get("token")
+		if len(token) == 0 {
+			token = rtToken
+		}
+		// a token can always list its own servers
+		if !h.checkSelfOrAdmin(rtToken, token) {
+			writeUnauth(rw)
+			return
+		}
 		servers, err := h.ListServers(token)
 		if err != nil {
-			writeInternalError(rw, err)
+			writeApiError(rw, err)
 			return
 		}
 		if servers == nil {
@@ -254,6 +675,254 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 			"data": servers,
 		})
 	})
+	mux.HandleFunc("/grants", func(rw http.ResponseWriter, req *http.Request){
+		rtToken := req.Header.Get("Authorization")
+		token := req.FormValue("token")
+		// a token can always see its own grants
+		if !h.checkSelfOrAdmin(rtToken, token) {
+			writeUnauth(rw)
+			return
+		}
+		grants, err := h.ListGrants(token)
+		if err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		if grants == nil {
+			grants = make([]HostGrant, 0)
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"data": grants,
+		})
+	})
+	mux.HandleFunc("/grant", func(rw http.ResponseWriter, req *http.Request){
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rtToken := req.Header.Get("Authorization")
+		values := req.URL.Query()
+		token := values.Get("token")
+		pattern := values.Get("pattern")
+		if !h.checkAdmin(rtToken) {
+			// host admins can manage the roles on their own hosts, but not on patterns
+			if isHostPattern(pattern) || h.GetRole(rtToken, pattern) < RoleAdmin || !checkScope(h, rtToken, ScopeAdmin) {
+				writeUnauth(rw)
+				return
+			}
+		}
+		var role Role
+		if err := readJsonBody(req, &role); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		if err := h.SetGrant(token, pattern, role); err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		h.auditReq(req, "grant", pattern, Map{"token": maskToken(token), "role": role})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/groups", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		groups, err := h.ListGroups()
+		if err != nil {
+			writeInternalError(rw, err)
+			return
+		}
+		if groups == nil {
+			groups = make([]Group, 0)
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"data": groups,
+		})
+	})
+	mux.HandleFunc("/create_group", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		name := req.FormValue("name")
+		if err := checkUsername(name); err != nil {
+			writeBadRequest(rw, fmt.Errorf("Invalid group name: %w", err))
+			return
+		}
+		if err := h.CreateGroup(name); err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		h.auditReq(req, "create_group", "", Map{"group": name})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/remove_group", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		name := req.FormValue("name")
+		if err := h.RemoveGroup(name); err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		h.auditReq(req, "remove_group", "", Map{"group": name})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/group_member", func(rw http.ResponseWriter, req *http.Request){
+		rtToken := req.Header.Get("Authorization")
+		if !h.checkAdmin(rtToken) {
+			writeUnauth(rw)
+			return
+		}
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		values := req.URL.Query()
+		var value bool
+		if err := readJsonBody(req, &value); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		group, token := values.Get("group"), values.Get("token")
+		if err := h.SetGroupMember(group, token, value); err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		h.auditReq(req, "group_member", "", Map{"group": group, "token": maskToken(token), "value": value})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/group_grant", func(rw http.ResponseWriter, req *http.Request){
+		rtToken := req.Header.Get("Authorization")
+		if !h.checkAdmin(rtToken) {
+			writeUnauth(rw)
+			return
+		}
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		values := req.URL.Query()
+		var role Role
+		if err := readJsonBody(req, &role); err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		group, pattern := values.Get("group"), values.Get("pattern")
+		if err := h.SetGroupGrant(group, pattern, role); err != nil {
+			writeApiError(rw, err)
+			return
+		}
+		h.auditReq(req, "group_grant", pattern, Map{"group": group, "role": role})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
+	mux.HandleFunc("/audit", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		if h.audit == nil {
+			writeJson(rw, http.StatusNotFound, Map{
+				"status": "error",
+				"error": "Audit log is disabled",
+			})
+			return
+		}
+		filter, err := parseAuditFilter(req)
+		if err != nil {
+			writeBadRequest(rw, err)
+			return
+		}
+		entries, total, err := h.audit.QueryAudit(filter)
+		if err != nil {
+			writeInternalError(rw, err)
+			return
+		}
+		if entries == nil {
+			entries = make([]AuditEntry, 0)
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"total": total,
+			"data": entries,
+		})
+	})
+	mux.HandleFunc("/lockouts", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		active, recent := make([]LockoutEvent, 0), make([]LockoutEvent, 0)
+		if h.limiter != nil {
+			a, r := h.limiter.Lockouts()
+			active = append(active, a...)
+			recent = append(recent, r...)
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"enabled": h.limiter != nil,
+			"active": active,
+			"recent": recent,
+		})
+	})
+	mux.HandleFunc("/write_queues", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		conns, total := h.WriteQueueMetrics()
+		if conns == nil {
+			conns = make([]ConnQueueMetric, 0)
+		}
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+			"total": total,
+			"data": conns,
+		})
+	})
+	mux.HandleFunc("/unlock", func(rw http.ResponseWriter, req *http.Request){
+		token := req.Header.Get("Authorization")
+		if !h.checkAdmin(token) {
+			writeUnauth(rw)
+			return
+		}
+		if req.Method != "POST" {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		key := req.FormValue("key")
+		if h.limiter == nil || !h.limiter.Unlock(key) {
+			writeJson(rw, http.StatusNotFound, Map{
+				"status": "error",
+				"error": "Key is not locked",
+			})
+			return
+		}
+		h.auditReq(req, "unlock", "", Map{"key": key})
+		writeJson(rw, http.StatusOK, Map{
+			"status": "ok",
+		})
+	})
 	mux.HandleFunc("/web_plugin", func(rw http.ResponseWriter, req *http.Request){
 		var err error
 		
@@ -274,7 +943,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 			})
 		case "POST": // Update plugin metadata
 			token := req.Header.Get("Authorization")
-			if !h.CheckRootToken(token) {
+			if !h.CheckRootToken(token) || !checkScope(h, token, ScopePluginsWrite) {
 				writeUnauth(rw)
 				return
 			}
@@ -293,6 +962,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 					writeInternalError(rw, err)
 					return
 				}
+				h.auditReq(req, "create_plugin", "", meta.WebScriptId)
 				writeJson(rw, http.StatusOK, Map{
 					"status": "ok",
 				})
@@ -309,6 +979,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 					writeInternalError(rw, err)
 					return
 				}
+				h.auditReq(req, "delete_plugin", "", pid)
 				writeJson(rw, http.StatusOK, Map{
 					"status": "ok",
 				})
@@ -338,6 +1009,10 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 				"data": scripts,
 			})
 		case "POST":
+			if !checkScope(h, token, ScopePluginsWrite) {
+				writeUnauth(rw)
+				return
+			}
 			var plugin WebScriptId
 			if err := readJsonBody(req, &plugin); err != nil {
 				writeJson(rw, http.StatusBadRequest, Map{
@@ -350,16 +1025,22 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 				writeInternalError(rw, err)
 				return
 			}
+			h.auditReq(req, "add_cli_plugin", "", plugin)
 			writeJson(rw, http.StatusOK, Map{
 				"status": "ok",
 			})
 		case "DELETE":
+			if !checkScope(h, token, ScopePluginsWrite) {
+				writeUnauth(rw)
+				return
+			}
 			values := req.URL.Query()
 			plugin := values.Get("plugin")
 			if err := h.DelCliWebScript(token, plugin); err != nil {
 				writeInternalError(rw, err)
 				return
 			}
+			h.auditReq(req, "remove_cli_plugin", "", Map{"plugin": plugin})
 			writeJson(rw, http.StatusOK, Map{
 				"status": "ok",
 			})
@@ -437,7 +1118,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 		case "PUT": // Write plugin file
 			defer req.Body.Close()
 			token := req.Header.Get("Authorization")
-			if !h.CheckRootToken(token) {
+			if !h.CheckRootToken(token) || !checkScope(h, token, ScopePluginsWrite) {
 				writeUnauth(rw)
 				return
 			}
@@ -454,12 +1135,13 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 				writeInternalError(rw, err)
 				return
 			}
+			h.auditReq(req, "put_plugin_file", "", Map{"plugin": id, "path": path})
 			writeJson(rw, http.StatusOK, Map{
 				"status": "ok",
 			})
 		case "DELETE": // Remove plugin file
 			token := req.Header.Get("Authorization")
-			if !h.CheckRootToken(token) {
+			if !h.CheckRootToken(token) || !checkScope(h, token, ScopePluginsWrite) {
 				writeUnauth(rw)
 				return
 			}
@@ -476,6 +1158,7 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 				writeInternalError(rw, err)
 				return
 			}
+			h.auditReq(req, "delete_plugin_file", "", Map{"plugin": id, "path": path})
 			writeJson(rw, http.StatusOK, Map{
 				"status": "ok",
 			})
@@ -486,6 +1169,128 @@ func (h *Handler)newApiMux()(mux *http.ServeMux){
 	return
 }
 
+// checkAdmin reports whether the token is a root token that is allowed to manage the server
+func (h *Handler)checkAdmin(token string)(bool){
+	return h.CheckRootToken(token) && checkScope(h, token, ScopeAdmin)
+}
+
+// checkSelfOrAdmin reports whether rtToken can read the data of token.
+// A valid token can always read its own data, and an unknown one is unauthorized instead of not found
+func (h *Handler)checkSelfOrAdmin(rtToken string, token string)(bool){
+	if rtToken == token {
+		return h.AuthCli(token)
+	}
+	return h.checkAdmin(rtToken)
+}
+
+// parseExpiration reads the optional expiration of a token from the request.
+// `ttl` can be a duration such as "72h" or a number of seconds,
+// `expiration` can be a RFC3339 time or an unix timestamp.
+// exp will be nil if both of them are not given
+func parseExpiration(req *http.Request)(exp *time.Time, err error){
+	if ttl := req.FormValue("ttl"); len(ttl) != 0 {
+		var dur time.Duration
+		if n, er := strconv.ParseInt(ttl, 10, 64); er == nil {
+			dur = (time.Duration)(n) * time.Second
+		}else if dur, err = time.ParseDuration(ttl); err != nil {
+			return nil, fmt.Errorf("Invalid ttl %q", ttl)
+		}
+		if dur <= 0 {
+			return nil, fmt.Errorf("ttl must be positive, got %q", ttl)
+		}
+		t := time.Now().Add(dur).UTC()
+		return &t, nil
+	}
+	if expiration := req.FormValue("expiration"); len(expiration) != 0 {
+		var t time.Time
+		if n, er := strconv.ParseInt(expiration, 10, 64); er == nil {
+			t = time.Unix(n, 0)
+		}else if t, err = time.Parse(time.RFC3339, expiration); err != nil {
+			return nil, fmt.Errorf("Invalid expiration %q", expiration)
+		}
+		t = t.UTC()
+		return &t, nil
+	}
+	return nil, nil
+}
+
+// parseAuditFilter reads the filter of /audit from the request,
+// `since` and `until` accept the same formats as `expiration`
+func parseAuditFilter(req *http.Request)(filter AuditFilter, err error){
+	filter.Action = req.FormValue("action")
+	filter.User = req.FormValue("user")
+	filter.Token = req.FormValue("token")
+	filter.Host = req.FormValue("host")
+	if device := req.FormValue("device"); len(device) != 0 {
+		n, err := strconv.ParseInt(device, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("Invalid device %q", device)
+		}
+		filter.Device = &n
+	}
+	parseTime := func(name string)(t time.Time, err error){
+		value := req.FormValue(name)
+		if len(value) == 0 {
+			return
+		}
+		if n, er := strconv.ParseInt(value, 10, 64); er == nil {
+			return time.Unix(n, 0).UTC(), nil
+		}
+		if t, err = time.Parse(time.RFC3339, value); err != nil {
+			return t, fmt.Errorf("Invalid %s %q", name, value)
+		}
+		return t.UTC(), nil
+	}
+	if filter.Since, err = parseTime("since"); err != nil {
+		return
+	}
+	if filter.Until, err = parseTime("until"); err != nil {
+		return
+	}
+	for _, name := range []string{"offset", "limit"} {
+		value := req.FormValue(name)
+		if len(value) == 0 {
+			continue
+		}
+		n, er := strconv.Atoi(value)
+		if er != nil || n < 0 {
+			return filter, fmt.Errorf("Invalid %s %q", name, value)
+		}
+		if name == "offset" {
+			filter.Offset = n
+		}else{
+			filter.Limit = n
+		}
+	}
+	return
+}
+
+func writeBadRequest(rw http.ResponseWriter, err error)(error){
+	return writeJson(rw, http.StatusBadRequest, Map{
+		"status": "error",
+		"error": err.Error(),
+	})
+}
+
+// writeApiError chooses the status code by the error that DataAPI returned
+func writeApiError(rw http.ResponseWriter, err error)(error){
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, InvalidPatternErr), errors.Is(err, InvalidRoleErr):
+		status = http.StatusBadRequest
+	case errors.Is(err, TokenNotExistsErr), errors.Is(err, GroupNotExistsErr),
+		errors.Is(err, UserNotExistsErr), errors.Is(err, ServerNotExistsErr), errors.Is(err, DeviceNotExistsErr),
+		errors.Is(err, MessageNotExistsErr):
+		status = http.StatusNotFound
+	case errors.Is(err, GroupExistsErr), errors.Is(err, UserExistsErr):
+		status = http.StatusConflict
+	}
+	return writeJson(rw, status, Map{
+		"status": "error",
+		"error": err.Error(),
+	})
+}
+
 func writeUnauth(rw http.ResponseWriter)(error){
 	return writeJson(rw, http.StatusUnauthorized, Map{
 		"status": "error",
@@ -5,15 +5,31 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
+	"time"
 )
 
+const defaultResumeGrace = 60 * time.Second
+
 type HostServer struct {
 	id string
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// resumeGrace is how long the session of a dropped device is kept for it to resume
+	resumeGrace time.Duration
+	// pingInterval is the interval of the pings to the devices, 0 disables the pings
+	pingInterval time.Duration
+	// maxMissedPongs is the pongs a device can miss in a row before it's dropped, 0 never drops it
+	maxMissedPongs int
+	// writeQueue is the outbound queue of each device socket
+	writeQueue WriteQueueConfig
+	broker *Broker
+	// route finds the other hosts for the device-to-device packets, nil disables the cross-host routing
+	route RouteFunc
+
 	connMux sync.RWMutex
 	conns   map[int64]*Conn
 }
@@ -24,6 +40,11 @@ func NewHostServer(ctx context.Context, id string)(s *HostServer){
 		ctx: ctx0,
 		cancel: cancel,
 		id: id,
+		resumeGrace: defaultResumeGrace,
+		pingInterval: defaultPingInterval,
+		maxMissedPongs: defaultMaxMissedPongs,
+		writeQueue: defaultDeviceWriteQueue,
+		broker: NewBroker(id),
 		conns: make(map[int64]*Conn),
 	}
 }
@@ -42,24 +63,46 @@ func (s *HostServer)Destroy(){
 	s.connMux.Unlock()
 }
 
-func (s *HostServer)AcceptConn(rw http.ResponseWriter, req *http.Request)(conn *Conn, err error){
+// AcceptConn accepts a daemon connection, token is the daemon token it authenticated with.
+// If the device sends the id of its live session by the header X-CC-Session, the session is resumed
+// and resumed is true, otherwise a new session is created.
+func (s *HostServer)AcceptConn(token string, rw http.ResponseWriter, req *http.Request)(conn *Conn, resumed bool, err error){
 	var ccId int64
 	if ccId, err = readCCID(req); err != nil {
 		rw.WriteHeader(http.StatusBadRequest)
 		fmt.Fprint(rw, err.Error())
+		return
 	}
+	session := req.Header.Get("X-CC-Session")
 	s.connMux.Lock()
-	if _, ok := s.conns[ccId]; ok {
-		s.connMux.Unlock()
-		err = fmt.Errorf("Device ID %d is already connected", ccId)
-		rw.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(rw, err.Error())
-		return
+	if old, ok := s.conns[ccId]; ok {
+		if old != nil && old.canResume(session, token) {
+			s.connMux.Unlock()
+			if err = old.resume(rw, req); err != nil {
+				return
+			}
+			return old, true, nil
+		}
+		if old == nil || old.Online() {
+			s.connMux.Unlock()
+			err = fmt.Errorf("Device ID %d is already connected", ccId)
+			rw.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(rw, err.Error())
+			return
+		}
+		// the device is offline and does not resume its session, it's probably rebooted
+		loger.Infof("[%s]: Device %d started a new session, ending the old one", req.RemoteAddr, ccId)
+		old.cancel()
 	}
 	s.conns[ccId] = nil // take the slot first
 	s.connMux.Unlock()
 
-	conn, err = AcceptConn(s, rw, req)
+	if conn, err = AcceptConn(s, token, rw, req); err != nil {
+		s.connMux.Lock()
+		delete(s.conns, ccId)
+		s.connMux.Unlock()
+		return
+	}
 	s.connMux.Lock()
 	s.conns[conn.id] = conn
 	s.connMux.Unlock()
@@ -67,8 +110,11 @@ func (s *HostServer)AcceptConn(rw http.ResponseWriter, req *http.Request)(conn *
 		select {
 		case <-conn.Context().Done():
 			s.connMux.Lock()
-			delete(s.conns, conn.id)
+			if s.conns[conn.id] == conn {
+				delete(s.conns, conn.id)
+			}
 			s.connMux.Unlock()
+			s.broker.UnsubscribeAll(conn)
 		case <-s.ctx.Done():
 		}
 	}()
@@ -76,6 +122,10 @@ func (s *HostServer)AcceptConn(rw http.ResponseWriter, req *http.Request)(conn *
 	return
 }
 
+func (s *HostServer)Broker()(*Broker){
+	return s.broker
+}
+
 func (s *HostServer)GetConn(id int64)(*Conn){
 	s.connMux.RLock()
 	defer s.connMux.RUnlock()
@@ -87,8 +137,21 @@ func (s *HostServer)GetConns()(conns []*Conn){
 	defer s.connMux.RUnlock()
 	conns = make([]*Conn, 0, len(s.conns))
 	for _, c := range s.conns {
-		conns = append(conns, c)
+		if c != nil { // skip the slots that are still accepting
+			conns = append(conns, c)
+		}
+	}
+	return
+}
+
+// Select returns the devices that match the selector, ordered by id
+func (s *HostServer)Select(sel *DeviceSelector)(conns []*Conn){
+	for _, c := range s.GetConns() {
+		if sel.MatchConn(c) {
+			conns = append(conns, c)
+		}
 	}
+	sort.Slice(conns, func(i, j int)(bool){ return conns[i].id < conns[j].id })
 	return
 }
 
@@ -103,6 +166,7 @@ func (s *HostServer)Broadcast(data Map)(n int, res <-chan error){
 	defer s.connMux.RUnlock()
 	res0 := make(chan error, len(s.conns))
 	for _, c := range s.conns {
+		c := c
 		n++
 		go func(){
 			res0 <- c.send(data)
@@ -118,6 +182,7 @@ func (s *HostServer)broadcastExcept(data Map, except *Conn)(n int, res <-chan er
 	res0 := make(chan error, len(s.conns))
 	for _, c := range s.conns {
 		if c != except {
+			c := c
 			n++
 			go func(){
 				res0 <- c.send(data)
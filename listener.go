@@ -0,0 +1,203 @@
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type TLSConfig struct {
+	// Cert and Key are the PEM files of the certificate, they are reloaded on SIGHUP
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type ListenerConfig struct {
+	// Network can be "tcp" or "unix", default is "tcp"
+	Network string `json:"network"`
+	// Addr is the host:port to listen on, or the socket path for the unix network
+	Addr    string `json:"addr"`
+	// Mode is the octal permission of the unix socket, such as "0660"
+	Mode    string `json:"mode"`
+	// Routes are the path prefixes served by the listener, such as ["/wsd"] or ["/api", "/wscli", "/main"].
+	// Empty serves everything
+	Routes  []string `json:"routes"`
+	// TLS makes the listener terminate TLS itself, nil to serve plain http
+	TLS     *TLSConfig `json:"tls"`
+}
+
+func (c *ListenerConfig)String()(string){
+	s := c.Addr
+	if c.Network == "unix" {
+		s = "unix:" + s
+	}
+	if c.TLS != nil {
+		s += " (tls)"
+	}
+	return s
+}
+
+// certReloader serves a certificate pair that can be replaced at runtime,
+// so renewed certificates can be used without restarting the server
+type certReloader struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+func newCertReloader(certPath, keyPath string)(r *certReloader, err error){
+	r = &certReloader{
+		certPath: certPath,
+		keyPath: keyPath,
+	}
+	if err = r.Reload(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Reload loads the files again, the old certificate is kept if they cannot be loaded
+func (r *certReloader)Reload()(err error){
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("Cannot load certificate %s: %w", r.certPath, err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+func (r *certReloader)GetCertificate(*tls.ClientHelloInfo)(*tls.Certificate, error){
+	return r.cert.Load(), nil
+}
+
+func staticCertificate(cert tls.Certificate)(func(*tls.ClientHelloInfo)(*tls.Certificate, error)){
+	return func(*tls.ClientHelloInfo)(*tls.Certificate, error){
+		return &cert, nil
+	}
+}
+
+// routeHandler only passes the requests under the route prefixes to next
+func routeHandler(next http.Handler, routes []string)(http.Handler){
+	if len(routes) == 0 {
+		return next
+	}
+	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){
+		path := req.URL.Path
+		for _, r := range routes {
+			r = strings.TrimSuffix(r, "/")
+			if path == r || strings.HasPrefix(path, r + "/") {
+				next.ServeHTTP(rw, req)
+				return
+			}
+		}
+		http.NotFound(rw, req)
+	})
+}
+
+// Listener is one of the addresses that the server is listening on
+type Listener struct {
+	cfg    ListenerConfig
+	ln     net.Listener
+	server *http.Server
+	certs  *certReloader
+}
+
+func NewListener(cfg ListenerConfig, handler http.Handler)(l *Listener, err error){
+	var (
+		tlsCfg *tls.Config
+		certs  *certReloader
+	)
+	if cfg.TLS != nil {
+		if certs, err = newCertReloader(cfg.TLS.Cert, cfg.TLS.Key); err != nil {
+			return
+		}
+		tlsCfg = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+	return newListenerWithTLS(cfg, handler, tlsCfg, certs)
+}
+
+// newListenerWithTLS creates a listener with a prepared tls config, such as the one that requires client certificates
+func newListenerWithTLS(cfg ListenerConfig, handler http.Handler, tlsCfg *tls.Config, certs *certReloader)(l *Listener, err error){
+	l = &Listener{
+		cfg: cfg,
+		server: &http.Server{
+			Addr: cfg.Addr,
+			Handler: routeHandler(handler, cfg.Routes),
+		},
+		certs: certs,
+	}
+	if err = l.listen(tlsCfg); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (l *Listener)listen(tlsCfg *tls.Config)(err error){
+	switch l.cfg.Network {
+	case "", "tcp":
+		if l.ln, err = net.Listen("tcp", l.cfg.Addr); err != nil {
+			return
+		}
+	case "unix":
+		// remove the socket left by the last run
+		if stat, err := os.Lstat(l.cfg.Addr); err == nil && stat.Mode() & os.ModeSocket != 0 {
+			os.Remove(l.cfg.Addr)
+		}
+		if l.ln, err = net.Listen("unix", l.cfg.Addr); err != nil {
+			return
+		}
+		if len(l.cfg.Mode) != 0 {
+			mode, err := strconv.ParseUint(l.cfg.Mode, 8, 32)
+			if err != nil {
+				l.ln.Close()
+				return fmt.Errorf("Invalid socket mode %q", l.cfg.Mode)
+			}
+			if err = os.Chmod(l.cfg.Addr, (os.FileMode)(mode)); err != nil {
+				l.ln.Close()
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown listener network %q", l.cfg.Network)
+	}
+	if tlsCfg != nil {
+		l.server.TLSConfig = tlsCfg
+		l.ln = tls.NewListener(l.ln, tlsCfg)
+	}
+	return
+}
+
+func (l *Listener)String()(string){
+	return l.cfg.String()
+}
+
+// Serve blocks until the listener is closed, it returns nil when it is closed by Shutdown
+func (l *Listener)Serve()(err error){
+	if err = l.server.Serve(l.ln); errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+func (l *Listener)Shutdown(ctx context.Context)(error){
+	return l.server.Shutdown(ctx)
+}
+
+// ReloadTLS reloads the certificate files if the listener is using TLS
+func (l *Listener)ReloadTLS()(error){
+	if l.certs == nil {
+		return nil
+	}
+	return l.certs.Reload()
+}
@@ -0,0 +1,142 @@
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRouteHandler(t *testing.T){
+	ok := (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	h := routeHandler(ok, []string{"/api/", "/wsd"})
+	for path, expect := range map[string]int{
+		"/api": http.StatusNoContent,
+		"/api/tokens": http.StatusNoContent,
+		"/wsd": http.StatusNoContent,
+		"/wsdx": http.StatusNotFound,
+		"/wscli": http.StatusNotFound,
+		"/": http.StatusNotFound,
+	} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code != expect {
+			t.Errorf("%s: expect status %d, got %d", path, expect, rw.Code)
+		}
+	}
+}
+
+func TestUnixListener(t *testing.T){
+	sock := filepath.Join(t.TempDir(), "cc.sock")
+	l, err := NewListener(ListenerConfig{
+		Network: "unix",
+		Addr: sock,
+		Mode: "0600",
+		Routes: []string{"/api"},
+	}, (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){
+		io.WriteString(rw, "ok")
+	}))
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	go l.Serve()
+	defer l.Shutdown(context.Background())
+
+	if stat, err := os.Stat(sock); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Expect socket mode 0600, got %v, %v", stat.Mode(), err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string)(net.Conn, error){
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		},
+	}
+	res, err := client.Get("http://unix/api/tokens")
+	if err != nil {
+		t.Fatalf("Cannot request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expect status 200, got %d", res.StatusCode)
+	}
+	if res, err = client.Get("http://unix/wsd"); err != nil {
+		t.Fatalf("Cannot request: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expect status 404, got %d", res.StatusCode)
+	}
+}
+
+func TestListenerReloadTLS(t *testing.T){
+	dir := t.TempDir()
+	ca, err := InitCertAuthority(filepath.Join(dir, "ca"), "test CA")
+	if err != nil {
+		t.Fatalf("Cannot init CA: %v", err)
+	}
+	certPath, keyPath := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCert := func()(*x509.Certificate){
+		cert, err := ca.IssueServerCert([]string{"127.0.0.1"}, time.Hour)
+		if err != nil {
+			t.Fatalf("Cannot issue server cert: %v", err)
+		}
+		keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatalf("Cannot marshal key: %v", err)
+		}
+		os.Remove(certPath)
+		os.Remove(keyPath)
+		if err = writePEMFile(certPath, "CERTIFICATE", cert.Certificate[0], 0600); err != nil {
+			t.Fatalf("Cannot write server cert: %v", err)
+		}
+		if err = writePEMFile(keyPath, "PRIVATE KEY", keyDer, 0600); err != nil {
+			t.Fatalf("Cannot write server key: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Cannot parse server cert: %v", err)
+		}
+		return leaf
+	}
+	first := writeCert()
+
+	l, err := NewListener(ListenerConfig{
+		Addr: "127.0.0.1:0",
+		TLS: &TLSConfig{Cert: certPath, Key: keyPath},
+	}, (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){}))
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	go l.Serve()
+	defer l.Shutdown(context.Background())
+
+	serial := func()(string){
+		conn, err := tls.Dial("tcp", l.ln.Addr().String(), &tls.Config{RootCAs: ca.Pool()})
+		if err != nil {
+			t.Fatalf("Cannot dial: %v", err)
+		}
+		defer conn.Close()
+		return formatSerial(conn.ConnectionState().PeerCertificates[0].SerialNumber)
+	}
+	if s := serial(); s != formatSerial(first.SerialNumber) {
+		t.Errorf("Expect the first certificate, got %s", s)
+	}
+	second := writeCert()
+	if err = l.ReloadTLS(); err != nil {
+		t.Fatalf("Cannot reload: %v", err)
+	}
+	if s := serial(); s != formatSerial(second.SerialNumber) {
+		t.Errorf("Expect the reloaded certificate, got %s", s)
+	}
+}
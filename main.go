@@ -3,28 +3,119 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 )
 
 var startTime = time.Now() // or maybe build time
 
+type DBConfig struct {
+	// Driver can be "mysql", "sqlite" or "memory", default is "mysql"
+	Driver string `json:"driver"`
+	// Path is the database file used by the sqlite driver,
+	// or the optional snapshot file used by the memory driver
+	Path   string `json:"path"`
+}
+
+type AuditConfig struct {
+	// Driver can be "db" to use the table in the sql database,
+	// "file" to append json lines to Path, or "none" to disable the audit log.
+	// The default is "db", or "file" when the database driver is "memory"
+	Driver string `json:"driver"`
+	// Path is the file used by the file driver, default is audit.log in the data directory
+	Path   string `json:"path"`
+}
+
+// DaemonTLSConfig enables a listener that terminates TLS itself and
+// authenticates the daemons by the client certificates issued by the `ca` subcommand
+type DaemonTLSConfig struct {
+	// Addr is the address of the listener, empty to disable it
+	Addr   string `json:"addr"`
+	// CADir is the directory of the certificate authority, default is ca in the data directory
+	CADir  string `json:"ca_dir"`
+	// Cert and Key are the files of the server certificate.
+	// When they are empty, the built-in CA issues one for ServerNames at startup
+	Cert   string `json:"cert"`
+	Key    string `json:"key"`
+	ServerNames []string `json:"server_names"`
+}
+
+func (c *DaemonTLSConfig)caDir()(string){
+	if len(c.CADir) == 0 {
+		return filepath.Join(DataDir, "ca")
+	}
+	return c.CADir
+}
+
 type Config struct {
-	Host string `json:"host"`
-	Port int    `json:"port"`
+	// Host and Port are the address of the default listener, they are ignored when Listeners is not empty
+	Host  string      `json:"host"`
+	Port  int         `json:"port"`
+	// TLS makes the default listener terminate TLS itself
+	TLS   *TLSConfig  `json:"tls"`
+	// Listeners can split the routes to different addresses or unix sockets,
+	// for example a public one for /wsd and a private one for /api and /wscli
+	Listeners []ListenerConfig `json:"listeners"`
+	DB    DBConfig    `json:"db"`
+	Audit AuditConfig `json:"audit"`
+	DaemonTLS DaemonTLSConfig `json:"daemon_tls"`
+	// RateLimit throttles the authentication attempts, null disables it
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+	// TokenSweepInterval is the seconds between two expired token cleanups, 0 to disable
+	TokenSweepInterval int `json:"token_sweep_interval"`
+	// AuthCacheTTL is the seconds that the auth and permission checks are cached, 0 to disable the cache
+	AuthCacheTTL int `json:"auth_cache_ttl"`
+	// LoginTokenTTL is the seconds before a token issued by /api/login expires
+	LoginTokenTTL int `json:"login_token_ttl"`
+	// DeviceResumeGrace is the seconds that the session of a dropped device is kept for it to resume, 0 to disable
+	DeviceResumeGrace int `json:"device_resume_grace"`
+	// DevicePingInterval is the seconds between two pings to a device, 0 to disable
+	DevicePingInterval int `json:"device_ping_interval"`
+	// DeviceMaxMissedPongs is the pongs a device can miss in a row before its connection is closed, 0 to never close it
+	DeviceMaxMissedPongs int `json:"device_max_missed_pongs"`
+	// DeviceRoutes are the other hosts that the devices of a host can send packets to, such as {"farm": ["storage"]}.
+	// "*" matches every host, and the devices can only reach their own host by default
+	DeviceRoutes map[string][]string `json:"device_routes"`
+	// DeviceOutbox queues the packets to the offline devices in the database, null disables it
+	DeviceOutbox *OutboxConfig `json:"device_outbox"`
+	// ClientWriteQueue and DeviceWriteQueue limit the packets waiting to be written to each connection,
+	// the zero fields are set to the defaults
+	ClientWriteQueue WriteQueueConfig `json:"client_write_queue"`
+	DeviceWriteQueue WriteQueueConfig `json:"device_write_queue"`
+}
+
+func (c *Config)listenerConfigs()([]ListenerConfig){
+	if len(c.Listeners) != 0 {
+		return c.Listeners
+	}
+	return []ListenerConfig{{
+		Addr: net.JoinHostPort(c.Host, strconv.Itoa(c.Port)),
+		TLS: c.TLS,
+	}}
 }
 
 var defaultConfig = &Config{
 	Host: "",
 	Port: 80,
+	DB: DBConfig{
+		Driver: "mysql",
+	},
+	RateLimit: &defaultRateLimitConfig,
+	TokenSweepInterval: 10 * 60,
+	AuthCacheTTL: 30,
+	LoginTokenTTL: 12 * 60 * 60,
+	DeviceResumeGrace: 60,
+	DevicePingInterval: 10,
+	DeviceMaxMissedPongs: 3,
 }
 var config *Config = loadConfig()
 
@@ -37,29 +128,55 @@ func loadConfig()(cfg *Config){
 		// loger.Fatalf("Cannot read config at %s: %v", configPath, err)
 	}
 	cfg = new(Config)
+	*cfg = *defaultConfig
 	if err = json.Unmarshal(data, cfg); err != nil {
 		loger.Fatalf("Cannot parse config at %s: %v", configPath, err)
 	}
+	if cfg.LoginTokenTTL <= 0 {
+		loger.Fatalf("Invalid config at %s: login_token_ttl must be positive, got %d", configPath, cfg.LoginTokenTTL)
+	}
 	return
 }
 
 func main(){
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrateCmd(os.Args[2:]))
+		case "ca":
+			os.Exit(runCACmd(os.Args[2:]))
+		}
+	}
+
 	hooksDir := filepath.Join(DataDir, "hooks")
 
-	username := os.Getenv("DB_USER")
-	passwd := os.Getenv("DB_PASSWD")
-	dbaddr := os.Getenv("DB_ADDR")
-	dbname := os.Getenv("DB_NAME")
-	if len(username) == 0 || len(dbaddr) == 0 || len(dbname) == 0 {
-		loger.Fatalf("Please set the envs `DB_USER`, `DB_PASSWD`, `DB_ADDR`, `DB_NAME`")
-	}
-	dtapi, err := NewMySQLAPI(username, passwd, dbaddr, dbname)
-	if err != nil {
-		loger.Fatalf("Cannot init mysql api: %v", err)
-	}
+	dtapi := openDataAPI(config.DB)
 	fsapi := NewOSFsAPI(DataDir)
+	audit := openAuditAPI(config.Audit, dtapi)
+	// the cache is used even if it's disabled, since the writes through it notify the live connections
+	cached := NewCachedDataAPI(dtapi, (time.Duration)(config.AuthCacheTTL) * time.Second)
 
-	handler := NewHandler(dtapi, fsapi)
+	handler := NewHandler(cached, fsapi, audit)
+	handler.SetResumeGrace((time.Duration)(config.DeviceResumeGrace) * time.Second)
+	handler.SetDevicePing((time.Duration)(config.DevicePingInterval) * time.Second, config.DeviceMaxMissedPongs)
+	handler.SetDeviceRoutes(config.DeviceRoutes)
+	if err := handler.SetWriteQueues(config.ClientWriteQueue, config.DeviceWriteQueue); err != nil {
+		loger.Fatalf("Cannot set write queues: %v", err)
+	}
+	if config.DeviceOutbox != nil {
+		handler.SetOutbox(config.DeviceOutbox)
+		handler.StartOutboxSweeper()
+	}
+	if config.RateLimit != nil {
+		limiter, err := NewAuthLimiter(*config.RateLimit)
+		if err != nil {
+			loger.Fatalf("Cannot init rate limit: %v", err)
+		}
+		handler.SetAuthLimiter(limiter)
+	}
+	if config.TokenSweepInterval > 0 {
+		handler.StartTokenSweeper((time.Duration)(config.TokenSweepInterval) * time.Second)
+	}
 
 	{
 		loger.Info("Loading hook plugins...")
@@ -73,21 +190,37 @@ func main(){
 		}
 	}
 
-	server := &http.Server{
-		Addr: net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
-		Handler: logMiddleWare(handler.NewServeMux()),
+	mux := logMiddleWare(handler.NewServeMux())
+	listeners := make([]*Listener, 0, len(config.Listeners) + 2)
+	for _, cfg := range config.listenerConfigs() {
+		l, err := NewListener(cfg, mux)
+		if err != nil {
+			loger.Fatalf("Cannot listen at %s: %v", cfg.String(), err)
+		}
+		listeners = append(listeners, l)
+	}
+	if config.DaemonTLS.Addr != "" {
+		listeners = append(listeners, newDaemonTLSListener(&config.DaemonTLS, handler))
 	}
 
 	done := make(chan struct{}, 0)
 	sigch := make(chan os.Signal, 1)
 	signal.Notify(sigch, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
 
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *Listener){
+			defer wg.Done()
+			loger.Infof("Server start at %s", l.String())
+			if err := l.Serve(); err != nil {
+				loger.Fatalf("Server at %s exit by: %v", l.String(), err)
+			}
+		}(l)
+	}
 	go func(){
-		defer close(done)
-		loger.Infof("Server start at %s", server.Addr)
-		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			loger.Fatalf("Server exit by: %v", err)
-		}
+		wg.Wait()
+		close(done)
 	}()
 
 	for {
@@ -95,6 +228,12 @@ func main(){
 		case sig := <-sigch:
 			if sig == syscall.SIGHUP { // reload
 				loger.Warnf("Reload signal received [%s]", sig.String())
+				loger.Info("Reloading TLS certificates...")
+				for _, l := range listeners {
+					if err := l.ReloadTLS(); err != nil {
+						loger.Errorf("Cannot reload TLS certificate of %s: %v", l.String(), err)
+					}
+				}
 				loger.Info("Reloading hook plugins...")
 				{
 					ctx, cancel := context.WithTimeout(context.Background(), time.Second * 10)
@@ -108,7 +247,9 @@ func main(){
 				}
 			}else{
 				ctx, cancel := context.WithTimeout(context.Background(), time.Second * 3)
-				server.Shutdown(ctx)
+				for _, l := range listeners {
+					l.Shutdown(ctx)
+				}
 				cancel()
 				return
 			}
@@ -118,6 +259,117 @@ func main(){
 	}
 }
 
+func getMySQLEnvs()(username, passwd, dbaddr, dbname string){
+	username = os.Getenv("DB_USER")
+	passwd = os.Getenv("DB_PASSWD")
+	dbaddr = os.Getenv("DB_ADDR")
+	dbname = os.Getenv("DB_NAME")
+	if len(username) == 0 || len(dbaddr) == 0 || len(dbname) == 0 {
+		loger.Fatalf("Please set the envs `DB_USER`, `DB_PASSWD`, `DB_ADDR`, `DB_NAME`")
+	}
+	return
+}
+
+func openDataAPI(cfg DBConfig)(DataAPI){
+	switch cfg.Driver {
+	case "", "mysql":
+		username, passwd, dbaddr, dbname := getMySQLEnvs()
+		dtapi, err := NewMySQLAPI(username, passwd, dbaddr, dbname)
+		if err != nil {
+			loger.Fatalf("Cannot init mysql api: %v", err)
+		}
+		return dtapi
+	case "sqlite":
+		path := cfg.Path
+		if len(path) == 0 {
+			path = filepath.Join(DataDir, "data.db")
+		}
+		dtapi, err := NewSQLiteAPI(path)
+		if err != nil {
+			loger.Fatalf("Cannot init sqlite api at %s: %v", path, err)
+		}
+		return dtapi
+	case "memory":
+		dtapi, err := NewMemAPI(cfg.Path)
+		if err != nil {
+			loger.Fatalf("Cannot init memory api: %v", err)
+		}
+		return dtapi
+	default:
+		loger.Fatalf("Unknown database driver %q", cfg.Driver)
+		return nil
+	}
+}
+
+func openAuditAPI(cfg AuditConfig, dtapi DataAPI)(AuditAPI){
+	driver := cfg.Driver
+	if len(driver) == 0 {
+		driver = "db"
+		if _, ok := dtapi.(*MemAPI); ok {
+			driver = "file"
+		}
+	}
+	switch driver {
+	case "db":
+		switch api := dtapi.(type) {
+		case *MySQLAPI:
+			return NewSQLAuditAPI(api.DB)
+		case *SQLiteAPI:
+			return NewSQLAuditAPI(api.DB)
+		default:
+			loger.Fatalf("Audit driver \"db\" requires a sql database driver")
+			return nil
+		}
+	case "file":
+		path := cfg.Path
+		if len(path) == 0 {
+			path = filepath.Join(DataDir, "audit.log")
+		}
+		audit, err := NewFileAuditAPI(path)
+		if err != nil {
+			loger.Fatalf("Cannot open audit log at %s: %v", path, err)
+		}
+		return audit
+	case "none":
+		loger.Warn("Audit log is disabled")
+		return nil
+	default:
+		loger.Fatalf("Unknown audit driver %q", cfg.Driver)
+		return nil
+	}
+}
+
+// newDaemonTLSListener creates the listener that only serves /wsd and requires the daemon certificates
+func newDaemonTLSListener(cfg *DaemonTLSConfig, handler *Handler)(*Listener){
+	ca, err := LoadCertAuthority(cfg.caDir())
+	if err != nil {
+		loger.Fatalf("Cannot load certificate authority at %s: %v", cfg.caDir(), err)
+	}
+	var (
+		tlsCfg *tls.Config
+		certs  *certReloader
+	)
+	if len(cfg.Cert) != 0 || len(cfg.Key) != 0 {
+		if certs, err = newCertReloader(cfg.Cert, cfg.Key); err != nil {
+			loger.Fatalf("Cannot load daemon TLS certificate: %v", err)
+		}
+		tlsCfg = ca.DaemonTLSConfig(certs.GetCertificate)
+	}else{
+		cert, err := ca.IssueServerCert(cfg.ServerNames, defaultDaemonCertValidFor)
+		if err != nil {
+			loger.Fatalf("Cannot issue daemon TLS certificate: %v", err)
+		}
+		tlsCfg = ca.DaemonTLSConfig(staticCertificate(cert))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wsd", handler.serveWsd)
+	l, err := newListenerWithTLS(ListenerConfig{Addr: cfg.Addr}, logMiddleWare(mux), tlsCfg, certs)
+	if err != nil {
+		loger.Fatalf("Cannot listen at %s: %v", cfg.Addr, err)
+	}
+	return l
+}
+
 func logMiddleWare(next http.Handler)(http.Handler){
 	return (http.HandlerFunc)(func(rw http.ResponseWriter, req *http.Request){
 		loger.Infof("[%s] %s %s", req.RemoteAddr, req.Method, req.URL.Path)
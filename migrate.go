@@ -0,0 +1,345 @@
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationsFS embed.FS
+
+// baselineVersion is the schema version created by the old hand-run init.sql.
+// Databases that already have the tables but no version table are assumed to be at this version.
+const baselineVersion = 2
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Migrator applies the embedded migrations of one SQL dialect ("mysql" or "sqlite") to a database.
+type Migrator struct {
+	DB      *sql.DB
+	Dialect string
+
+	migrations []Migration
+}
+
+func NewMigrator(db *sql.DB, dialect string)(m *Migrator, err error){
+	m = &Migrator{
+		DB: db,
+		Dialect: dialect,
+	}
+	if m.migrations, err = loadMigrations(dialect); err != nil {
+		return
+	}
+	return
+}
+
+// loadMigrations reads files named as <version>_<name>.(up|down).sql under migrations/<dialect>
+func loadMigrations(dialect string)(migrations []Migration, err error){
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationsFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("No migrations for dialect %q: %w", dialect, err)
+	}
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".sql")
+		base, direction := splitByteR(base, '.')
+		sver, mname := splitByte(base, '_')
+		var ver int
+		if ver, err = strconv.Atoi(sver); err != nil || ver <= 0 {
+			return nil, fmt.Errorf("Invalid migration file name %q", name)
+		}
+		var buf []byte
+		if buf, err = migrationsFS.ReadFile(path.Join(dir, name)); err != nil {
+			return
+		}
+		m, ok := byVersion[ver]
+		if !ok {
+			m = &Migration{Version: ver, Name: mname}
+			byVersion[ver] = m
+		}
+		switch direction {
+		case "up":
+			m.Up = (string)(buf)
+		case "down":
+			m.Down = (string)(buf)
+		default:
+			return nil, fmt.Errorf("Invalid migration file name %q", name)
+		}
+	}
+	migrations = make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if len(m.Up) == 0 {
+			return nil, fmt.Errorf("Migration %d_%s does not have an up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int)(bool){ return migrations[i].Version < migrations[j].Version })
+	return
+}
+
+// splitSQLStatements splits a script into statements, a statement ends with a line that ends with ';'
+func splitSQLStatements(script string)(stmts []string){
+	var sb strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			if stmt := strings.TrimSpace(sb.String()); stmt != ";" {
+				stmts = append(stmts, stmt)
+			}
+			sb.Reset()
+		}
+	}
+	if stmt := strings.TrimSpace(sb.String()); len(stmt) != 0 {
+		stmts = append(stmts, stmt)
+	}
+	return
+}
+
+func (m *Migrator)Latest()(int){
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations) - 1].Version
+}
+
+func (m *Migrator)tableExists(ctx context.Context, name string)(ok bool, err error){
+	var queryCmd string
+	switch m.Dialect {
+	case "mysql":
+		queryCmd = "SELECT 1 FROM information_schema.tables" +
+			" WHERE `table_schema`=DATABASE() AND `table_name`=?"
+	case "sqlite":
+		queryCmd = "SELECT 1 FROM sqlite_master" +
+			" WHERE `type`='table' AND `name`=?"
+	default:
+		return false, fmt.Errorf("Unknown sql dialect %q", m.Dialect)
+	}
+	if err = m.DB.QueryRowContext(ctx, queryCmd, name).Scan(&ok); err != nil {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		return false, err
+	}
+	return
+}
+
+// prepare creates the version table if not exists, and adopts databases created by init.sql
+func (m *Migrator)prepare(ctx context.Context)(err error){
+	const createCmd = "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		" `version`    INTEGER NOT NULL," +
+		" `name`       VARCHAR(128) NOT NULL," +
+		" `applied_at` BIGINT NOT NULL," +
+		" PRIMARY KEY (`version`)" +
+		")"
+	const insertCmd = "INSERT INTO schema_migrations (`version`, `name`, `applied_at`)" +
+		" VALUES (?, ?, ?)"
+
+	var exists bool
+	if exists, err = m.tableExists(ctx, "schema_migrations"); err != nil || exists {
+		return
+	}
+	var legacy bool
+	if legacy, err = m.tableExists(ctx, "tokens"); err != nil {
+		return
+	}
+	if _, err = m.DB.ExecContext(ctx, createCmd); err != nil {
+		return
+	}
+	if legacy {
+		loger.Warnf("Found tables without schema version, assuming version %d", baselineVersion)
+		now := time.Now().Unix()
+		for _, mg := range m.migrations {
+			if mg.Version > baselineVersion {
+				break
+			}
+			if _, err = m.DB.ExecContext(ctx, insertCmd, mg.Version, mg.Name, now); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (m *Migrator)applied(ctx context.Context)(versions map[int]time.Time, err error){
+	const queryCmd = "SELECT `version`, `applied_at` FROM schema_migrations"
+
+	if err = m.prepare(ctx); err != nil {
+		return
+	}
+	rows, err := m.DB.QueryContext(ctx, queryCmd)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	versions = make(map[int]time.Time)
+	for rows.Next() {
+		var (
+			ver int
+			at int64
+		)
+		if err = rows.Scan(&ver, &at); err != nil {
+			return
+		}
+		versions[ver] = time.Unix(at, 0)
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	return
+}
+
+// Version returns the highest applied migration version
+func (m *Migrator)Version(ctx context.Context)(version int, err error){
+	versions, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	for v, _ := range versions {
+		if v > version {
+			version = v
+		}
+	}
+	return
+}
+
+func (m *Migrator)Status(ctx context.Context)(status []MigrationStatus, err error){
+	versions, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	status = make([]MigrationStatus, len(m.migrations))
+	for i, mg := range m.migrations {
+		at, ok := versions[mg.Version]
+		status[i] = MigrationStatus{
+			Migration: mg,
+			Applied: ok,
+			AppliedAt: at,
+		}
+	}
+	return
+}
+
+func (m *Migrator)run(ctx context.Context, mg Migration, up bool)(err error){
+	const insertCmd = "INSERT INTO schema_migrations (`version`, `name`, `applied_at`)" +
+		" VALUES (?, ?, ?)"
+	const deleteCmd = "DELETE FROM schema_migrations" +
+		" WHERE `version`=?"
+
+	script := mg.Up
+	if !up {
+		script = mg.Down
+		if len(script) == 0 {
+			return fmt.Errorf("Migration %d_%s cannot be reverted", mg.Version, mg.Name)
+		}
+	}
+
+	// Note: MySQL commits DDL statements implicitly, so a failed migration may need to be fixed by hand
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitSQLStatements(script) {
+		loger.Debugf("Exec migration sql: %s", stmt)
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("Migration %d_%s failed: %w", mg.Version, mg.Name, err)
+		}
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, insertCmd, mg.Version, mg.Name, time.Now().Unix())
+	}else{
+		_, err = tx.ExecContext(ctx, deleteCmd, mg.Version)
+	}
+	if err != nil {
+		return
+	}
+	return tx.Commit()
+}
+
+// Up applies all pending migrations whose version is not greater than target.
+// If target is not positive, all pending migrations will be applied.
+func (m *Migrator)Up(ctx context.Context, target int)(applied []Migration, err error){
+	versions, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	for _, mg := range m.migrations {
+		if target > 0 && mg.Version > target {
+			break
+		}
+		if _, ok := versions[mg.Version]; ok {
+			continue
+		}
+		loger.Infof("Applying migration %d_%s", mg.Version, mg.Name)
+		if err = m.run(ctx, mg, true); err != nil {
+			return
+		}
+		applied = append(applied, mg)
+	}
+	return
+}
+
+// Down reverts the last steps applied migrations
+func (m *Migrator)Down(ctx context.Context, steps int)(reverted []Migration, err error){
+	versions, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		mg := m.migrations[i]
+		if _, ok := versions[mg.Version]; !ok {
+			continue
+		}
+		loger.Infof("Reverting migration %d_%s", mg.Version, mg.Name)
+		if err = m.run(ctx, mg, false); err != nil {
+			return
+		}
+		reverted = append(reverted, mg)
+	}
+	return
+}
+
+// migrateUp is called at startup by the SQL based DataAPIs
+func migrateUp(db *sql.DB, dialect string)(err error){
+	m, err := NewMigrator(db, dialect)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	applied, err := m.Up(ctx, 0)
+	if err != nil {
+		return
+	}
+	if len(applied) != 0 {
+		loger.Infof("Database schema is migrated to version %d", applied[len(applied) - 1].Version)
+	}
+	return
+}
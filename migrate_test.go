@@ -0,0 +1,90 @@
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMigrateUpDown(t *testing.T){
+	db, err := openSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %v", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "sqlite")
+	if err != nil {
+		t.Fatalf("Cannot load migrations: %v", err)
+	}
+	ctx := context.Background()
+
+	applied, err := m.Up(ctx, 0)
+	if err != nil {
+		t.Fatalf("Migrate up failed: %v", err)
+	}
+	if len(applied) == 0 || applied[len(applied) - 1].Version != m.Latest() {
+		t.Fatalf("Expect to apply all migrations, got %v", applied)
+	}
+	if ver, err := m.Version(ctx); err != nil || ver != m.Latest() {
+		t.Errorf("Unexpected version %d, %v", ver, err)
+	}
+	if applied, err = m.Up(ctx, 0); err != nil || len(applied) != 0 {
+		t.Errorf("Second migrate up should do nothing, got %v, %v", applied, err)
+	}
+
+	reverted, err := m.Down(ctx, len(m.migrations))
+	if err != nil {
+		t.Fatalf("Migrate down failed: %v", err)
+	}
+	if len(reverted) != len(m.migrations) {
+		t.Errorf("Expect to revert all migrations, got %v", reverted)
+	}
+	if ok, _ := m.tableExists(ctx, "tokens"); ok {
+		t.Errorf("Table tokens should be dropped")
+	}
+	if _, err = m.Up(ctx, 0); err != nil {
+		t.Fatalf("Migrate up again failed: %v", err)
+	}
+}
+
+func TestMigrateAdoptLegacy(t *testing.T){
+	db, err := openSQLiteDB(":memory:")
+	if err != nil {
+		t.Fatalf("Cannot open sqlite: %v", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "sqlite")
+	if err != nil {
+		t.Fatalf("Cannot load migrations: %v", err)
+	}
+	ctx := context.Background()
+
+	// simulate a database created before the version table exists
+	for _, mg := range m.migrations[:baselineVersion] {
+		for _, stmt := range splitSQLStatements(mg.Up) {
+			if _, err = db.ExecContext(ctx, stmt); err != nil {
+				t.Fatalf("Cannot exec %q: %v", stmt, err)
+			}
+		}
+	}
+	for _, stmt := range []string{
+		"INSERT INTO tokens (`token`) VALUES ('t1')",
+		"INSERT INTO servers (`id`) VALUES ('h1')",
+		"INSERT INTO token_ops (`token`, `server`) VALUES ('t1', 'h1')",
+	} {
+		if _, err = db.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("Cannot exec %q: %v", stmt, err)
+		}
+	}
+	if ver, err := m.Version(ctx); err != nil || ver != baselineVersion {
+		t.Fatalf("Expect legacy version %d, got %d, %v", baselineVersion, ver, err)
+	}
+	if _, err = m.Up(ctx, 0); err != nil {
+		t.Fatalf("Migrate up failed: %v", err)
+	}
+	var role Role
+	if err = db.QueryRowContext(ctx, "SELECT `role` FROM token_grants WHERE `token`='t1' AND `pattern`='h1'").
+		Scan(&role); err != nil || role != RoleOperator {
+		t.Errorf("Server permission should become an operator grant, got %v, %v", role, err)
+	}
+}
@@ -0,0 +1,5 @@
+DROP TABLE cli_web_plugins;
+DROP TABLE daemon_tokens;
+DROP TABLE token_ops;
+DROP TABLE servers;
+DROP TABLE tokens;
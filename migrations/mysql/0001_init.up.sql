@@ -1,6 +1,3 @@
-
-use ccWs2;
-
 CREATE TABLE tokens (
 	`token`      CHAR(64) NOT NULL,
 	`root`       BOOLEAN NOT NULL DEFAULT FALSE,
@@ -8,8 +5,6 @@ CREATE TABLE tokens (
 	PRIMARY KEY (`token`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 
-ALTER TABLE tokens ADD `username`   VARCHAR(64) DEFAULT NULL;
-
 CREATE TABLE servers (
 	`id` VARCHAR(64) NOT NULL,
 	PRIMARY KEY (`id`)
@@ -0,0 +1 @@
+ALTER TABLE tokens ADD `username` VARCHAR(64) DEFAULT NULL;
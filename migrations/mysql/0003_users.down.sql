@@ -0,0 +1,2 @@
+DROP INDEX tokens_username ON tokens;
+DROP TABLE users;
@@ -0,0 +1,13 @@
+CREATE TABLE users (
+	`username`   VARCHAR(64) NOT NULL,
+	`password`   VARCHAR(128) NOT NULL DEFAULT '', -- bcrypt hash, empty if password login is disabled
+	`created_at` DATETIME NOT NULL,
+	PRIMARY KEY (`username`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- keep the usernames that were set by hand before
+INSERT INTO users (`username`, `created_at`)
+	SELECT DISTINCT `username`, UTC_TIMESTAMP() FROM tokens
+	WHERE `username` IS NOT NULL;
+
+CREATE INDEX tokens_username ON tokens (`username`);
@@ -0,0 +1,19 @@
+CREATE TABLE token_ops (
+	`token`  CHAR(64) NOT NULL,
+	`server` VARCHAR(64) NOT NULL,
+	PRIMARY KEY (`token`, `server`),
+	CONSTRAINT op_token FOREIGN KEY (`token`)
+	REFERENCES tokens(`token`) ON DELETE CASCADE ON UPDATE CASCADE,
+	CONSTRAINT op_server FOREIGN KEY (`server`)
+	REFERENCES servers(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+-- only the grants on existing servers can be kept, group and pattern grants are lost
+INSERT INTO token_ops (`token`, `server`)
+	SELECT `token`, `pattern` FROM token_grants
+	WHERE `pattern` IN (SELECT `id` FROM servers);
+
+DROP TABLE group_grants;
+DROP TABLE token_group_members;
+DROP TABLE token_groups;
+DROP TABLE token_grants;
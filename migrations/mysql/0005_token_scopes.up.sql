@@ -0,0 +1,2 @@
+-- scopes are separated by spaces, NULL if the token is not limited
+ALTER TABLE tokens ADD `scopes` VARCHAR(255) DEFAULT NULL;
@@ -0,0 +1,12 @@
+-- every device that has ever connected, so the offline ones can still be listed
+CREATE TABLE devices (
+	`host`       VARCHAR(64) NOT NULL,
+	`id`         BIGINT NOT NULL,
+	`type`       VARCHAR(32) NOT NULL DEFAULT '',
+	`label`      VARCHAR(128) NOT NULL DEFAULT '',
+	`note`       VARCHAR(1024) NOT NULL DEFAULT '',
+	`first_seen` BIGINT NOT NULL, -- unix milliseconds
+	`last_seen`  BIGINT NOT NULL, -- unix milliseconds
+	`last_addr`  VARCHAR(64) NOT NULL DEFAULT '',
+	PRIMARY KEY (`host`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
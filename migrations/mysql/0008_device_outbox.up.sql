@@ -0,0 +1,14 @@
+-- the durable outbox of the devices, the messages are delivered in id order when the device connects
+CREATE TABLE device_outbox (
+	`id`           BIGINT NOT NULL AUTO_INCREMENT,
+	`host`         VARCHAR(64) NOT NULL,
+	`device`       BIGINT NOT NULL,
+	`data`         MEDIUMTEXT NOT NULL,
+	`status`       VARCHAR(16) NOT NULL,
+	`created_at`   BIGINT NOT NULL, -- unix milliseconds
+	`expires_at`   BIGINT NOT NULL, -- unix milliseconds
+	`delivered_at` BIGINT, -- unix milliseconds
+	PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE INDEX device_outbox_device ON device_outbox (`host`, `device`, `status`);
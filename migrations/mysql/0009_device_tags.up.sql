@@ -0,0 +1,2 @@
+-- the tags of the devices that are set by the admins, separated by spaces
+ALTER TABLE devices ADD `tags` VARCHAR(2200) NOT NULL DEFAULT '';
@@ -0,0 +1,35 @@
+CREATE TABLE tokens (
+	`token`      CHAR(64) NOT NULL,
+	`root`       BOOLEAN NOT NULL DEFAULT FALSE,
+	`expiration` INTEGER, -- unix timestamp, NULL if never expired
+	PRIMARY KEY (`token`)
+);
+
+CREATE TABLE servers (
+	`id` VARCHAR(64) NOT NULL,
+	PRIMARY KEY (`id`)
+);
+
+CREATE TABLE token_ops (
+	`token`  CHAR(64) NOT NULL,
+	`server` VARCHAR(64) NOT NULL,
+	PRIMARY KEY (`token`, `server`),
+	FOREIGN KEY (`token`) REFERENCES tokens(`token`) ON DELETE CASCADE ON UPDATE CASCADE,
+	FOREIGN KEY (`server`) REFERENCES servers(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE daemon_tokens (
+	`token`      CHAR(64) NOT NULL,
+	`server`     VARCHAR(64) NOT NULL,
+	`expiration` INTEGER, -- unix timestamp, NULL if never expired
+	PRIMARY KEY (`token`),
+	FOREIGN KEY (`server`) REFERENCES servers(`id`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE cli_web_plugins (
+	`token`   CHAR(64) NOT NULL,
+	`plugin`  VARCHAR(128) NOT NULL,
+	`version` VARCHAR(64) NOT NULL,
+	PRIMARY KEY (`token`, `plugin`),
+	FOREIGN KEY (`token`) REFERENCES tokens(`token`) ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,2 @@
+DROP INDEX tokens_username;
+DROP TABLE users;
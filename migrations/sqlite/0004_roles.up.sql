@@ -0,0 +1,36 @@
+CREATE TABLE token_grants (
+	`token`   CHAR(64) NOT NULL,
+	`pattern` VARCHAR(64) NOT NULL, -- host id or a pattern such as "prod-*"
+	`role`    VARCHAR(16) NOT NULL, -- viewer, operator or admin
+	PRIMARY KEY (`token`, `pattern`),
+	FOREIGN KEY (`token`) REFERENCES tokens(`token`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- a server permission used to allow everything except token management
+INSERT INTO token_grants (`token`, `pattern`, `role`)
+	SELECT `token`, `server`, 'operator' FROM token_ops;
+
+DROP TABLE token_ops;
+
+CREATE TABLE token_groups (
+	`name` VARCHAR(64) NOT NULL,
+	PRIMARY KEY (`name`)
+);
+
+CREATE TABLE token_group_members (
+	`group` VARCHAR(64) NOT NULL,
+	`token` CHAR(64) NOT NULL,
+	PRIMARY KEY (`group`, `token`),
+	FOREIGN KEY (`group`) REFERENCES token_groups(`name`) ON DELETE CASCADE ON UPDATE CASCADE,
+	FOREIGN KEY (`token`) REFERENCES tokens(`token`) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX token_group_members_token ON token_group_members (`token`);
+
+CREATE TABLE group_grants (
+	`group`   VARCHAR(64) NOT NULL,
+	`pattern` VARCHAR(64) NOT NULL,
+	`role`    VARCHAR(16) NOT NULL,
+	PRIMARY KEY (`group`, `pattern`),
+	FOREIGN KEY (`group`) REFERENCES token_groups(`name`) ON DELETE CASCADE ON UPDATE CASCADE
+);
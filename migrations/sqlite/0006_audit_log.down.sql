@@ -0,0 +1,3 @@
+DROP INDEX audit_log_action;
+DROP INDEX audit_log_time;
+DROP TABLE audit_log;
@@ -0,0 +1,14 @@
+CREATE TABLE audit_log (
+	`id`      INTEGER PRIMARY KEY AUTOINCREMENT,
+	`time`    BIGINT NOT NULL, -- unix milliseconds
+	`action`  VARCHAR(32) NOT NULL,
+	`token`   VARCHAR(16) NOT NULL DEFAULT '', -- masked token
+	`user`    VARCHAR(64) NOT NULL DEFAULT '',
+	`addr`    VARCHAR(64) NOT NULL DEFAULT '',
+	`host`    VARCHAR(64) NOT NULL DEFAULT '',
+	`device`  BIGINT,
+	`summary` TEXT NOT NULL
+);
+
+CREATE INDEX audit_log_time ON audit_log (`time`);
+CREATE INDEX audit_log_action ON audit_log (`action`);
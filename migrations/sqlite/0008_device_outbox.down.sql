@@ -0,0 +1,2 @@
+DROP INDEX device_outbox_device;
+DROP TABLE device_outbox;
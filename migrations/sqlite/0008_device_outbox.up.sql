@@ -0,0 +1,13 @@
+-- the durable outbox of the devices, the messages are delivered in id order when the device connects
+CREATE TABLE device_outbox (
+	`id`           INTEGER PRIMARY KEY AUTOINCREMENT,
+	`host`         VARCHAR(64) NOT NULL,
+	`device`       BIGINT NOT NULL,
+	`data`         TEXT NOT NULL,
+	`status`       VARCHAR(16) NOT NULL,
+	`created_at`   BIGINT NOT NULL, -- unix milliseconds
+	`expires_at`   BIGINT NOT NULL, -- unix milliseconds
+	`delivered_at` BIGINT -- unix milliseconds
+);
+
+CREATE INDEX device_outbox_device ON device_outbox (`host`, `device`, `status`);
@@ -0,0 +1,149 @@
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	outboxSweepInterval = time.Minute
+	// outboxStatusKeep is how long the delivery status of a message can be queried after it's queued
+	outboxStatusKeep = 24 * time.Hour
+)
+
+var MessageTooLargeErr = errors.New("Message is too large to be queued")
+
+// OutboxConfig enables the durable outbox of the devices,
+// the packets to an offline device are queued and delivered in order when it connects
+type OutboxConfig struct {
+	// TTL is the seconds before a queued message expires
+	TTL int `json:"ttl"`
+	// MaxMessages is the queued messages that a device can have
+	MaxMessages int `json:"max_messages"`
+	// MaxMessageSize is the bytes of a queued message in JSON
+	MaxMessageSize int `json:"max_message_size"`
+}
+
+var defaultOutboxConfig = OutboxConfig{
+	TTL: 60 * 60,
+	MaxMessages: 256,
+	MaxMessageSize: 64 * 1024,
+}
+
+// SetOutbox enables the durable outbox of the devices, nil disables it.
+// The zero fields of cfg are set to the defaults. It must be called before serving
+func (h *Handler)SetOutbox(cfg *OutboxConfig){
+	if cfg != nil {
+		if cfg.TTL <= 0 {
+			cfg.TTL = defaultOutboxConfig.TTL
+		}
+		if cfg.MaxMessages <= 0 {
+			cfg.MaxMessages = defaultOutboxConfig.MaxMessages
+		}
+		if cfg.MaxMessageSize <= 0 {
+			cfg.MaxMessageSize = defaultOutboxConfig.MaxMessageSize
+		}
+	}
+	h.outbox = cfg
+}
+
+// SendToDevice sends the packet to the device if it's online.
+// Otherwise it's queued to the durable outbox if that is enabled, and msg is the queued message.
+// Without the outbox, the packet can only be buffered by a live session of the device
+func (h *Handler)SendToDevice(hostid string, device int64, data Map)(msg *QueuedMessage, err error){
+	var conn *Conn
+	if host := h.GetHost(hostid); host != nil {
+		conn = host.GetConn(device)
+	}
+	if h.outbox == nil {
+		if conn == nil {
+			return nil, fmt.Errorf("Device %d is not connected", device)
+		}
+		return nil, conn.send(data)
+	}
+	if conn != nil {
+		// hold the outbox, so the packet is not sent before the queued ones are flushed
+		conn.outboxMux.Lock()
+		defer conn.outboxMux.Unlock()
+		if conn.outboxReady && conn.Online() {
+			return nil, conn.send(data)
+		}
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	if h.outbox.MaxMessageSize > 0 && len(buf) > h.outbox.MaxMessageSize {
+		return nil, MessageTooLargeErr
+	}
+	now := time.Now()
+	msg = &QueuedMessage{
+		Host: hostid,
+		Device: device,
+		Data: data,
+		CreatedAt: now,
+		ExpiresAt: now.Add((time.Duration)(h.outbox.TTL) * time.Second),
+	}
+	if err = h.QueueMessage(msg, h.outbox.MaxMessages); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// flushOutbox delivers the queued messages of the device after it connected,
+// and then lets the new packets be sent directly.
+// It stops if the device drops again, the rest of the messages are kept for the next connection
+func (h *Handler)flushOutbox(hostid string, conn *Conn){
+	if h.outbox == nil {
+		return
+	}
+	conn.outboxMux.Lock()
+	defer conn.outboxMux.Unlock()
+	msgs, err := h.PendingMessages(hostid, conn.Id(), time.Now())
+	if err != nil {
+		loger.Errorf("Cannot load the outbox of device %d of %s: %v", conn.Id(), hostid, err)
+		return
+	}
+	for _, m := range msgs {
+		if !conn.Online() {
+			return
+		}
+		// the message is only delivered after it's written to the socket
+		if err := conn.flush(m.Data); err != nil {
+			loger.Warnf("Cannot deliver queued message %d: %v", m.Id, err)
+			return
+		}
+		if err := h.SetMessageDelivered(m.Id, time.Now()); err != nil {
+			loger.Errorf("Cannot mark message %d delivered: %v", m.Id, err)
+		}
+	}
+	if len(msgs) != 0 {
+		loger.Infof("Delivered %d queued messages to device %d of %s", len(msgs), conn.Id(), hostid)
+	}
+	conn.outboxReady = conn.Online()
+}
+
+// StartOutboxSweeper expires the queued messages and removes the old ones until the handler is closed
+func (h *Handler)StartOutboxSweeper(){
+	go func(){
+		ticker := time.NewTicker(outboxSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				now := time.Now()
+				n, err := h.SweepMessages(now, now.Add(-outboxStatusKeep))
+				if err != nil {
+					loger.Errorf("Cannot sweep the device outbox: %v", err)
+				}else if n > 0 {
+					loger.Infof("%d queued messages expired", n)
+				}
+			case <-h.ctx.Done():
+				return
+			}
+		}
+	}()
+}
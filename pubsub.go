@@ -0,0 +1,180 @@
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxTopicLength = 256
+	// maxRetainedTopics is the retained values that a host can keep
+	maxRetainedTopics = 1024
+)
+
+var RetainedFullErr = errors.New("Too many retained topics on the host")
+
+// ChannelMessage is a message published to a topic of a host
+type ChannelMessage struct {
+	Host    string    `json:"host"`
+	Topic   string    `json:"topic"`
+	Payload any       `json:"payload"`
+	// From is the device that published the message, nil if it's published by a client
+	From     Map       `json:"from"`
+	Time     time.Time `json:"time"`
+	// Retained is true if the message is the retained value sent on subscribe
+	Retained bool      `json:"retained"`
+}
+
+// checkTopic validates a topic, patterns may contain the wildcards.
+// "*" matches exactly one level, and "#" as the last level matches its parent level and any levels after it
+func checkTopic(topic string, pattern bool)(err error){
+	if len(topic) == 0 || len(topic) > maxTopicLength {
+		return fmt.Errorf("Topic must be 1 to %d characters", maxTopicLength)
+	}
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		if len(l) == 0 {
+			return fmt.Errorf("Topic %q has an empty level", topic)
+		}
+		if l == "*" || l == "#" {
+			if !pattern {
+				return fmt.Errorf("Topic %q cannot contain wildcards", topic)
+			}
+			if l == "#" && i != len(levels) - 1 {
+				return fmt.Errorf("Wildcard '#' must be the last level of %q", topic)
+			}
+		}else if strings.ContainsAny(l, "*#") {
+			return fmt.Errorf("Wildcard must be a whole level in %q", topic)
+		}
+	}
+	return nil
+}
+
+// matchTopic reports whether the topic matches the pattern, both of them must be valid
+func matchTopic(pattern string, topic string)(bool){
+	for {
+		p, prest, pmore := strings.Cut(pattern, "/")
+		if p == "#" {
+			return true
+		}
+		t, trest, tmore := strings.Cut(topic, "/")
+		if p != "*" && p != t {
+			return false
+		}
+		if !tmore {
+			// the multi-level wildcard also matches the parent level
+			return !pmore || prest == "#"
+		}
+		if !pmore {
+			return false
+		}
+		pattern, topic = prest, trest
+	}
+}
+
+// Broker is the pub/sub channels of a host.
+// Subscribers are identified by an owner, which is usually a *Conn or a *CliConn
+type Broker struct {
+	host string
+
+	mux      sync.RWMutex
+	subs     map[any]map[string]func(ChannelMessage)
+	retained map[string]ChannelMessage
+}
+
+func NewBroker(host string)(*Broker){
+	return &Broker{
+		host: host,
+		subs: make(map[any]map[string]func(ChannelMessage)),
+		retained: make(map[string]ChannelMessage),
+	}
+}
+
+// Subscribe calls fn with the messages that match the pattern,
+// the retained values that match it are delivered before it returns
+func (b *Broker)Subscribe(owner any, pattern string, fn func(ChannelMessage))(err error){
+	if err = checkTopic(pattern, true); err != nil {
+		return
+	}
+	b.mux.Lock()
+	subs, ok := b.subs[owner]
+	if !ok {
+		subs = make(map[string]func(ChannelMessage))
+		b.subs[owner] = subs
+	}
+	subs[pattern] = fn
+	var retained []ChannelMessage
+	for topic, msg := range b.retained {
+		if matchTopic(pattern, topic) {
+			retained = append(retained, msg)
+		}
+	}
+	b.mux.Unlock()
+	for _, msg := range retained {
+		msg.Retained = true
+		fn(msg)
+	}
+	return
+}
+
+func (b *Broker)Unsubscribe(owner any, pattern string){
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if subs, ok := b.subs[owner]; ok {
+		delete(subs, pattern)
+		if len(subs) == 0 {
+			delete(b.subs, owner)
+		}
+	}
+}
+
+func (b *Broker)UnsubscribeAll(owner any){
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	delete(b.subs, owner)
+}
+
+// Publish delivers the message to the subscribers and returns how many of them received it.
+// If retain is true the message is kept as the last value of the topic, and a nil payload clears it
+func (b *Broker)Publish(topic string, payload any, from Map, retain bool)(n int, err error){
+	if err = checkTopic(topic, false); err != nil {
+		return
+	}
+	msg := ChannelMessage{
+		Host: b.host,
+		Topic: topic,
+		Payload: payload,
+		From: from,
+		Time: time.Now(),
+	}
+	var fns []func(ChannelMessage)
+	b.mux.Lock()
+	if retain {
+		if payload == nil {
+			delete(b.retained, topic)
+		}else if _, ok := b.retained[topic]; ok || len(b.retained) < maxRetainedTopics {
+			b.retained[topic] = msg
+		}else{
+			b.mux.Unlock()
+			return 0, RetainedFullErr
+		}
+	}
+	for _, subs := range b.subs {
+		// an owner receives a message once even if more than one of its patterns match
+		for pattern, fn := range subs {
+			if matchTopic(pattern, topic) {
+				fns = append(fns, fn)
+				break
+			}
+		}
+	}
+	b.mux.Unlock()
+	for _, fn := range fns {
+		fn(msg)
+	}
+	return len(fns), nil
+}
@@ -0,0 +1,70 @@
+
+package main
+
+import (
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T){
+	cases := []struct {
+		pattern string
+		topic   string
+		match   bool
+	}{
+		{"power/main/level", "power/main/level", true},
+		{"power/*/level", "power/main/level", true},
+		{"power/*/level", "power/main/backup/level", false},
+		{"power/*", "power/main/level", false},
+		{"power/#", "power/main/level", true},
+		{"power/#", "power", true},
+		{"power/*/#", "power/main", true},
+		{"power/*/#", "power", false},
+		{"power/main/#", "power", false},
+		{"#", "power/main", true},
+		{"power/main", "power/main/level", false},
+		{"power/main/level", "power/main", false},
+	}
+	for _, c := range cases {
+		if matchTopic(c.pattern, c.topic) != c.match {
+			t.Errorf("Expect %q matches %q: %v", c.pattern, c.topic, c.match)
+		}
+	}
+	for _, topic := range []string{"", "a//b", "a/#/b", "a/b*", "a/*"} {
+		if checkTopic(topic, false) == nil {
+			t.Errorf("Expect topic %q to be invalid", topic)
+		}
+	}
+	if err := checkTopic("a/*/#", true); err != nil {
+		t.Errorf("Expect pattern to be valid, got %v", err)
+	}
+}
+
+func TestBrokerRetained(t *testing.T){
+	b := NewBroker("h1")
+	if _, err := b.Publish("power/main/level", 10, nil, true); err != nil {
+		t.Fatalf("Cannot publish: %v", err)
+	}
+	b.Publish("power/main/level", 20, nil, true)
+	b.Publish("power/backup/level", 5, nil, false)
+
+	var got []ChannelMessage
+	if err := b.Subscribe("sub", "power/*/level", func(msg ChannelMessage){
+		got = append(got, msg)
+	}); err != nil {
+		t.Fatalf("Cannot subscribe: %v", err)
+	}
+	if len(got) != 1 || got[0].Payload != 20 || !got[0].Retained {
+		t.Fatalf("Expect the latest retained value, got %v", got)
+	}
+	if n, _ := b.Publish("power/backup/level", 6, nil, false); n != 1 || len(got) != 2 || got[1].Retained {
+		t.Errorf("Expect the message to be delivered, got %v", got)
+	}
+	b.Publish("power/main/level", nil, nil, true)
+	b.UnsubscribeAll("sub")
+	if n, _ := b.Publish("power/main/level", 30, nil, false); n != 0 {
+		t.Errorf("Expect no subscriber, got %d", n)
+	}
+	b.Subscribe("sub", "power/#", func(msg ChannelMessage){
+		t.Errorf("Expect the retained value to be cleared, got %v", msg)
+	})
+}
@@ -0,0 +1,370 @@
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxLockoutEvents = 100
+	limiterSweepInterval = time.Minute
+)
+
+type RateLimitConfig struct {
+	// Rate is the auth attempts per second allowed for one ip or token prefix, 0 disables the rate limit
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// MaxFailures is the failed attempts within FailureWindow seconds that cause a lockout, 0 disables the lockout
+	MaxFailures   int `json:"max_failures"`
+	FailureWindow int `json:"failure_window"`
+	// LockoutBase is the seconds of the first lockout, it doubles with each lockout in a row up to LockoutMax
+	LockoutBase int `json:"lockout_base"`
+	LockoutMax  int `json:"lockout_max"`
+	// Allowlist are the ips or CIDRs that are never limited
+	Allowlist []string `json:"allowlist"`
+	// TrustedProxies are the ips or CIDRs of the reverse proxies in front of the server,
+	// the attempts from them are counted by the client ip in X-Forwarded-For.
+	// Without it all the clients behind a proxy share one ip and can lock out each other
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+var defaultRateLimitConfig = RateLimitConfig{
+	Rate: 5,
+	Burst: 30,
+	MaxFailures: 10,
+	FailureWindow: 5 * 60,
+	LockoutBase: 60,
+	LockoutMax: 60 * 60,
+}
+
+// LockoutEvent records that a key was locked out
+type LockoutEvent struct {
+	// Key is either "ip:<addr>" or "token:<prefix>"
+	Key      string    `json:"key"`
+	Time     time.Time `json:"time"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
+
+// AuthLimitedErr is returned when the attempt is rejected, RetryAfter is how long the caller should wait
+type AuthLimitedErr struct {
+	Key        string
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *AuthLimitedErr)Error()(string){
+	if e.Locked {
+		return fmt.Sprintf("%s is locked out, retry after %s", e.Key, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("Too many attempts from %s, retry after %s", e.Key, e.RetryAfter.Round(time.Second))
+}
+
+type limiterEntry struct {
+	tokens   float64
+	lastFill time.Time
+
+	failures    []time.Time
+	lockedUntil time.Time
+	// streak is the count of the lockouts in a row, it resets after a quiet period
+	streak      int
+}
+
+// AuthLimiter throttles the authentication attempts by the ip and the token prefix,
+// so guessing tokens cannot hammer the database
+type AuthLimiter struct {
+	cfg       RateLimitConfig
+	allowIPs  []net.IP
+	allowNets []*net.IPNet
+	proxyIPs  []net.IP
+	proxyNets []*net.IPNet
+
+	mux       sync.Mutex
+	entries   map[string]*limiterEntry
+	events    []LockoutEvent
+	lastSweep time.Time
+
+	// OnLockout is called without the lock held when a key is locked out
+	OnLockout func(event LockoutEvent)
+}
+
+func NewAuthLimiter(cfg RateLimitConfig)(l *AuthLimiter, err error){
+	l = &AuthLimiter{
+		cfg: cfg,
+		entries: make(map[string]*limiterEntry),
+	}
+	if l.allowIPs, l.allowNets, err = parseIPList(cfg.Allowlist); err != nil {
+		return nil, fmt.Errorf("Invalid allowlist entry %w", err)
+	}
+	if l.proxyIPs, l.proxyNets, err = parseIPList(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("Invalid trusted proxy %w", err)
+	}
+	if l.cfg.Burst <= 0 {
+		l.cfg.Burst = 1
+	}
+	return
+}
+
+// parseIPList parses the entries which are either ips or CIDRs
+func parseIPList(entries []string)(ips []net.IP, nets []*net.IPNet, err error){
+	for _, a := range entries {
+		if _, n, er := net.ParseCIDR(a); er == nil {
+			nets = append(nets, n)
+		}else if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, ip)
+		}else{
+			return nil, nil, fmt.Errorf("%q", a)
+		}
+	}
+	return
+}
+
+func containsIP(ips []net.IP, nets []*net.IPNet, addr net.IP)(bool){
+	for _, a := range ips {
+		if a.Equal(addr) {
+			return true
+		}
+	}
+	for _, n := range nets {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the ip is in the allowlist.
+// Addresses that are not ips, such as the ones from unix sockets, are always allowed
+func (l *AuthLimiter)allowed(ip string)(bool){
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return true
+	}
+	return containsIP(l.allowIPs, l.allowNets, addr)
+}
+
+// ClientIP returns the ip that the attempts of the request are counted by.
+// For a request from a trusted proxy, it is the right-most address in X-Forwarded-For
+// that is not a trusted proxy, since the addresses on the left can be forged by the client
+func (l *AuthLimiter)ClientIP(req *http.Request)(string){
+	ip := remoteIP(req.RemoteAddr)
+	addr := net.ParseIP(ip)
+	if addr == nil || !containsIP(l.proxyIPs, l.proxyNets, addr) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		if addr = net.ParseIP(strings.TrimSpace(hops[i])); addr == nil {
+			break
+		}
+		ip = addr.String()
+		if !containsIP(l.proxyIPs, l.proxyNets, addr) {
+			break
+		}
+	}
+	return ip
+}
+
+// limiterKeys returns the keys of the attempt, the token is cut to its prefix
+func limiterKeys(ip string, token string)(keys []string){
+	keys = []string{"ip:" + ip}
+	if len(token) != 0 {
+		if m := maskToken(token); len(m) != 0 {
+			token = m
+		}else if len(token) > 12 {
+			token = token[:12]
+		}
+		keys = append(keys, "token:" + token)
+	}
+	return
+}
+
+func (l *AuthLimiter)entry(key string, now time.Time)(e *limiterEntry){
+	e = l.entries[key]
+	if e == nil {
+		e = &limiterEntry{
+			tokens: (float64)(l.cfg.Burst),
+			lastFill: now,
+		}
+		l.entries[key] = e
+	}
+	return
+}
+
+func (l *AuthLimiter)lockoutDuration(streak int)(time.Duration){
+	d := (time.Duration)(l.cfg.LockoutBase) * time.Second
+	if streak > 0 {
+		d *= (time.Duration)(math.Pow(2, math.Min((float64)(streak), 30)))
+	}
+	if max := (time.Duration)(l.cfg.LockoutMax) * time.Second; max > 0 && d > max {
+		d = max
+	}
+	return d
+}
+
+// sweep drops the entries that are back to the initial state, it must be called with the lock held
+func (l *AuthLimiter)sweep(now time.Time){
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	window := (time.Duration)(l.cfg.FailureWindow) * time.Second
+	quiet := (time.Duration)(l.cfg.LockoutMax) * time.Second
+	for k, e := range l.entries {
+		if now.Before(e.lockedUntil) {
+			continue
+		}
+		if len(e.failures) != 0 && now.Sub(e.failures[len(e.failures) - 1]) < window {
+			continue
+		}
+		if e.streak > 0 && now.Sub(e.lockedUntil) < quiet {
+			continue
+		}
+		if l.cfg.Rate > 0 && e.tokens + now.Sub(e.lastFill).Seconds() * l.cfg.Rate < (float64)(l.cfg.Burst) {
+			continue
+		}
+		delete(l.entries, k)
+	}
+}
+
+// Allow takes one attempt from the ip and the token, it returns an *AuthLimitedErr if the attempt should be rejected
+func (l *AuthLimiter)Allow(ip string, token string)(error){
+	if l.allowed(ip) {
+		return nil
+	}
+	now := time.Now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.sweep(now)
+
+	keys := limiterKeys(ip, token)
+	for _, k := range keys {
+		e := l.entry(k, now)
+		if now.Before(e.lockedUntil) {
+			return &AuthLimitedErr{Key: k, Locked: true, RetryAfter: e.lockedUntil.Sub(now)}
+		}
+	}
+	if l.cfg.Rate <= 0 {
+		return nil
+	}
+	for _, k := range keys {
+		e := l.entries[k]
+		e.tokens = math.Min((float64)(l.cfg.Burst), e.tokens + now.Sub(e.lastFill).Seconds() * l.cfg.Rate)
+		e.lastFill = now
+		if e.tokens < 1 {
+			wait := (time.Duration)((1 - e.tokens) / l.cfg.Rate * (float64)(time.Second))
+			return &AuthLimitedErr{Key: k, RetryAfter: wait}
+		}
+	}
+	for _, k := range keys {
+		l.entries[k].tokens--
+	}
+	return nil
+}
+
+// Done records the result of an attempt that Allow accepted.
+// A failure counts toward the lockout, a success clears the failures
+func (l *AuthLimiter)Done(ip string, token string, success bool){
+	if l.allowed(ip) {
+		return
+	}
+	now := time.Now()
+	var events []LockoutEvent
+
+	l.mux.Lock()
+	window := (time.Duration)(l.cfg.FailureWindow) * time.Second
+	for _, k := range limiterKeys(ip, token) {
+		e := l.entry(k, now)
+		if success {
+			e.failures = nil
+			continue
+		}
+		if l.cfg.MaxFailures <= 0 {
+			continue
+		}
+		// drop the failures out of the window
+		i := 0
+		for i < len(e.failures) && now.Sub(e.failures[i]) >= window {
+			i++
+		}
+		e.failures = append(e.failures[i:], now)
+		if len(e.failures) < l.cfg.MaxFailures {
+			continue
+		}
+		if e.streak > 0 && now.Sub(e.lockedUntil) >= (time.Duration)(l.cfg.LockoutMax) * time.Second {
+			e.streak = 0
+		}
+		e.lockedUntil = now.Add(l.lockoutDuration(e.streak))
+		e.streak++
+		event := LockoutEvent{
+			Key: k,
+			Time: now.UTC(),
+			Until: e.lockedUntil.UTC(),
+			Failures: len(e.failures),
+		}
+		e.failures = nil
+		events = append(events, event)
+		l.events = append(l.events, event)
+		if len(l.events) > maxLockoutEvents {
+			l.events = l.events[len(l.events) - maxLockoutEvents:]
+		}
+	}
+	l.mux.Unlock()
+
+	for _, event := range events {
+		loger.Warnf("Authentication of %s is locked out until %s after %d failures",
+			event.Key, event.Until.Format(time.RFC3339), event.Failures)
+		if l.OnLockout != nil {
+			l.OnLockout(event)
+		}
+	}
+}
+
+// Lockouts returns the active lockouts and the recent lockout events, both newest first
+func (l *AuthLimiter)Lockouts()(active []LockoutEvent, recent []LockoutEvent){
+	now := time.Now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	for k, e := range l.entries {
+		if now.Before(e.lockedUntil) {
+			ev := LockoutEvent{Key: k, Until: e.lockedUntil.UTC()}
+			// find the event that started the lockout
+			for i := len(l.events) - 1; i >= 0; i-- {
+				if l.events[i].Key == k {
+					ev = l.events[i]
+					break
+				}
+			}
+			active = append(active, ev)
+		}
+	}
+	sort.Slice(active, func(i, j int)(bool){ return active[i].Time.After(active[j].Time) })
+	recent = make([]LockoutEvent, len(l.events))
+	for i, ev := range l.events {
+		recent[len(l.events) - 1 - i] = ev
+	}
+	return
+}
+
+// Unlock clears the lockout and the failures of the key, it reports whether the key was locked
+func (l *AuthLimiter)Unlock(key string)(ok bool){
+	now := time.Now()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	e := l.entries[key]
+	if e == nil {
+		return false
+	}
+	ok = now.Before(e.lockedUntil)
+	e.lockedUntil = time.Time{}
+	e.failures = nil
+	e.streak = 0
+	return
+}
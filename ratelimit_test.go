@@ -0,0 +1,183 @@
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthLimiterLockout(t *testing.T){
+	l, err := NewAuthLimiter(RateLimitConfig{
+		MaxFailures: 3,
+		FailureWindow: 60,
+		LockoutBase: 10,
+		LockoutMax: 25,
+		Allowlist: []string{"10.0.0.0/8", "::1"},
+	})
+	if err != nil {
+		t.Fatalf("Cannot create limiter: %v", err)
+	}
+	var locked []LockoutEvent
+	l.OnLockout = func(event LockoutEvent){
+		locked = append(locked, event)
+	}
+
+	fail := func(ip string, n int){
+		for i := 0; i < n; i++ {
+			if err := l.Allow(ip, ""); err != nil {
+				t.Fatalf("Attempt %d from %s should be allowed, got %v", i, ip, err)
+			}
+			l.Done(ip, "", false)
+		}
+	}
+
+	fail("1.2.3.4", 2)
+	l.Done("1.2.3.4", "", true)
+	fail("1.2.3.4", 2)
+	if len(locked) != 0 {
+		t.Fatalf("A success should clear the failures, but got lockouts %v", locked)
+	}
+	fail("1.2.3.4", 1)
+	if len(locked) != 1 || locked[0].Key != "ip:1.2.3.4" {
+		t.Fatalf("Expect ip:1.2.3.4 to be locked, got %v", locked)
+	}
+	if d := locked[0].Until.Sub(locked[0].Time); d != 10 * time.Second {
+		t.Errorf("Expect the first lockout to be 10s, got %v", d)
+	}
+	var le *AuthLimitedErr
+	if err := l.Allow("1.2.3.4", ""); !errors.As(err, &le) || !le.Locked {
+		t.Errorf("Locked ip should be rejected, got %v", err)
+	}
+	if err := l.Allow("5.6.7.8", ""); err != nil {
+		t.Errorf("Other ips should not be affected, got %v", err)
+	}
+
+	active, recent := l.Lockouts()
+	if len(active) != 1 || len(recent) != 1 {
+		t.Errorf("Expect 1 active and 1 recent lockout, got %v and %v", active, recent)
+	}
+	if !l.Unlock("ip:1.2.3.4") {
+		t.Errorf("Unlock should report the key was locked")
+	}
+	if err := l.Allow("1.2.3.4", ""); err != nil {
+		t.Errorf("Unlocked ip should be allowed, got %v", err)
+	}
+
+	// the lockouts in a row double up to the max
+	fail("5.6.7.8", 3)
+	l.mux.Lock()
+	l.entries["ip:5.6.7.8"].lockedUntil = time.Now()
+	l.mux.Unlock()
+	fail("5.6.7.8", 3)
+	if len(locked) != 3 {
+		t.Fatalf("Expect 3 lockouts, got %v", locked)
+	}
+	if d := locked[2].Until.Sub(locked[2].Time); d != 20 * time.Second {
+		t.Errorf("Expect the second lockout to be 20s, got %v", d)
+	}
+	if d := l.lockoutDuration(5); d != 25 * time.Second {
+		t.Errorf("Expect lockout to be capped at 25s, got %v", d)
+	}
+
+	fail("10.1.2.3", 10)
+	fail("::1", 10)
+	fail("@", 10)
+	if len(locked) != 3 {
+		t.Errorf("Allowlisted addresses should never be locked, got %v", locked)
+	}
+}
+
+func TestAuthLimiterRate(t *testing.T){
+	l, err := NewAuthLimiter(RateLimitConfig{
+		Rate: 1,
+		Burst: 3,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create limiter: %v", err)
+	}
+	token := cliTokenPrefix + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("1.2.3.4", token); err != nil {
+			t.Fatalf("Attempt %d should be allowed, got %v", i, err)
+		}
+	}
+	var le *AuthLimitedErr
+	if err := l.Allow("1.2.3.4", token); !errors.As(err, &le) || le.Locked || le.RetryAfter <= 0 {
+		t.Errorf("Attempt over the burst should be rate limited, got %v", err)
+	}
+	// the same token prefix is also limited from another ip
+	if err := l.Allow("5.6.7.8", token); !errors.As(err, &le) || le.Key != "token:" + maskToken(token) {
+		t.Errorf("Token prefix should be rate limited, got %v", err)
+	}
+	if err := l.Allow("5.6.7.8", ""); err != nil {
+		t.Errorf("Another ip without the token should be allowed, got %v", err)
+	}
+
+	if _, err := NewAuthLimiter(RateLimitConfig{Allowlist: []string{"not an ip"}}); err == nil {
+		t.Errorf("Invalid allowlist entry should be rejected")
+	}
+}
+
+func TestLimitAuthSelfLookup(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	bad := cliTokenPrefix + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	// the unknown tokens looking up themselves are failed guesses
+	for _, path := range []string{"/api/perm_servers", "/api/perm_servers?token=" + bad,
+		"/api/grants?token=" + bad, "/api/token_scopes?token=" + bad} {
+		limiter, err := NewAuthLimiter(RateLimitConfig{MaxFailures: 2, FailureWindow: 60, LockoutBase: 60})
+		if err != nil {
+			t.Fatalf("Cannot create limiter: %v", err)
+		}
+		h := NewHandler(api, nil, nil)
+		h.SetAuthLimiter(limiter)
+		mux := h.NewServeMux()
+		for i, expect := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Authorization", bad)
+			rw := httptest.NewRecorder()
+			mux.ServeHTTP(rw, req)
+			if rw.Code != expect {
+				t.Errorf("Expect attempt %d on %s to be %d, got %d", i, path, expect, rw.Code)
+			}
+		}
+	}
+}
+
+func TestAuthLimiterClientIP(t *testing.T){
+	l, err := NewAuthLimiter(RateLimitConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("Cannot create limiter: %v", err)
+	}
+	cases := []struct {
+		remote string
+		forwarded []string
+		expect string
+	}{
+		{"1.2.3.4:5", nil, "1.2.3.4"},
+		// the clients that are not proxies cannot set their ip
+		{"1.2.3.4:5", []string{"5.6.7.8"}, "1.2.3.4"},
+		{"10.0.0.1:5", []string{"5.6.7.8"}, "5.6.7.8"},
+		{"10.0.0.1:5", []string{"9.9.9.9, 5.6.7.8", "10.0.0.2"}, "5.6.7.8"},
+		{"10.0.0.1:5", []string{"5.6.7.8, bad"}, "10.0.0.1"},
+		{"10.0.0.1:5", nil, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/api/tokens", nil)
+		req.RemoteAddr = c.remote
+		for _, f := range c.forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		if ip := l.ClientIP(req); ip != c.expect {
+			t.Errorf("Expect client ip of %s %v to be %s, got %s", c.remote, c.forwarded, c.expect, ip)
+		}
+	}
+	if _, err := NewAuthLimiter(RateLimitConfig{TrustedProxies: []string{"proxy"}}); err == nil {
+		t.Errorf("Invalid trusted proxy should be rejected")
+	}
+}
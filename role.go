@@ -0,0 +1,147 @@
+
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Role is the permission level of a token on a host.
+// A higher role includes everything the lower roles can do.
+type Role int
+
+const (
+	RoleNone Role = iota
+	// RoleViewer can list the devices and watch their terminals
+	RoleViewer
+	// RoleOperator can also run programs, exec codes and send events or broadcasts to the devices
+	RoleOperator
+	// RoleAdmin can also grant roles on the host to other tokens
+	RoleAdmin
+)
+
+var roleNames = [...]string{
+	RoleNone: "none",
+	RoleViewer: "viewer",
+	RoleOperator: "operator",
+	RoleAdmin: "admin",
+}
+
+var (
+	InvalidRoleErr = errors.New("Invalid role")
+	InvalidPatternErr = errors.New("Invalid host pattern")
+	GroupNotExistsErr = errors.New("Group not exists")
+	GroupExistsErr = errors.New("Group already exists")
+)
+
+func ParseRole(s string)(r Role, err error){
+	if len(s) == 0 {
+		return RoleNone, nil
+	}
+	for i, name := range roleNames {
+		if name == s {
+			return (Role)(i), nil
+		}
+	}
+	return RoleNone, fmt.Errorf("%w %q", InvalidRoleErr, s)
+}
+
+func (r Role)String()(string){
+	if r < 0 || (int)(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", (int)(r))
+	}
+	return roleNames[r]
+}
+
+func (r Role)MarshalJSON()([]byte, error){
+	return json.Marshal(r.String())
+}
+
+func (r *Role)UnmarshalJSON(buf []byte)(err error){
+	var s string
+	if err = json.Unmarshal(buf, &s); err != nil {
+		return
+	}
+	*r, err = ParseRole(s)
+	return
+}
+
+// Value implements driver.Valuer, roles are saved as their names in the database
+func (r Role)Value()(driver.Value, error){
+	return r.String(), nil
+}
+
+// Scan implements sql.Scanner
+func (r *Role)Scan(src any)(err error){
+	switch s := src.(type) {
+	case string:
+		*r, err = ParseRole(s)
+	case []byte:
+		*r, err = ParseRole((string)(s))
+	default:
+		return fmt.Errorf("Cannot scan %T into Role", src)
+	}
+	return
+}
+
+// HostGrant gives a role on the hosts that match the pattern.
+// The pattern is either a host id or a path.Match pattern such as "prod-*"
+type HostGrant struct {
+	Pattern string `json:"pattern"`
+	Role    Role   `json:"role"`
+}
+
+type Group struct {
+	Name    string      `json:"name"`
+	Members []string    `json:"members"`
+	Grants  []HostGrant `json:"grants"`
+}
+
+func checkHostPattern(pattern string)(err error){
+	if len(pattern) == 0 || len(pattern) > 64 {
+		return InvalidPatternErr
+	}
+	if _, err = path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%w %q: %v", InvalidPatternErr, pattern, err)
+	}
+	return nil
+}
+
+// isHostPattern reports whether the pattern can match more than one host
+func isHostPattern(pattern string)(bool){
+	return strings.ContainsAny(pattern, "*?[\\")
+}
+
+func matchHost(pattern string, host string)(bool){
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
+
+// resolveRole returns the highest role that the grants give on the host
+func resolveRole(grants []HostGrant, host string)(role Role){
+	for _, g := range grants {
+		if g.Role > role && matchHost(g.Pattern, host) {
+			role = g.Role
+		}
+	}
+	return
+}
+
+// filterHosts returns the hosts that the grants give at least the role on
+func filterHosts(grants []HostGrant, hosts []string, role Role)(res []string){
+	for _, h := range hosts {
+		if resolveRole(grants, h) >= role {
+			res = append(res, h)
+		}
+	}
+	return
+}
+
+func sortGrants(grants []HostGrant){
+	sort.Slice(grants, func(i, j int)(bool){ return grants[i].Pattern < grants[j].Pattern })
+}
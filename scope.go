@@ -0,0 +1,97 @@
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Scopes limit what a cli token can do, on top of its roles.
+// A token without any scope is not limited, so the tokens created before scopes existed keep working.
+const (
+	// ScopeHostsRead allows listing the hosts and the devices connected to them
+	ScopeHostsRead = "hosts:read"
+	// ScopeTerminalRead allows reading the terminals of the devices
+	ScopeTerminalRead = "terminal:read"
+	// ScopeDeviceExec allows running programs, executing codes and firing events on the devices
+	ScopeDeviceExec = "device:exec"
+	// ScopeBroadcast allows broadcasting to the devices of a host or to other clients
+	ScopeBroadcast = "broadcast"
+	// ScopePluginsWrite allows installing and changing web plugins
+	ScopePluginsWrite = "plugins:write"
+	// ScopeAdmin allows a root token to manage tokens, users, servers and roles
+	ScopeAdmin = "admin"
+)
+
+var allScopes = []string{
+	ScopeHostsRead,
+	ScopeTerminalRead,
+	ScopeDeviceExec,
+	ScopeBroadcast,
+	ScopePluginsWrite,
+	ScopeAdmin,
+}
+
+// parseScopes parses a list of scopes separated by commas or spaces
+func parseScopes(s string)(scopes []string, err error){
+	seen := make(map[string]struct{})
+	for _, scope := range strings.FieldsFunc(s, func(c rune)(bool){ return c == ',' || c == ' ' }) {
+		if _, ok := seen[scope]; ok {
+			continue
+		}
+		if !isValidScope(scope) {
+			return nil, fmt.Errorf("Unknown scope %q", scope)
+		}
+		seen[scope] = struct{}{}
+		scopes = append(scopes, scope)
+	}
+	sort.Strings(scopes)
+	return
+}
+
+func isValidScope(scope string)(bool){
+	for _, s := range allScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// joinScopes encodes scopes to be saved in the database, nil means not limited
+func joinScopes(scopes []string)(any){
+	if len(scopes) == 0 {
+		return nil
+	}
+	return strings.Join(scopes, " ")
+}
+
+func splitScopes(s string)(scopes []string){
+	if scopes = strings.Fields(s); len(scopes) == 0 {
+		return nil
+	}
+	return
+}
+
+// hasScope reports whether the scopes allow the operation, empty scopes allow everything
+func hasScope(scopes []string, scope string)(bool){
+	if len(scopes) == 0 {
+		return true
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// checkScope returns false if the token is invalid or does not have the scope
+func checkScope(api DataAPI, token string, scope string)(bool){
+	scopes, err := api.GetScopes(token)
+	if err != nil {
+		return false
+	}
+	return hasScope(scopes, scope)
+}
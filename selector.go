@@ -0,0 +1,179 @@
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxDeviceTags = 32
+	maxTagLength = 64
+)
+
+// normalizeTags trims, lowercases, deduplicates and sorts the tags, the empty ones are dropped
+func normalizeTags(tags []string)(res []string, err error){
+	res = make([]string, 0, len(tags))
+	seen := make(map[string]struct{}, len(tags))
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if len(t) == 0 {
+			continue
+		}
+		if len(t) > maxTagLength {
+			return nil, fmt.Errorf("Tag %q is longer than %d characters", t, maxTagLength)
+		}
+		if strings.ContainsAny(t, ", ") {
+			return nil, fmt.Errorf("Tag %q cannot contain comma or space", t)
+		}
+		if _, ok := seen[t]; !ok {
+			seen[t] = struct{}{}
+			res = append(res, t)
+		}
+	}
+	if len(res) > maxDeviceTags {
+		return nil, fmt.Errorf("A device cannot have more than %d tags", maxDeviceTags)
+	}
+	sort.Strings(res)
+	return
+}
+
+// parseTagList reads the tags from a json list, the items which are not string are errors
+func parseTagList(l List)(tags []string, err error){
+	tags = make([]string, len(l))
+	for i := range l {
+		var ok bool
+		if tags[i], ok = l.GetString(i); !ok {
+			return nil, fmt.Errorf("Tag at index %d is not a string", i)
+		}
+	}
+	return normalizeTags(tags)
+}
+
+// mergeTags returns the sorted union of two normalized tag lists
+func mergeTags(a, b []string)(res []string){
+	res = make([]string, 0, len(a) + len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			res, a = append(res, a[0]), a[1:]
+		case a[0] > b[0]:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			res, a, b = append(res, a[0]), a[1:], b[1:]
+		}
+	}
+	res = append(res, a...)
+	return append(res, b...)
+}
+
+// IdRange is an inclusive range of the device ids, Max is -1 if it's unbounded
+type IdRange struct {
+	Min int64
+	Max int64
+}
+
+func (r IdRange)Contains(id int64)(bool){
+	return id >= r.Min && (r.Max < 0 || id <= r.Max)
+}
+
+// parseIdRanges parses the ranges such as "1-5,8,10-"
+func parseIdRanges(s string)(ranges []IdRange, err error){
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		var r IdRange
+		lo, hi, isRange := strings.Cut(part, "-")
+		if r.Min, err = strconv.ParseInt(strings.TrimSpace(lo), 10, 64); err != nil || r.Min < 0 {
+			return nil, fmt.Errorf("Invalid id range %q", part)
+		}
+		r.Max = r.Min
+		if isRange {
+			if hi = strings.TrimSpace(hi); len(hi) == 0 {
+				r.Max = -1
+			}else if r.Max, err = strconv.ParseInt(hi, 10, 64); err != nil || r.Max < r.Min {
+				return nil, fmt.Errorf("Invalid id range %q", part)
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// DeviceSelector selects the devices of a host, all the set fields must match.
+// An empty selector matches every device
+type DeviceSelector struct {
+	// Tags the device must have all of
+	Tags []string
+	// Device is the device type, such as turtle
+	Device string
+	// Label is a glob pattern of the label
+	Label string
+	Ids   []IdRange
+}
+
+// ParseDeviceSelector reads the selector from a packet, such as
+// {"tags": ["miner"], "device": "turtle", "label": "north-*", "ids": "1-5,8"}
+func ParseDeviceSelector(m Map)(sel *DeviceSelector, err error){
+	sel = new(DeviceSelector)
+	if tags, ok := m.GetList("tags"); ok {
+		if sel.Tags, err = parseTagList(tags); err != nil {
+			return nil, err
+		}
+	}
+	sel.Device, _ = m.GetString("device")
+	if sel.Label, _ = m.GetString("label"); len(sel.Label) != 0 {
+		if _, err = path.Match(sel.Label, ""); err != nil {
+			return nil, fmt.Errorf("Invalid label pattern %q: %w", sel.Label, err)
+		}
+	}
+	if ids, ok := m.GetString("ids"); ok {
+		if sel.Ids, err = parseIdRanges(ids); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func (s *DeviceSelector)matchId(id int64)(bool){
+	if len(s.Ids) == 0 {
+		return true
+	}
+	for _, r := range s.Ids {
+		if r.Contains(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether the device matches the selector, tags must be normalized
+func (s *DeviceSelector)Match(id int64, device string, label string, tags []string)(bool){
+	if !s.matchId(id) {
+		return false
+	}
+	if len(s.Device) != 0 && s.Device != device {
+		return false
+	}
+	if len(s.Label) != 0 {
+		if ok, _ := path.Match(s.Label, label); !ok {
+			return false
+		}
+	}
+	for _, t := range s.Tags {
+		i := sort.SearchStrings(tags, t)
+		if i >= len(tags) || tags[i] != t {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *DeviceSelector)MatchConn(c *Conn)(bool){
+	return s.Match(c.Id(), c.Device(), c.Label(), c.Tags())
+}
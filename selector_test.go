@@ -0,0 +1,78 @@
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseIdRanges(t *testing.T){
+	ranges, err := parseIdRanges("1-5, 8,10-")
+	if err != nil {
+		t.Fatalf("Cannot parse id ranges: %v", err)
+	}
+	expects := []IdRange{{1, 5}, {8, 8}, {10, -1}}
+	if len(ranges) != len(expects) {
+		t.Fatalf("Expect %v, got %v", expects, ranges)
+	}
+	for i, r := range ranges {
+		if r != expects[i] {
+			t.Errorf("Expect range %d to be %v, got %v", i, expects[i], r)
+		}
+	}
+	for _, s := range []string{"a", "5-1", "-3", "1-b"} {
+		if _, err := parseIdRanges(s); err == nil {
+			t.Errorf("Expect %q to be invalid", s)
+		}
+	}
+}
+
+func TestDeviceSelectorMatch(t *testing.T){
+	sel, err := ParseDeviceSelector(Map{
+		"tags": []any{"Miner"},
+		"device": "turtle",
+		"label": "north-*",
+		"ids": "1-5,8",
+	})
+	if err != nil {
+		t.Fatalf("Cannot parse selector: %v", err)
+	}
+	tags := []string{"farm-north", "miner"}
+	type device struct {
+		id int64
+		device string
+		label string
+		tags []string
+	}
+	cases := []struct {
+		d device
+		match bool
+	}{
+		{device{1, "turtle", "north-1", tags}, true},
+		{device{8, "turtle", "north-8", tags}, true},
+		{device{6, "turtle", "north-6", tags}, false},
+		{device{2, "computer", "north-2", tags}, false},
+		{device{3, "turtle", "south-3", tags}, false},
+		{device{4, "turtle", "north-4", []string{"farm-north"}}, false},
+	}
+	for _, c := range cases {
+		if sel.Match(c.d.id, c.d.device, c.d.label, c.d.tags) != c.match {
+			t.Errorf("Expect %v to match: %v", c.d, c.match)
+		}
+	}
+	if !(&DeviceSelector{}).Match(6, "pocket", "", nil) {
+		t.Errorf("Expect the empty selector to match every device")
+	}
+	if _, err := ParseDeviceSelector(Map{"label": "["}); err == nil {
+		t.Errorf("Expect the invalid label pattern to be rejected")
+	}
+}
+
+func TestMergeTags(t *testing.T){
+	res := mergeTags([]string{"a", "c", "d"}, []string{"b", "c", "e"})
+	if !equalStrings(res, []string{"a", "b", "c", "d", "e"}) {
+		t.Errorf("Unexpected merged tags %v", res)
+	}
+	if res := mergeTags(nil, []string{"a"}); !equalStrings(res, []string{"a"}) {
+		t.Errorf("Unexpected merged tags %v", res)
+	}
+}
@@ -0,0 +1,293 @@
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestSessionRevoked(t *testing.T){
+	mem, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	api := NewCachedDataAPI(mem, time.Minute)
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create token: %v", err)
+	}
+	if err = api.SetRoot(tk, true); err != nil {
+		t.Fatalf("Cannot set root: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/wscli", &websocket.DialOptions{
+		HTTPHeader: http.Header{"Authorization": {tk}},
+	})
+	if err != nil {
+		t.Fatalf("Cannot dial: %v", err)
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+
+	// wait until the connection is registered
+	for i := 0; ; i++ {
+		h.cliMux.RLock()
+		n := len(h.clients)
+		h.cliMux.RUnlock()
+		if n != 0 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("The client is not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	readRevoked := func()(data Map){
+		for {
+			var msg Map
+			if err := wsjson.Read(ctx, ws, &msg); err != nil {
+				t.Fatalf("Cannot read session_revoked: %v", err)
+			}
+			if msg["type"] == "session_revoked" {
+				data, _ := msg["data"].(map[string]any)
+				return data
+			}
+		}
+	}
+
+	if err = api.SetRoot(tk, false); err != nil {
+		t.Fatalf("Cannot unset root: %v", err)
+	}
+	if data := readRevoked(); data["closed"] != false || data["root"] != true {
+		t.Errorf("Expect the session to be downgraded, got %v", data)
+	}
+
+	if err = api.RemoveCliToken(tk); err != nil {
+		t.Fatalf("Cannot remove token: %v", err)
+	}
+	if data := readRevoked(); data["closed"] != true {
+		t.Errorf("Expect the session to be closed, got %v", data)
+	}
+	var msg Map
+	if err = wsjson.Read(ctx, ws, &msg); websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Errorf("Expect the connection to be closed with policy violation, got %v", err)
+	}
+}
+
+// flakyAPI fails the scope lookups while fail is set, like a database that is down
+type flakyAPI struct {
+	DataAPI
+	fail atomic.Bool
+}
+
+func (v *flakyAPI)GetScopes(token string)(scopes []string, err error){
+	if v.fail.Load() {
+		return nil, errors.New("database is down")
+	}
+	return v.DataAPI.GetScopes(token)
+}
+
+func TestRefreshPermsLookupError(t *testing.T){
+	mem, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	api := &flakyAPI{DataAPI: mem}
+	tk, err := api.NewCliToken(nil)
+	if err != nil {
+		t.Fatalf("Cannot create token: %v", err)
+	}
+	c := &CliConn{
+		handler: NewHandler(api, nil, nil),
+		token: tk,
+	}
+	c.refreshPerms()
+	if !c.hasScope(ScopeHostsRead) {
+		t.Fatalf("Expect the token to be valid")
+	}
+	api.fail.Store(true)
+	c.refreshPerms()
+	if !c.hasScope(ScopeHostsRead) {
+		t.Errorf("Expect the permissions to be kept when the lookup fails")
+	}
+	api.fail.Store(false)
+	if err = api.RemoveCliToken(tk); err != nil {
+		t.Fatalf("Cannot remove token: %v", err)
+	}
+	c.refreshPerms()
+	if c.hasScope(ScopeHostsRead) {
+		t.Errorf("Expect the removed token to be invalid")
+	}
+}
+
+// noScopesAPI cannot write the scopes of the tokens
+type noScopesAPI struct {
+	DataAPI
+}
+
+func (v *noScopesAPI)SetScopes(token string, scopes []string)(err error){
+	return errors.New("database is down")
+}
+
+func TestCreateTokenScopesError(t *testing.T){
+	mem, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	tokens, err := mem.ListTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Expect one root token, got %v, %v", tokens, err)
+	}
+	mux := NewHandler(&noScopesAPI{mem}, nil, nil).NewServeMux()
+	req := httptest.NewRequest("POST", "/api/create_token?scopes=hosts:read", nil)
+	req.Header.Set("Authorization", tokens[0].Token)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("Expect create_token to fail, got %d %s", rw.Code, rw.Body.String())
+	}
+	// the token without its scopes would be unlimited
+	if tokens, _ = mem.ListTokens(); len(tokens) != 1 {
+		t.Errorf("Expect the new token to be removed, got %v", tokens)
+	}
+}
+
+func TestDeviceSessionResume(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	if err = api.CreateServer("h1"); err != nil {
+		t.Fatalf("Cannot create server: %v", err)
+	}
+	dtk, err := api.NewDaemonToken("h1", nil)
+	if err != nil {
+		t.Fatalf("Cannot create daemon token: %v", err)
+	}
+	h := NewHandler(api, nil, nil)
+	h.SetResumeGrace(200 * time.Millisecond)
+	srv := httptest.NewServer(h.NewServeMux())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	dial := func(session string)(*websocket.Conn, Map){
+		header := http.Header{
+			"X-CC-Auth": {dtk},
+			"X-CC-Host": {"h1"},
+			"X-CC-ID": {"1"},
+		}
+		if len(session) != 0 {
+			header.Set("X-CC-Session", session)
+		}
+		ws, _, err := websocket.Dial(ctx, "ws" + strings.TrimPrefix(srv.URL, "http") + "/wsd", &websocket.DialOptions{
+			HTTPHeader: header,
+		})
+		if err != nil {
+			return nil, nil
+		}
+		var msg Map
+		if err := wsjson.Read(ctx, ws, &msg); err != nil || msg["type"] != "session" {
+			t.Fatalf("Expect the session packet first, got %v, %v", msg, err)
+		}
+		data, _ := msg["data"].(map[string]any)
+		return ws, data
+	}
+	readType := func(ws *websocket.Conn, typ string){
+		for {
+			var msg Map
+			if err := wsjson.Read(ctx, ws, &msg); err != nil {
+				t.Fatalf("Cannot read %s: %v", typ, err)
+			}
+			if msg["type"] == typ {
+				return
+			}
+		}
+	}
+
+	ws, data := dial("")
+	if ws == nil {
+		t.Fatalf("Cannot dial")
+	}
+	session, _ := data["id"].(string)
+	if len(session) == 0 || data["resumed"] != false {
+		t.Fatalf("Expect a new session, got %v", data)
+	}
+	readType(ws, "run")
+	conn := h.GetHost("h1").GetConn(1)
+	if conn == nil || conn.Session() != session {
+		t.Fatalf("Expect the device to be connected with session %s, got %v", session, conn)
+	}
+
+	if other, _ := dial("ses_wrong"); other != nil {
+		t.Errorf("Another session should not take over an online device")
+	}
+
+	ws.Close(websocket.StatusGoingAway, "")
+	for i := 0; conn.Online(); i++ {
+		if i > 100 {
+			t.Fatalf("The device should be offline")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err = conn.send(Map{"type": "buffered"}); err != nil {
+		t.Fatalf("Cannot buffer packet: %v", err)
+	}
+
+	ws, data = dial(session)
+	if ws == nil || data["resumed"] != true {
+		t.Fatalf("Expect the session to be resumed, got %v", data)
+	}
+	readType(ws, "buffered")
+	if h.GetHost("h1").GetConn(1) != conn || len(conn.GetTerms()) != 1 {
+		t.Errorf("Expect the session and its terminal to be kept")
+	}
+
+	ws.Close(websocket.StatusGoingAway, "")
+	select {
+	case <-conn.Context().Done():
+	case <-ctx.Done():
+		t.Fatalf("The session should end after the grace period")
+	}
+	if ws, _ = dial(session); ws == nil {
+		t.Fatalf("Cannot dial")
+	}
+	if c := h.GetHost("h1").GetConn(1); c == nil || c == conn {
+		t.Errorf("Expect a new session after the old one ended, got %v", c)
+	}
+	ws.Close(websocket.StatusNormalClosure, "")
+}
+
+func TestDetachOutboxOverflow(t *testing.T){
+	for _, backlog := range []int{maxOutboxPackets - 2, maxOutboxPackets - 1} {
+		c := &Conn{host: &HostServer{resumeGrace: time.Minute}, id: 1}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		c.wq = newWriteQueue(nil, WriteQueueConfig{Size: 4, Policy: OverflowDropOldest})
+		c.wq.push(Map{"type": "a"})
+		c.wq.push(Map{"type": "b"})
+		c.outbox = make([]Map, backlog)
+		c.detach(nil)
+		// the session cannot be resumed if some of the packets are lost
+		if lost := backlog + 2 > maxOutboxPackets; (c.ctx.Err() != nil) != lost {
+			t.Errorf("Expect the session with %d packets to end: %v, got %v", backlog + 2, lost, c.ctx.Err())
+		}
+		if c.grace != nil {
+			c.grace.Stop()
+		}
+		c.cancel()
+	}
+}
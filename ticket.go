@@ -0,0 +1,108 @@
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+const (
+	ticketPrefix = "tkt_"
+	ticketBytes = 24
+	defaultTicketTTL = 30 * time.Second
+
+	// TicketWscli is the purpose of the tickets that open /wscli
+	TicketWscli = "wscli"
+)
+
+var ticketPurposes = []string{TicketWscli}
+
+func isValidTicketPurpose(purpose string)(bool){
+	for _, p := range ticketPurposes {
+		if p == purpose {
+			return true
+		}
+	}
+	return false
+}
+
+type wsTicket struct {
+	token   string
+	purpose string
+	expires time.Time
+}
+
+// TicketStore keeps the single-use tickets that stand for a cli token for a few seconds,
+// so the streaming endpoints don't need the token in their query string.
+// Tickets only live in memory, they are lost when the server restarts.
+type TicketStore struct {
+	ttl time.Duration
+
+	mux       sync.Mutex
+	tickets   map[string]*wsTicket
+	lastSweep time.Time
+}
+
+func NewTicketStore(ttl time.Duration)(s *TicketStore){
+	if ttl <= 0 {
+		ttl = defaultTicketTTL
+	}
+	return &TicketStore{
+		ttl: ttl,
+		tickets: make(map[string]*wsTicket),
+	}
+}
+
+// sweep removes the expired tickets, it must be called with the lock held
+func (s *TicketStore)sweep(now time.Time){
+	if now.Sub(s.lastSweep) < s.ttl {
+		return
+	}
+	s.lastSweep = now
+	for k, t := range s.tickets {
+		if now.After(t.expires) {
+			delete(s.tickets, k)
+		}
+	}
+}
+
+// Issue creates a ticket of the token which can be redeemed once for the purpose before it expires
+func (s *TicketStore)Issue(token string, purpose string)(ticket string, expires time.Time, err error){
+	var buf [ticketBytes]byte
+	if _, err = rand.Read(buf[:]); err != nil {
+		return
+	}
+	ticket = ticketPrefix + base64.RawURLEncoding.EncodeToString(buf[:])
+	now := time.Now()
+	expires = now.Add(s.ttl)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sweep(now)
+	s.tickets[ticket] = &wsTicket{
+		token: token,
+		purpose: purpose,
+		expires: expires,
+	}
+	return
+}
+
+// Redeem returns the token of the ticket and invalidates it.
+// ok is false if the ticket is unknown, expired, already used or issued for another purpose
+func (s *TicketStore)Redeem(ticket string, purpose string)(token string, ok bool){
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.sweep(now)
+	t, exists := s.tickets[ticket]
+	if !exists {
+		return "", false
+	}
+	delete(s.tickets, ticket)
+	if t.purpose != purpose || now.After(t.expires) {
+		return "", false
+	}
+	return t.token, true
+}
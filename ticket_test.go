@@ -0,0 +1,42 @@
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTicketStore(t *testing.T){
+	s := NewTicketStore(50 * time.Millisecond)
+
+	ticket, exp, err := s.Issue("cli_token", TicketWscli)
+	if err != nil {
+		t.Fatalf("Cannot issue ticket: %v", err)
+	}
+	if time.Until(exp) <= 0 {
+		t.Errorf("Ticket should expire in the future, got %v", exp)
+	}
+	if token, ok := s.Redeem(ticket, TicketWscli); !ok || token != "cli_token" {
+		t.Errorf("Expect token cli_token, got %q, %v", token, ok)
+	}
+	if _, ok := s.Redeem(ticket, TicketWscli); ok {
+		t.Errorf("Ticket should only be redeemed once")
+	}
+
+	ticket, _, _ = s.Issue("cli_token", TicketWscli)
+	if _, ok := s.Redeem(ticket, "other"); ok {
+		t.Errorf("Ticket should not be redeemed for another purpose")
+	}
+	if _, ok := s.Redeem(ticket, TicketWscli); ok {
+		t.Errorf("Ticket should be invalidated after a failed redeem")
+	}
+
+	ticket, _, _ = s.Issue("cli_token", TicketWscli)
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := s.Redeem(ticket, TicketWscli); ok {
+		t.Errorf("Expired ticket should not be redeemed")
+	}
+	if _, ok := s.Redeem("", TicketWscli); ok {
+		t.Errorf("Empty ticket should not be redeemed")
+	}
+}
@@ -0,0 +1,66 @@
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	maxUsernameLen = 64
+	minPasswordLen = 8
+	maxPasswordLen = 72 // bcrypt only uses the first 72 bytes
+)
+
+var (
+	InvalidCredentialErr = errors.New("Invalid username or password")
+)
+
+// dummyPasswordHash is compared when the user does not exist,
+// so the response time does not tell whether a username is registered
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+func checkUsername(username string)(err error){
+	if len(username) == 0 || len(username) > maxUsernameLen {
+		return fmt.Errorf("Username must have 1 to %d characters", maxUsernameLen)
+	}
+	for _, c := range username {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return fmt.Errorf("Username contains invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+func hashPassword(password string)(hash string, err error){
+	if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return "", fmt.Errorf("Password must have %d to %d bytes", minPasswordLen, maxPasswordLen)
+	}
+	buf, err := bcrypt.GenerateFromPassword(([]byte)(password), bcrypt.DefaultCost)
+	if err != nil {
+		return
+	}
+	return (string)(buf), nil
+}
+
+// checkUserPassword returns InvalidCredentialErr if the user does not exist,
+// has no password, or the password does not match
+func checkUserPassword(api DataAPI, username string, password string)(err error){
+	hash, err := api.GetUserPassword(username)
+	if err != nil {
+		if !errors.Is(err, UserNotExistsErr) {
+			return
+		}
+		hash = ""
+	}
+	if len(hash) == 0 {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, ([]byte)(password))
+		return InvalidCredentialErr
+	}
+	if bcrypt.CompareHashAndPassword(([]byte)(hash), ([]byte)(password)) != nil {
+		return InvalidCredentialErr
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckUserPassword(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	hash, err := hashPassword("correct horse")
+	if err != nil {
+		t.Fatalf("Cannot hash password: %v", err)
+	}
+	if err = api.CreateUser("alice", hash); err != nil {
+		t.Fatalf("Cannot create user: %v", err)
+	}
+	if err = api.CreateUser("bob", ""); err != nil {
+		t.Fatalf("Cannot create user: %v", err)
+	}
+	if err = checkUserPassword(api, "alice", "correct horse"); err != nil {
+		t.Errorf("Correct password is rejected: %v", err)
+	}
+	if err = checkUserPassword(api, "alice", "wrong horse"); err != InvalidCredentialErr {
+		t.Errorf("Expect InvalidCredentialErr for wrong password, got %v", err)
+	}
+	if err = checkUserPassword(api, "bob", ""); err != InvalidCredentialErr {
+		t.Errorf("Expect InvalidCredentialErr for user without password, got %v", err)
+	}
+	if err = checkUserPassword(api, "carol", "correct horse"); err != InvalidCredentialErr {
+		t.Errorf("Expect InvalidCredentialErr for unknown user, got %v", err)
+	}
+	if _, err = hashPassword("short"); err == nil {
+		t.Errorf("Short password should be rejected")
+	}
+}
+
+func TestLogout(t *testing.T){
+	api, err := NewMemAPI("")
+	if err != nil {
+		t.Fatalf("Cannot create memory api: %v", err)
+	}
+	tokens, err := api.ListTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Expect one root token, got %v, %v", tokens, err)
+	}
+	root := tokens[0].Token
+	if err = api.CreateUser("alice", ""); err != nil {
+		t.Fatalf("Cannot create user: %v", err)
+	}
+	utk, err := api.NewUserToken("alice", nil)
+	if err != nil {
+		t.Fatalf("Cannot create user token: %v", err)
+	}
+	mux := NewHandler(api, nil, nil).NewServeMux()
+	logout := func(token string)(int){
+		req := httptest.NewRequest("POST", "/api/logout", nil)
+		req.Header.Set("Authorization", token)
+		rw := httptest.NewRecorder()
+		mux.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if code := logout(root); code != http.StatusForbidden {
+		t.Errorf("Expect the root token to be rejected, got %d", code)
+	}
+	if !api.AuthCli(root) {
+		t.Errorf("Root token should not be removed by logout")
+	}
+	if code := logout(utk); code != http.StatusOK {
+		t.Errorf("Expect the user token to log out, got %d", code)
+	}
+	if api.AuthCli(utk) {
+		t.Errorf("User token should be removed by logout")
+	}
+}
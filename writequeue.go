@@ -0,0 +1,460 @@
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// OverflowPolicy is what a connection does when its write queue is full
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest drops the oldest queued packet
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowCoalesce replaces the queued updates of a terminal with one term.resync packet,
+	// and the client fetches the whole terminal again. The oldest packet is dropped if no update can be coalesced
+	OverflowCoalesce OverflowPolicy = "coalesce"
+	// OverflowDisconnect closes the connection, a device can still resume its session
+	OverflowDisconnect OverflowPolicy = "disconnect"
+)
+
+var (
+	WriteQueueClosedErr = errors.New("Write queue is closed")
+	WriteQueueOverflowErr = errors.New("Write queue overflowed")
+)
+
+// WriteQueueConfig limits the packets waiting to be written to a connection
+type WriteQueueConfig struct {
+	// Size is the packets that can be queued
+	Size int `json:"size"`
+	// Policy is one of "drop_oldest", "coalesce" and "disconnect"
+	Policy OverflowPolicy `json:"policy"`
+	// WriteTimeout is the seconds that a packet can take to be written before the connection is closed
+	WriteTimeout int `json:"write_timeout"`
+}
+
+var (
+	defaultClientWriteQueue = WriteQueueConfig{
+		Size: 256,
+		Policy: OverflowCoalesce,
+		WriteTimeout: 10,
+	}
+	// the packets to a device are mostly requests, so they are kept for the resumption instead of being dropped
+	defaultDeviceWriteQueue = WriteQueueConfig{
+		Size: 256,
+		Policy: OverflowDisconnect,
+		WriteTimeout: 10,
+	}
+)
+
+// withDefaults returns the config with its zero fields set to def
+func (cfg WriteQueueConfig)withDefaults(def WriteQueueConfig)(WriteQueueConfig){
+	if cfg.Size <= 0 {
+		cfg.Size = def.Size
+	}
+	if len(cfg.Policy) == 0 {
+		cfg.Policy = def.Policy
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = def.WriteTimeout
+	}
+	return cfg
+}
+
+func (cfg WriteQueueConfig)check()(error){
+	switch cfg.Policy {
+	case "", OverflowDropOldest, OverflowCoalesce, OverflowDisconnect:
+		return nil
+	}
+	return fmt.Errorf("Unknown overflow policy %q", cfg.Policy)
+}
+
+// WriteQueueStats is the metric of a write queue
+type WriteQueueStats struct {
+	Depth    int   `json:"depth"`
+	MaxDepth int   `json:"max_depth"`
+	// Dropped are the packets that are dropped or coalesced because the queue was full
+	Dropped  int64 `json:"dropped"`
+	Overflows int64 `json:"overflows"`
+}
+
+type queuedPacket struct {
+	data Map
+	// key is the coalescing key of a terminal update, empty for the other packets
+	key  string
+	resync bool
+	// written receives the result of the write if it's not nil
+	written chan<- error
+}
+
+// writeQueue is the bounded outbound queue of a websocket, the packets are written by a single goroutine,
+// so a slow peer doesn't block the senders
+type writeQueue struct {
+	ws  *websocket.Conn
+	cfg WriteQueueConfig
+	// coalesceKey returns the key of the packets that can be replaced by one resync packet
+	coalesceKey func(data Map)(key string)
+	resync      func(data Map)(Map)
+	// onClose is called once after the queue is closed because of an overflow or a write error
+	onClose func(err error)
+
+	mux       sync.Mutex
+	packets   []queuedPacket
+	// reserved are the preloaded packets in the queue, which don't take the room of the new packets
+	reserved  int
+	resyncing map[string]struct{}
+	closed    bool
+	wake      chan struct{}
+	done      chan struct{}
+
+	maxDepth  int
+	dropped   atomic.Int64
+	overflows atomic.Int64
+}
+
+// newWriteQueue creates the queue of ws, the zero fields of cfg must be set
+func newWriteQueue(ws *websocket.Conn, cfg WriteQueueConfig)(q *writeQueue){
+	return &writeQueue{
+		ws: ws,
+		cfg: cfg,
+		resyncing: make(map[string]struct{}),
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+}
+
+// preload queues the backlog of the socket before the writer starts, it can exceed the size of the queue
+func (q *writeQueue)preload(backlog []Map){
+	for _, data := range backlog {
+		q.packets = append(q.packets, queuedPacket{data: data})
+	}
+	q.reserved = len(q.packets)
+	q.maxDepth = q.reserved
+}
+
+// start runs the writer until ctx is done or the queue is closed
+func (q *writeQueue)start(ctx context.Context){
+	go q.run(ctx)
+}
+
+func (q *writeQueue)run(ctx context.Context){
+	defer close(q.done)
+	timeout := (time.Duration)(q.cfg.WriteTimeout) * time.Second
+	for {
+		p, ok := q.next(ctx)
+		if !ok {
+			return
+		}
+		wctx, cancel := context.WithTimeout(ctx, timeout)
+		err := wsjson.Write(wctx, q.ws, p.data)
+		cancel()
+		if p.written != nil {
+			p.written <- err
+		}
+		if err != nil {
+			if p.written == nil && len(p.key) == 0 {
+				// keep the packet, so it can be taken by stop
+				q.mux.Lock()
+				q.packets = append([]queuedPacket{p}, q.packets...)
+				q.mux.Unlock()
+			}
+			q.fail(err)
+			return
+		}
+	}
+}
+
+// next waits for the next packet
+func (q *writeQueue)next(ctx context.Context)(p queuedPacket, ok bool){
+	for {
+		q.mux.Lock()
+		if q.closed {
+			q.mux.Unlock()
+			return
+		}
+		if len(q.packets) != 0 {
+			p = q.packets[0]
+			q.packets[0] = queuedPacket{}
+			q.packets = q.packets[1:]
+			if q.reserved > 0 {
+				q.reserved--
+			}
+			if p.resync {
+				delete(q.resyncing, p.key)
+			}
+			q.mux.Unlock()
+			return p, true
+		}
+		q.mux.Unlock()
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (q *writeQueue)fail(err error){
+	q.mux.Lock()
+	if q.closed {
+		q.mux.Unlock()
+		return
+	}
+	q.closed = true
+	q.mux.Unlock()
+	q.notify()
+	if q.onClose != nil {
+		q.onClose(err)
+	}
+}
+
+func (q *writeQueue)notify(){
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// push queues the packet, it only returns an error if the queue is closed or it's overflowed with the disconnect policy
+func (q *writeQueue)push(data Map)(err error){
+	return q.pushPacket(queuedPacket{data: data})
+}
+
+// pushWait queues the packet and waits until it's written
+func (q *writeQueue)pushWait(ctx context.Context, data Map)(err error){
+	written := make(chan error, 1)
+	if err = q.pushPacket(queuedPacket{data: data, written: written}); err != nil {
+		return
+	}
+	select {
+	case err = <-written:
+		return
+	case <-q.done:
+		select {
+		case err = <-written:
+			return
+		default:
+			return WriteQueueClosedErr
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *writeQueue)pushPacket(p queuedPacket)(err error){
+	if q.coalesceKey != nil && p.written == nil {
+		p.key = q.coalesceKey(p.data)
+	}
+	q.mux.Lock()
+	if q.closed {
+		q.mux.Unlock()
+		return WriteQueueClosedErr
+	}
+	if len(p.key) != 0 {
+		if _, ok := q.resyncing[p.key]; ok {
+			// the client will fetch the whole terminal after the queued resync packet
+			q.mux.Unlock()
+			q.dropped.Add(1)
+			return nil
+		}
+	}
+	if len(q.packets) >= q.cfg.Size + q.reserved {
+		q.overflows.Add(1)
+		if !q.makeRoom() {
+			q.mux.Unlock()
+			q.fail(WriteQueueOverflowErr)
+			return WriteQueueOverflowErr
+		}
+		if len(p.key) != 0 {
+			if _, ok := q.resyncing[p.key]; ok {
+				q.mux.Unlock()
+				q.dropped.Add(1)
+				return nil
+			}
+		}
+	}
+	q.packets = append(q.packets, p)
+	if len(q.packets) > q.maxDepth {
+		q.maxDepth = len(q.packets)
+	}
+	q.mux.Unlock()
+	q.notify()
+	return nil
+}
+
+// makeRoom frees at least one slot of the full queue by the overflow policy, q.mux must be held
+func (q *writeQueue)makeRoom()(ok bool){
+	switch q.cfg.Policy {
+	case OverflowDisconnect:
+		return false
+	case OverflowCoalesce:
+		if q.coalesce() {
+			return true
+		}
+	}
+	// the packets that someone is waiting for are not dropped
+	for i, p := range q.packets {
+		if p.written == nil && !p.resync {
+			q.packets = append(q.packets[:i], q.packets[i + 1:]...)
+			if i < q.reserved {
+				q.reserved--
+			}
+			q.dropped.Add(1)
+			return true
+		}
+	}
+	return false
+}
+
+// coalesce replaces the queued updates of the terminal that has the oldest update with a resync packet
+func (q *writeQueue)coalesce()(bool){
+	first := -1
+	for i, p := range q.packets {
+		if len(p.key) != 0 && !p.resync {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return false
+	}
+	key := q.packets[first].key
+	packets := make([]queuedPacket, first, len(q.packets))
+	copy(packets, q.packets[:first])
+	packets = append(packets, queuedPacket{data: q.resync(q.packets[first].data), key: key, resync: true})
+	n := 0
+	for _, p := range q.packets[first:] {
+		if p.key == key {
+			n++
+		}else{
+			packets = append(packets, p)
+		}
+	}
+	q.packets = packets
+	q.resyncing[key] = struct{}{}
+	q.dropped.Add((int64)(n))
+	// a single update is replaced by the resync packet, so the oldest packet is dropped instead
+	if n == 1 {
+		return false
+	}
+	return true
+}
+
+// stop closes the queue and returns the packets that are not written, the writer exits without closing the socket
+func (q *writeQueue)stop()(rest []Map){
+	q.mux.Lock()
+	q.closed = true
+	packets := q.packets
+	q.packets = nil
+	q.reserved = 0
+	q.mux.Unlock()
+	q.notify()
+	for _, p := range packets {
+		if p.written != nil {
+			p.written <- WriteQueueClosedErr
+		}else if len(p.key) == 0 {
+			rest = append(rest, p.data)
+		}
+	}
+	return
+}
+
+func (q *writeQueue)Stats()(s WriteQueueStats){
+	q.mux.Lock()
+	s.Depth = len(q.packets)
+	s.MaxDepth = q.maxDepth
+	q.mux.Unlock()
+	s.Dropped = q.dropped.Load()
+	s.Overflows = q.overflows.Load()
+	return
+}
+
+// termUpdateKey returns the coalescing key of a term.oper packet to a client, which is unique for each terminal
+func termUpdateKey(data Map)(string){
+	if typ, _ := data.GetString("type"); typ != "term.oper" {
+		return ""
+	}
+	host, _ := data.GetString("host")
+	dt, _ := data["data"].(Map)
+	conn, ok := dt.GetInt64("conn")
+	if !ok {
+		return ""
+	}
+	args, _ := dt["args"].(List)
+	if len(args) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d/%v", host, conn, args[0])
+}
+
+// termResyncPacket tells the client that some updates of the terminal are dropped, so it should fetch the terminal again
+func termResyncPacket(data Map)(Map){
+	dt, _ := data["data"].(Map)
+	args, _ := dt["args"].(List)
+	return Map{
+		"type": "term.resync",
+		"host": data["host"],
+		"data": Map{
+			"conn": dt["conn"],
+			"args": List{args[0]},
+		},
+	}
+}
+
+// ConnQueueMetric is the write queue of a client or a device connection
+type ConnQueueMetric struct {
+	Addr   string `json:"addr"`
+	// Host and Device are empty for the clients
+	Host   string `json:"host,omitempty"`
+	Device *int64 `json:"device,omitempty"`
+	WriteQueueStats
+}
+
+func (s *WriteQueueStats)add(o WriteQueueStats){
+	s.Depth += o.Depth
+	if o.MaxDepth > s.MaxDepth {
+		s.MaxDepth = o.MaxDepth
+	}
+	s.Dropped += o.Dropped
+	s.Overflows += o.Overflows
+}
+
+// WriteQueueMetrics returns the write queues of the online connections, and the sum of them
+func (h *Handler)WriteQueueMetrics()(conns []ConnQueueMetric, total WriteQueueStats){
+	h.cliMux.RLock()
+	for c, _ := range h.clients {
+		m := ConnQueueMetric{
+			Addr: c.Addr(),
+			WriteQueueStats: c.QueueStats(),
+		}
+		total.add(m.WriteQueueStats)
+		conns = append(conns, m)
+	}
+	h.cliMux.RUnlock()
+	for _, host := range h.GetHosts() {
+		for _, conn := range host.GetConns() {
+			q := conn.queue()
+			if q == nil {
+				continue
+			}
+			id := conn.Id()
+			m := ConnQueueMetric{
+				Addr: conn.Addr(),
+				Host: host.Id(),
+				Device: &id,
+				WriteQueueStats: q.Stats(),
+			}
+			total.add(m.WriteQueueStats)
+			conns = append(conns, m)
+		}
+	}
+	return
+}
@@ -0,0 +1,124 @@
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func termOperPacket(tid int, oper string)(Map){
+	return Map{
+		"type": "term.oper",
+		"host": "h1",
+		"data": Map{
+			"conn": (int64)(1),
+			"args": List{tid, oper, List{}},
+		},
+	}
+}
+
+func queuedTypes(q *writeQueue)(types []string){
+	q.mux.Lock()
+	defer q.mux.Unlock()
+	for _, p := range q.packets {
+		typ, _ := p.data.GetString("type")
+		if typ == "term.oper" {
+			args := p.data["data"].(Map)["args"].(List)
+			typ += ":" + args[1].(string)
+		}
+		types = append(types, typ)
+	}
+	return
+}
+
+func equalStrings(a, b []string)(bool){
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if b[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWriteQueueOverflow(t *testing.T){
+	// the writers are not started, so the queues act like the peers are stuck
+	q := newWriteQueue(nil, WriteQueueConfig{Size: 2, Policy: OverflowDropOldest})
+	for _, typ := range []string{"a", "b", "c"} {
+		if err := q.push(Map{"type": typ}); err != nil {
+			t.Fatalf("Cannot push %s: %v", typ, err)
+		}
+	}
+	if types := queuedTypes(q); !equalStrings(types, []string{"b", "c"}) {
+		t.Errorf("Expect the oldest packet to be dropped, got %v", types)
+	}
+	if s := q.Stats(); s.Depth != 2 || s.MaxDepth != 2 || s.Dropped != 1 || s.Overflows != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	q = newWriteQueue(nil, WriteQueueConfig{Size: 2, Policy: OverflowDisconnect})
+	var closeErr error
+	q.onClose = func(err error){ closeErr = err }
+	q.push(Map{"type": "a"})
+	q.push(Map{"type": "b"})
+	if err := q.push(Map{"type": "c"}); !errors.Is(err, WriteQueueOverflowErr) || !errors.Is(closeErr, WriteQueueOverflowErr) {
+		t.Errorf("Expect the queue to be closed by the overflow, got %v, %v", err, closeErr)
+	}
+	if err := q.push(Map{"type": "d"}); !errors.Is(err, WriteQueueClosedErr) {
+		t.Errorf("Expect the queue to be closed, got %v", err)
+	}
+	if rest := q.stop(); len(rest) != 2 {
+		t.Errorf("Expect the unwritten packets, got %v", rest)
+	}
+}
+
+func TestWriteQueueCoalesce(t *testing.T){
+	q := newWriteQueue(nil, WriteQueueConfig{Size: 3, Policy: OverflowCoalesce})
+	q.coalesceKey = termUpdateKey
+	q.resync = termResyncPacket
+	q.push(termOperPacket(1, "write"))
+	q.push(termOperPacket(1, "setCursorPos"))
+	q.push(Map{"type": "device_join"})
+	// the queued updates of term 1 are replaced, and the new one is covered by the resync
+	q.push(termOperPacket(1, "clear"))
+	q.push(termOperPacket(2, "write"))
+	if types := queuedTypes(q); !equalStrings(types, []string{"term.resync", "device_join", "term.oper:write"}) {
+		t.Fatalf("Unexpected queue %v", types)
+	}
+	if s := q.Stats(); s.Dropped != 3 || s.Overflows != 1 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	p, ok := q.next(context.Background())
+	if !ok || p.data["type"] != "term.resync" {
+		t.Fatalf("Expect the resync packet, got %v", p.data)
+	}
+	if dt := p.data["data"].(Map); dt["conn"] != (int64)(1) || dt["args"].(List)[0] != 1 {
+		t.Errorf("Expect the resync of term 1, got %v", p.data)
+	}
+	// the updates after the resync packet is written are sent again
+	q.push(termOperPacket(1, "scroll"))
+	if types := queuedTypes(q); !equalStrings(types, []string{"device_join", "term.oper:write", "term.oper:scroll"}) {
+		t.Errorf("Unexpected queue %v", types)
+	}
+}
+
+func TestWriteQueuePreload(t *testing.T){
+	q := newWriteQueue(nil, WriteQueueConfig{Size: 2, Policy: OverflowDisconnect})
+	q.preload([]Map{{"type": "session"}, {"type": "a"}, {"type": "b"}})
+	// the backlog doesn't take the room of the new packets
+	for _, typ := range []string{"c", "d"} {
+		if err := q.push(Map{"type": typ}); err != nil {
+			t.Fatalf("Cannot push %s: %v", typ, err)
+		}
+	}
+	if p, ok := q.next(context.Background()); !ok || p.data["type"] != "session" {
+		t.Fatalf("Expect the backlog to be written first, got %v", p.data)
+	}
+	if err := q.push(Map{"type": "e"}); !errors.Is(err, WriteQueueOverflowErr) {
+		t.Errorf("Expect the queue to overflow, got %v", err)
+	}
+}